@@ -2,14 +2,19 @@ package main
 
 import (
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/peterh/liner"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -63,9 +68,160 @@ var commands = map[string]int{
 	"zcard":       40,
 	"zismember":   41,
 	"ztop":        42,
+	// connection
+	"auth": 43,
+	// admin
+	"acl": 44,
+	// database
+	"select":   45,
+	"swapdb":   46,
+	"flushdb":  47,
+	"flushall": 48,
+	// counter
+	"incr":         49,
+	"decr":         50,
+	"incrby":       51,
+	"decrby":       52,
+	"incrbyfloat":  53,
+	"hincrby":      54,
+	"hincrbyfloat": 55,
+	// string range
+	"strlen":   56,
+	"append":   57,
+	"getrange": 58,
+	"setrange": 59,
+	"getdel":   60,
+	"getex":    61,
+	// bitmap
+	"setbit":   62,
+	"getbit":   63,
+	"bitcount": 64,
+	"bitpos":   65,
+	"bitop":    66,
+	"bitfield": 67,
+	// hash
+	"hmset":      68,
+	"hmget":      69,
+	"hkeys":      70,
+	"hvals":      71,
+	"hrandfield": 72,
+	"hscan":      73,
+	"hstrlen":    74,
+	// blocking list
+	"blpop":  75,
+	"brpop":  76,
+	"blmove": 77,
+	// list move and trim
+	"lmove":     78,
+	"rpoplpush": 79,
+	"ltrim":     80,
+	"lpos":      81,
+	"lpushx":    82,
+	"rpushx":    83,
+	// set algebra
+	"sinter":      84,
+	"sintercard":  85,
+	"sinterstore": 86,
+	"sunionstore": 87,
+	"sdiffstore":  88,
+	"spop":        89,
+	"srandmember": 90,
+	"smismember":  91,
+	// zset rank and score ranges
+	"zrange":           92,
+	"zrevrange":        93,
+	"zrangebyscore":    94,
+	"zrevrangebyscore": 95,
+	"zrank":            96,
+	"zrevrank":         97,
+	"zcount":           98,
+	// zset mutation
+	"zincrby":          99,
+	"zpopmin":          167,
+	"zpopmax":          101,
+	"zremrangebyscore": 102,
+	"zremrangebyrank":  103,
+	// zset aggregation
+	"zunion":      104,
+	"zinter":      105,
+	"zdiff":       106,
+	"zunionstore": 107,
+	"zinterstore": 108,
+	"zdiffstore":  109,
+	// zset lexicographic ranges
+	"zrangebylex":    110,
+	"zrevrangebylex": 111,
+	"zlexcount":      112,
+	"zremrangebylex": 113,
+	// keyspace
+	"type":     114,
+	"exists":   115,
+	"del":      116,
+	"unlink":   117,
+	"rename":   118,
+	"renamenx": 119,
+	"copy":     120,
+	// stream
+	"xadd":       121,
+	"xlen":       122,
+	"xrange":     123,
+	"xrevrange":  124,
+	"xread":      125,
+	"xreadgroup": 126,
+	"xgroup":     127,
+	"xack":       128,
+	"xpending":   129,
+	"xclaim":     130,
+	// hyperloglog
+	"pfadd":   131,
+	"pfcount": 132,
+	"pfmerge": 133,
+	// geo
+	"geoadd":    134,
+	"geopos":    135,
+	"geohash":   136,
+	"geodist":   137,
+	"geosearch": 138,
+	// json
+	"json.set":       139,
+	"json.get":       140,
+	"json.del":       141,
+	"json.arrappend": 142,
+	"json.numincrby": 143,
+	// time series
+	"ts.create":     144,
+	"ts.add":        145,
+	"ts.range":      146,
+	"ts.createrule": 147,
+	"ts.deleterule": 148,
+	"ts.info":       149,
+	// bloom and cuckoo filters
+	"bf.reserve": 150,
+	"bf.add":     151,
+	"bf.madd":    152,
+	"bf.exists":  153,
+	"cf.reserve": 154,
+	"cf.add":     155,
+	"cf.addnx":   156,
+	"cf.exists":  157,
+	"cf.del":     158,
+	// locks
+	"lock": 159,
+	// queues
+	"q.create": 160,
+	"q.push":   161,
+	"q.pop":    162,
+	"q.ack":    163,
+	"q.nack":   164,
+	"q.stats":  165,
+	// rate limiting
+	"ratelimit": 166,
 }
 
-const HistoryPath = "/tmp/caskdb-cli"
+const (
+	HistoryPath = "/tmp/caskdb-cli"
+	PasswordEnv = "CASKDB_PASSWORD"
+)
 
 type Message struct {
 	id     uint32
@@ -76,6 +232,14 @@ type Message struct {
 func main() {
 	h := flag.String("h", "0.0.0.0", "tcp server address")
 	p := flag.Int("p", 4519, "tcp server port")
+	a := flag.String("a", "", "password used to authenticate, $"+PasswordEnv+" is used if empty")
+	u := flag.String("user", "", "acl user used to authenticate with the password")
+	useTLS := flag.Bool("tls", false, "connect with tls")
+	caCert := flag.String("cacert", "", "CA certificate used to verify the server")
+	cert := flag.String("cert", "", "client certificate for mutual tls")
+	key := flag.String("key", "", "client private key for mutual tls")
+	sni := flag.String("sni", "", "server name verified in the server certificate, the -h host if empty")
+	n := flag.Int("n", 0, "database number")
 	flag.Parse()
 	if *h == "" {
 		*h = "0.0.0.0"
@@ -83,15 +247,46 @@ func main() {
 	if *p == 0 {
 		*p = 4519
 	}
+	if *a == "" {
+		*a = os.Getenv(PasswordEnv)
+	}
 
 	// connect
-	addr := fmt.Sprintf("%s:%d", *h, *p)
-	conn, err := net.Dial("tcp4", addr)
+	addr := net.JoinHostPort(*h, strconv.Itoa(*p))
+	var tlsCfg *tls.Config
+	if *useTLS {
+		if *sni == "" {
+			*sni = *h
+		}
+		// the default host can not be in the server certificate
+		if ip := net.ParseIP(*sni); ip != nil && ip.IsUnspecified() {
+			log.Fatal("-tls needs the server host with -h or its name with -sni")
+		}
+		cfg, err := NewTLSConfig(*sni, *caCert, *cert, *key)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tlsCfg = cfg
+	}
+	conn, err := Dial(addr, tlsCfg)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer conn.Close()
 
+	// authenticate before anything else is sent
+	if *a != "" {
+		if err := AuthUser(conn, *u, *a); err != nil {
+			fmt.Println(err)
+		}
+	}
+
+	if *n != 0 {
+		if err := Select(conn, *n); err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	// client heart beat
 	go heartBeat(conn)
 
@@ -115,9 +310,9 @@ func main() {
 		}
 	}()
 
-	prompt := addr + ">"
+	db := *n
 	for {
-		cmd, err := line.Prompt(prompt)
+		cmd, err := line.Prompt(prompt(addr, db))
 		if err != nil {
 			fmt.Println(err)
 			break
@@ -127,8 +322,11 @@ func main() {
 		if len(cmd) == 0 {
 			continue
 		}
-		line.AppendHistory(cmd)
 		command := parseCommand(cmd)
+		// keep passwords out of the history file
+		if !hasPassword(command) {
+			line.AppendHistory(cmd)
+		}
 		if command[0] == "quit" {
 			break
 		} else {
@@ -137,55 +335,178 @@ func main() {
 				continue
 			}
 			// do request
-			if err := handle(conn, command); err != nil {
+			msg, err := handle(conn, command)
+			if err != nil {
 				fmt.Println(err)
+			} else if command[0] == "select" && msg.id == 200 {
+				db, _ = strconv.Atoi(command[1])
 			}
 		}
 	}
 }
 
-func handle(conn net.Conn, c []string) error {
+// Dial connects to the server, over tls when tlsCfg is not nil
+func Dial(addr string, tlsCfg *tls.Config) (net.Conn, error) {
+	if tlsCfg == nil {
+		return net.Dial("tcp4", addr)
+	}
+	return tls.Dial("tcp4", addr, tlsCfg)
+}
+
+// NewTLSConfig creates the client tls config, the system roots verify the
+// server unless caCert is given, cert and key are sent for mutual tls
+func NewTLSConfig(serverName, caCert, cert, key string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if caCert != "" {
+		pem, err := ioutil.ReadFile(caCert)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", caCert)
+		}
+		cfg.RootCAs = pool
+	}
+	if cert != "" || key != "" {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{pair}
+	}
+	return cfg, nil
+}
+
+// prompt shows the selected database, as host:port[2]>
+func prompt(addr string, db int) string {
+	if db == 0 {
+		return addr + ">"
+	}
+	return fmt.Sprintf("%s[%d]>", addr, db)
+}
+
+func handle(conn net.Conn, c []string) (*Message, error) {
+	msg, err := Do(conn, c[0], c[1:]...)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println(string(msg.data))
+
+	return msg, nil
+}
+
+// Do sends a command with its arguments and waits for the reply
+func Do(conn net.Conn, cmd string, args ...string) (*Message, error) {
 
 	// prepare data
-	id := uint32(commands[c[0]])
+	id := uint32(commands[cmd])
 	var data bytes.Buffer
-	for i := 1; i < len(c); i++ {
-		data.Write([]byte(c[i]))
-		if i < len(c)-1 {
+	for i := 0; i < len(args); i++ {
+		data.Write([]byte(args[i]))
+		if i < len(args)-1 {
 			data.Write([]byte(" "))
 		}
 	}
 	binMsg, err := Pack(id, data.Bytes())
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// send
 	if _, err = conn.Write(binMsg); err != nil {
-		return err
+		return nil, err
 	}
 
 	// read head
 	headBuf := make([]byte, 8)
 	if _, err = io.ReadFull(conn, headBuf); err != nil {
-		return err
+		return nil, err
 	}
 	msg, err := UnPack(headBuf)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// read data
-	length := msg.length
-	dataBuf := make([]byte, length)
-	if _, err = io.ReadFull(conn, dataBuf); err != nil {
+	msg.data = make([]byte, msg.length)
+	if _, err = io.ReadFull(conn, msg.data); err != nil {
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// Auth authenticates the connection with the server password
+func Auth(conn net.Conn, password string) error {
+	return AuthUser(conn, "", password)
+}
+
+// AuthUser authenticates the connection as an acl user, an empty user
+// stands for the default one
+func AuthUser(conn net.Conn, user, password string) error {
+	args := []string{password}
+	if user != "" {
+		args = []string{user, password}
+	}
+	msg, err := Do(conn, "auth", args...)
+	if err != nil {
 		return err
 	}
-	fmt.Println(string(dataBuf))
+	if msg.id != 200 {
+		return errors.New(string(msg.data))
+	}
+	return nil
+}
 
+// Select switches the connection to another database
+func Select(conn net.Conn, db int) error {
+	msg, err := Do(conn, "select", strconv.Itoa(db))
+	if err != nil {
+		return err
+	}
+	if msg.id != 200 {
+		return errors.New(string(msg.data))
+	}
 	return nil
 }
 
+// HGetAll reads all the fields of a hash into a map
+func HGetAll(conn net.Conn, key string) (map[string]string, error) {
+	msg, err := Do(conn, "hgetall", key)
+	if err != nil {
+		return nil, err
+	}
+	if msg.id != 200 {
+		return nil, errors.New(string(msg.data))
+	}
+	// one field and its value per line
+	m := make(map[string]string)
+	for _, pair := range parseList(msg.data) {
+		if i := strings.Index(pair, " "); i >= 0 {
+			m[pair[:i]] = pair[i+1:]
+		}
+	}
+	return m, nil
+}
+
+// parseList splits a numbered list reply into its elements
+func parseList(data []byte) []string {
+	if string(data) == "(empty list)" {
+		return nil
+	}
+	var res []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, ") "); i >= 0 {
+			res = append(res, line[i+2:])
+		}
+	}
+	return res
+}
+
 func heartBeat(conn net.Conn) {
 	for {
 		time.Sleep(30 * time.Second)
@@ -249,6 +570,16 @@ func parseCommand(cmdLine string) []string {
 	return args
 }
 
+func hasPassword(command []string) bool {
+	switch command[0] {
+	case "auth":
+		return true
+	case "acl":
+		return len(command) > 1 && strings.ToLower(command[1]) == "setuser"
+	}
+	return false
+}
+
 func checkCommand(command []string) bool {
 	if _, ok := commands[command[0]]; !ok {
 		return false
@@ -395,7 +726,7 @@ func checkCommand(command []string) bool {
 			return false
 		}
 	case "zadd":
-		if len(command) != 4 {
+		if len(command) < 4 {
 			return false
 		}
 	case "zrem":
@@ -418,6 +749,498 @@ func checkCommand(command []string) bool {
 		if len(command) != 3 {
 			return false
 		}
+	case "auth":
+		if len(command) != 2 && len(command) != 3 {
+			return false
+		}
+	case "acl":
+		if len(command) < 2 {
+			return false
+		}
+	case "select":
+		if len(command) != 2 {
+			return false
+		}
+	case "swapdb":
+		if len(command) != 3 {
+			return false
+		}
+	case "flushdb", "flushall":
+		if len(command) != 1 {
+			return false
+		}
+	case "incr":
+		if len(command) != 2 {
+			return false
+		}
+	case "decr":
+		if len(command) != 2 {
+			return false
+		}
+	case "incrby":
+		if len(command) != 3 {
+			return false
+		}
+	case "decrby":
+		if len(command) != 3 {
+			return false
+		}
+	case "incrbyfloat":
+		if len(command) != 3 {
+			return false
+		}
+	case "hincrby":
+		if len(command) != 4 {
+			return false
+		}
+	case "hincrbyfloat":
+		if len(command) != 4 {
+			return false
+		}
+	case "strlen":
+		if len(command) != 2 {
+			return false
+		}
+	case "append":
+		if len(command) != 3 {
+			return false
+		}
+	case "getrange":
+		if len(command) != 4 {
+			return false
+		}
+	case "setrange":
+		if len(command) != 4 {
+			return false
+		}
+	case "getdel":
+		if len(command) != 2 {
+			return false
+		}
+	case "getex":
+		if len(command) < 2 {
+			return false
+		}
+	case "setbit":
+		if len(command) != 4 {
+			return false
+		}
+	case "getbit":
+		if len(command) != 3 {
+			return false
+		}
+	case "bitcount":
+		if len(command) < 2 {
+			return false
+		}
+	case "bitpos":
+		if len(command) < 3 {
+			return false
+		}
+	case "bitop":
+		if len(command) < 4 {
+			return false
+		}
+	case "bitfield":
+		if len(command) < 2 {
+			return false
+		}
+	case "hmset":
+		if len(command) < 4 {
+			return false
+		}
+	case "hmget":
+		if len(command) < 3 {
+			return false
+		}
+	case "hkeys":
+		if len(command) != 2 {
+			return false
+		}
+	case "hvals":
+		if len(command) != 2 {
+			return false
+		}
+	case "hrandfield":
+		if len(command) < 2 {
+			return false
+		}
+	case "hscan":
+		if len(command) < 3 {
+			return false
+		}
+	case "hstrlen":
+		if len(command) != 3 {
+			return false
+		}
+	case "blpop":
+		if len(command) < 3 {
+			return false
+		}
+	case "brpop":
+		if len(command) < 3 {
+			return false
+		}
+	case "blmove":
+		if len(command) != 6 {
+			return false
+		}
+	case "lmove":
+		if len(command) != 5 {
+			return false
+		}
+	case "rpoplpush":
+		if len(command) != 3 {
+			return false
+		}
+	case "ltrim":
+		if len(command) != 4 {
+			return false
+		}
+	case "lpos":
+		if len(command) < 3 {
+			return false
+		}
+	case "lpushx":
+		if len(command) < 3 {
+			return false
+		}
+	case "rpushx":
+		if len(command) < 3 {
+			return false
+		}
+	case "sinter":
+		if len(command) < 2 {
+			return false
+		}
+	case "sintercard":
+		if len(command) < 3 {
+			return false
+		}
+	case "sinterstore":
+		if len(command) < 3 {
+			return false
+		}
+	case "sunionstore":
+		if len(command) < 3 {
+			return false
+		}
+	case "sdiffstore":
+		if len(command) < 3 {
+			return false
+		}
+	case "spop":
+		if len(command) < 2 {
+			return false
+		}
+	case "srandmember":
+		if len(command) < 2 {
+			return false
+		}
+	case "smismember":
+		if len(command) < 3 {
+			return false
+		}
+	case "zrange":
+		if len(command) < 4 {
+			return false
+		}
+	case "zrevrange":
+		if len(command) < 4 {
+			return false
+		}
+	case "zrangebyscore":
+		if len(command) < 4 {
+			return false
+		}
+	case "zrevrangebyscore":
+		if len(command) < 4 {
+			return false
+		}
+	case "zrank":
+		if len(command) < 3 {
+			return false
+		}
+	case "zrevrank":
+		if len(command) < 3 {
+			return false
+		}
+	case "zcount":
+		if len(command) != 4 {
+			return false
+		}
+	case "zincrby":
+		if len(command) != 4 {
+			return false
+		}
+	case "zpopmin":
+		if len(command) < 2 {
+			return false
+		}
+	case "zpopmax":
+		if len(command) < 2 {
+			return false
+		}
+	case "zremrangebyscore":
+		if len(command) != 4 {
+			return false
+		}
+	case "zremrangebyrank":
+		if len(command) != 4 {
+			return false
+		}
+	case "zunion":
+		if len(command) < 3 {
+			return false
+		}
+	case "zinter":
+		if len(command) < 3 {
+			return false
+		}
+	case "zdiff":
+		if len(command) < 3 {
+			return false
+		}
+	case "zunionstore":
+		if len(command) < 4 {
+			return false
+		}
+	case "zinterstore":
+		if len(command) < 4 {
+			return false
+		}
+	case "zdiffstore":
+		if len(command) < 4 {
+			return false
+		}
+	case "zrangebylex":
+		if len(command) < 4 {
+			return false
+		}
+	case "zrevrangebylex":
+		if len(command) < 4 {
+			return false
+		}
+	case "zlexcount":
+		if len(command) != 4 {
+			return false
+		}
+	case "zremrangebylex":
+		if len(command) != 4 {
+			return false
+		}
+	case "type":
+		if len(command) != 2 {
+			return false
+		}
+	case "exists":
+		if len(command) < 2 {
+			return false
+		}
+	case "del":
+		if len(command) < 2 {
+			return false
+		}
+	case "unlink":
+		if len(command) < 2 {
+			return false
+		}
+	case "rename":
+		if len(command) != 3 {
+			return false
+		}
+	case "renamenx":
+		if len(command) != 3 {
+			return false
+		}
+	case "copy":
+		if len(command) < 3 {
+			return false
+		}
+	case "xadd":
+		if len(command) < 5 {
+			return false
+		}
+	case "xlen":
+		if len(command) != 2 {
+			return false
+		}
+	case "xrange":
+		if len(command) < 4 {
+			return false
+		}
+	case "xrevrange":
+		if len(command) < 4 {
+			return false
+		}
+	case "xread":
+		if len(command) < 4 {
+			return false
+		}
+	case "xreadgroup":
+		if len(command) < 7 {
+			return false
+		}
+	case "xgroup":
+		if len(command) < 4 {
+			return false
+		}
+	case "xack":
+		if len(command) < 4 {
+			return false
+		}
+	case "xpending":
+		if len(command) < 3 {
+			return false
+		}
+	case "xclaim":
+		if len(command) < 6 {
+			return false
+		}
+	case "pfadd":
+		if len(command) < 2 {
+			return false
+		}
+	case "pfcount":
+		if len(command) < 2 {
+			return false
+		}
+	case "pfmerge":
+		if len(command) < 2 {
+			return false
+		}
+	case "geoadd":
+		if len(command) < 5 {
+			return false
+		}
+	case "geopos":
+		if len(command) < 2 {
+			return false
+		}
+	case "geohash":
+		if len(command) < 2 {
+			return false
+		}
+	case "geodist":
+		if len(command) < 4 {
+			return false
+		}
+	case "geosearch":
+		if len(command) < 7 {
+			return false
+		}
+	case "json.set":
+		if len(command) < 4 {
+			return false
+		}
+	case "json.get":
+		if len(command) < 2 {
+			return false
+		}
+	case "json.del":
+		if len(command) < 2 {
+			return false
+		}
+	case "json.arrappend":
+		if len(command) < 4 {
+			return false
+		}
+	case "json.numincrby":
+		if len(command) != 4 {
+			return false
+		}
+	case "ts.create":
+		if len(command) < 2 {
+			return false
+		}
+	case "ts.add":
+		if len(command) < 4 {
+			return false
+		}
+	case "ts.range":
+		if len(command) < 4 {
+			return false
+		}
+	case "ts.createrule":
+		if len(command) != 6 {
+			return false
+		}
+	case "ts.deleterule":
+		if len(command) != 3 {
+			return false
+		}
+	case "ts.info":
+		if len(command) != 2 {
+			return false
+		}
+	case "bf.reserve":
+		if len(command) < 4 {
+			return false
+		}
+	case "bf.add":
+		if len(command) != 3 {
+			return false
+		}
+	case "bf.madd":
+		if len(command) < 3 {
+			return false
+		}
+	case "bf.exists":
+		if len(command) != 3 {
+			return false
+		}
+	case "cf.reserve":
+		if len(command) < 3 {
+			return false
+		}
+	case "cf.add":
+		if len(command) != 3 {
+			return false
+		}
+	case "cf.addnx":
+		if len(command) != 3 {
+			return false
+		}
+	case "cf.exists":
+		if len(command) != 3 {
+			return false
+		}
+	case "cf.del":
+		if len(command) != 3 {
+			return false
+		}
+	case "lock":
+		if len(command) < 4 {
+			return false
+		}
+	case "q.create":
+		if len(command) < 2 {
+			return false
+		}
+	case "q.push":
+		if len(command) < 3 {
+			return false
+		}
+	case "q.pop":
+		if len(command) < 2 {
+			return false
+		}
+	case "q.ack":
+		if len(command) < 3 {
+			return false
+		}
+	case "q.nack":
+		if len(command) < 3 {
+			return false
+		}
+	case "q.stats":
+		if len(command) != 2 {
+			return false
+		}
+	case "ratelimit":
+		if len(command) < 5 {
+			return false
+		}
 	}
 	return true
 }
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/k-si/Kinx/kiface"
+	"github.com/k-si/Kinx/knet"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const DefaultUser = "default"
+
+// UserConfig is an acl user defined in the profile.
+type UserConfig struct {
+	Name     string   `json:"name" yaml:"name" toml:"name"`
+	Password string   `json:"password" yaml:"password" toml:"password"`
+	Commands []string `json:"commands" yaml:"commands" toml:"commands"`
+	Keys     []string `json:"keys" yaml:"keys" toml:"keys"`
+}
+
+// User is an acl user, the permissions of a connection are those of the
+// user it authenticated as.
+type User struct {
+	Name       string
+	Enabled    bool
+	NoPass     bool
+	Passwords  map[string]bool // sha256 of the passwords
+	Commands   map[string]bool // explicitly allowed or denied commands
+	Categories map[string]bool // allowed categories, "all" allows every command
+	AllKeys    bool
+	Patterns   []string
+}
+
+func newUser(name string) *User {
+	return &User{
+		Name:       name,
+		Passwords:  make(map[string]bool),
+		Commands:   make(map[string]bool),
+		Categories: make(map[string]bool),
+	}
+}
+
+func (u *User) clone() *User {
+	nu := newUser(u.Name)
+	nu.Enabled = u.Enabled
+	nu.NoPass = u.NoPass
+	nu.AllKeys = u.AllKeys
+	for k, v := range u.Passwords {
+		nu.Passwords[k] = v
+	}
+	for k, v := range u.Commands {
+		nu.Commands[k] = v
+	}
+	for k, v := range u.Categories {
+		nu.Categories[k] = v
+	}
+	nu.Patterns = append(nu.Patterns, u.Patterns...)
+	return nu
+}
+
+func hashPassword(password []byte) string {
+	sum := sha256.Sum256(password)
+	return hex.EncodeToString(sum[:])
+}
+
+func (u *User) checkPassword(password []byte) bool {
+	if !u.Enabled {
+		return false
+	}
+	if u.NoPass {
+		return true
+	}
+	h := hashPassword(password)
+	ok := false
+	for p := range u.Passwords {
+		if subtle.ConstantTimeCompare([]byte(p), []byte(h)) == 1 {
+			ok = true
+		}
+	}
+	return ok
+}
+
+func (u *User) canRun(cmd *Command) bool {
+	if allowed, ok := u.Commands[cmd.Name]; ok {
+		return allowed
+	}
+	// connection commands only need an authenticated user
+	return u.Categories["all"] || u.Categories[cmd.Category] || cmd.Category == CategoryConnection
+}
+
+func (u *User) canAccess(key string) bool {
+	if u.AllKeys {
+		return true
+	}
+	for _, p := range u.Patterns {
+		if matchPattern(p, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply changes the user according to one ACL SETUSER rule.
+func (u *User) apply(rule string) error {
+	switch {
+	case rule == "on":
+		u.Enabled = true
+	case rule == "off":
+		u.Enabled = false
+	case rule == "nopass":
+		u.NoPass = true
+		u.Passwords = make(map[string]bool)
+	case rule == "resetpass":
+		u.NoPass = false
+		u.Passwords = make(map[string]bool)
+	case rule == "allkeys":
+		u.AllKeys = true
+	case rule == "resetkeys":
+		u.AllKeys = false
+		u.Patterns = nil
+	case rule == "allcommands":
+		return u.apply("+@all")
+	case rule == "nocommands":
+		return u.apply("-@all")
+	case rule == "reset":
+		*u = *newUser(u.Name)
+	case strings.HasPrefix(rule, ">"):
+		u.NoPass = false
+		u.Passwords[hashPassword([]byte(rule[1:]))] = true
+	case strings.HasPrefix(rule, "<"):
+		delete(u.Passwords, hashPassword([]byte(rule[1:])))
+	case strings.HasPrefix(rule, "~"):
+		if rule == "~*" {
+			u.AllKeys = true
+		} else {
+			u.Patterns = append(u.Patterns, rule[1:])
+		}
+	case strings.HasPrefix(rule, "+@"), strings.HasPrefix(rule, "-@"):
+		cat := rule[2:]
+		if cat != "all" && !categories[cat] {
+			return fmt.Errorf("ERR unknown command category '%s'", cat)
+		}
+		if cat == "all" {
+			u.Commands = make(map[string]bool)
+			u.Categories = make(map[string]bool)
+			if rule[0] == '+' {
+				u.Categories[cat] = true
+			}
+			break
+		}
+		if rule[0] == '+' {
+			u.Categories[cat] = true
+		} else {
+			delete(u.Categories, cat)
+		}
+		// the category rule overrides earlier rules on its commands, with
+		// +@all the removed category must be denied one by one
+		for _, cmd := range commandTable {
+			if cmd.Category != cat {
+				continue
+			}
+			if rule[0] == '-' && u.Categories["all"] {
+				u.Commands[cmd.Name] = false
+			} else {
+				delete(u.Commands, cmd.Name)
+			}
+		}
+	case strings.HasPrefix(rule, "+"), strings.HasPrefix(rule, "-"):
+		name := strings.ToLower(rule[1:])
+		if lookupCommand(name) == nil {
+			return fmt.Errorf("ERR unknown command '%s'", name)
+		}
+		u.Commands[name] = rule[0] == '+'
+	default:
+		return fmt.Errorf("ERR syntax error in ACL SETUSER modifier '%s'", rule)
+	}
+	return nil
+}
+
+// describe renders the user as the rules that would recreate it.
+func (u *User) describe() string {
+	rules := []string{"user", u.Name}
+	if u.Enabled {
+		rules = append(rules, "on")
+	} else {
+		rules = append(rules, "off")
+	}
+
+	if u.NoPass {
+		rules = append(rules, "nopass")
+	}
+	var passwords []string
+	for p := range u.Passwords {
+		passwords = append(passwords, "#"+p)
+	}
+	sort.Strings(passwords)
+	rules = append(rules, passwords...)
+
+	if u.AllKeys {
+		rules = append(rules, "~*")
+	}
+	for _, p := range u.Patterns {
+		rules = append(rules, "~"+p)
+	}
+
+	var cats []string
+	for c := range u.Categories {
+		cats = append(cats, "+@"+c)
+	}
+	sort.Strings(cats)
+	rules = append(rules, cats...)
+
+	var cmds []string
+	for name, allowed := range u.Commands {
+		if allowed {
+			cmds = append(cmds, "+"+name)
+		} else {
+			cmds = append(cmds, "-"+name)
+		}
+	}
+	sort.Strings(cmds)
+	rules = append(rules, cmds...)
+
+	return strings.Join(rules, " ")
+}
+
+// ACL keeps the users known by the server.
+type ACL struct {
+	users map[string]*User
+}
+
+// NewACL creates the users of the profile, the default user is granted
+// everything and is protected by requirepass unless it is redefined.
+func NewACL(requirePass string, users []UserConfig) (*ACL, error) {
+	acl := &ACL{users: make(map[string]*User)}
+
+	def := newUser(DefaultUser)
+	rules := []string{"on", "allkeys", "allcommands", "nopass"}
+	if requirePass != "" {
+		rules[3] = ">" + requirePass
+	}
+	for _, r := range rules {
+		if err := def.apply(r); err != nil {
+			return nil, err
+		}
+	}
+	acl.users[DefaultUser] = def
+
+	for _, uc := range users {
+		if uc.Name == "" {
+			return nil, errors.New("acl user without name")
+		}
+		rules := []string{"on", "nopass"}
+		if uc.Password != "" {
+			rules[1] = ">" + uc.Password
+		}
+		for _, c := range uc.Commands {
+			if !strings.HasPrefix(c, "+") && !strings.HasPrefix(c, "-") {
+				c = "+" + c
+			}
+			rules = append(rules, c)
+		}
+		for _, k := range uc.Keys {
+			rules = append(rules, "~"+k)
+		}
+
+		u := newUser(uc.Name)
+		for _, r := range rules {
+			if err := u.apply(r); err != nil {
+				return nil, fmt.Errorf("acl user %s: %v", uc.Name, err)
+			}
+		}
+		acl.users[uc.Name] = u
+	}
+	return acl, nil
+}
+
+func (acl *ACL) user(name string) *User {
+	return acl.users[name]
+}
+
+// setUser creates or changes a user, no rule is applied if any of them is invalid.
+func (acl *ACL) setUser(name string, rules []string) error {
+	var u *User
+	if old, ok := acl.users[name]; ok {
+		u = old.clone()
+	} else {
+		u = newUser(name)
+	}
+	for _, r := range rules {
+		if err := u.apply(r); err != nil {
+			return err
+		}
+	}
+	acl.users[name] = u
+	return nil
+}
+
+func (acl *ACL) delUser(names []string) (int, error) {
+	n := 0
+	for _, name := range names {
+		if name == DefaultUser {
+			return 0, fmt.Errorf("ERR the '%s' user cannot be removed", DefaultUser)
+		}
+	}
+	for _, name := range names {
+		if _, ok := acl.users[name]; ok {
+			delete(acl.users, name)
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (acl *ACL) list() []string {
+	var names []string
+	for name := range acl.users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var res []string
+	for _, name := range names {
+		res = append(res, acl.users[name].describe())
+	}
+	return res
+}
+
+type AclRouter struct {
+	knet.BaseRouter
+}
+
+func (ar *AclRouter) Handle(req kiface.IRequest) {
+	log.Println("handle Acl")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	var res []byte
+	var err error
+	switch strings.ToLower(string(c[0])) {
+	case "setuser":
+		if len(c) < 2 {
+			err = errors.New("ERR wrong number of arguments for 'acl setuser' command")
+			break
+		}
+		var rules []string
+		for _, r := range c[2:] {
+			rules = append(rules, string(r))
+		}
+		if err = s.acl.setUser(string(c[1]), rules); err == nil {
+			res = []byte("\"OK\"")
+		}
+	case "deluser":
+		var names []string
+		for _, name := range c[1:] {
+			names = append(names, string(name))
+		}
+		var n int
+		if n, err = s.acl.delUser(names); err == nil {
+			res = []byte(strconv.Itoa(n))
+		}
+	case "whoami":
+		res = []byte(s.session(req.GetConnection()).user)
+	case "list":
+		b := strings.Builder{}
+		list := s.acl.list()
+		for i, l := range list {
+			b.WriteString(strconv.Itoa(i))
+			b.WriteString(") ")
+			b.WriteString(l)
+			if i < len(list)-1 {
+				b.WriteString("\n")
+			}
+		}
+		res = []byte(b.String())
+	default:
+		err = fmt.Errorf("ERR unknown subcommand '%s'", c[0])
+	}
+
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, res); err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"github.com/k-si/Kinx/kiface"
+	"github.com/k-si/Kinx/knet"
+	"log"
+)
+
+var (
+	ErrNoAuth        = errors.New("NOAUTH authentication required")
+	ErrWrongPass     = errors.New("WRONGPASS invalid username-password pair or user is disabled")
+	ErrNoPasswordSet = errors.New("ERR AUTH <password> called without any password configured for the default user")
+)
+
+// Session holds the state of one client connection.
+type Session struct {
+	user string // authenticated user, empty until AUTH succeeds
+	db   int    // selected database
+}
+
+// session returns the state of conn, creating it on first use.
+func (s *Server) session(conn kiface.IConnection) *Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ss, ok := s.sessions[conn.GetConnID()]
+	if !ok {
+		ss = &Session{}
+		// connections start as the default user when it needs no password
+		if u := s.acl.user(DefaultUser); u != nil && u.Enabled && u.NoPass {
+			ss.user = DefaultUser
+		}
+		s.sessions[conn.GetConnID()] = ss
+	}
+	return ss
+}
+
+// sessionUser returns the user conn is authenticated as, or nil.
+func (s *Server) sessionUser(conn kiface.IConnection) *User {
+	ss := s.session(conn)
+	if ss.user == "" {
+		return nil
+	}
+	u := s.acl.user(ss.user)
+	if u == nil || !u.Enabled {
+		return nil
+	}
+	return u
+}
+
+func (s *Server) closeSession(conn kiface.IConnection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sessions, conn.GetConnID())
+	s.dropWaiters(conn)
+}
+
+type AuthRouter struct {
+	knet.BaseRouter
+}
+
+func (ar *AuthRouter) Handle(req kiface.IRequest) {
+	log.Println("handle Auth")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	// AUTH password authenticates the default user
+	name, password := DefaultUser, c[0]
+	if len(c) > 1 {
+		name, password = string(c[0]), c[1]
+	}
+
+	ss := s.session(req.GetConnection())
+	u := s.acl.user(name)
+	if len(c) == 1 && u != nil && u.NoPass {
+		if err := req.GetConnection().SendMessage(400, []byte(ErrNoPasswordSet.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	if u == nil || !u.checkPassword(password) {
+		if err := req.GetConnection().SendMessage(400, []byte(ErrWrongPass.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	ss.user = name
+	if err := req.GetConnection().SendMessage(200, []byte("\"OK\"")); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,600 @@
+package main
+
+import (
+	"errors"
+	"github.com/k-si/Kinx/kiface"
+	"github.com/k-si/Kinx/knet"
+	"log"
+	"math/big"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrBitOffset    = errors.New("ERR bit offset is not an integer or out of range")
+	ErrBitValue     = errors.New("ERR bit is not an integer or out of range")
+	ErrBitfieldType = errors.New("ERR invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is")
+)
+
+// bits are numbered from the most significant bit of the first byte.
+
+func getBit(buf []byte, offset uint64) int {
+	i := offset >> 3
+	if i >= uint64(len(buf)) {
+		return 0
+	}
+	return int(buf[i]>>(7-offset&7)) & 1
+}
+
+// setBit sets the bit at offset growing buf as needed, it returns the
+// new buffer and the previous bit.
+func setBit(buf []byte, offset uint64, bit int) ([]byte, int) {
+	i := offset >> 3
+	if n := int(i) + 1; n > len(buf) {
+		buf = append(buf, make([]byte, n-len(buf))...)
+	}
+	old := int(buf[i]>>(7-offset&7)) & 1
+	mask := byte(1) << (7 - offset&7)
+	if bit == 1 {
+		buf[i] |= mask
+	} else {
+		buf[i] &^= mask
+	}
+	return buf, old
+}
+
+// normalizeRange resolves negative and out of bound indexes of an inclusive
+// range over n elements, ok is false for an empty range.
+func normalizeRange(start, end, n int) (int, int, bool) {
+	if start < 0 {
+		start += n
+	}
+	if end < 0 {
+		end += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= n {
+		end = n - 1
+	}
+	if start > end || n == 0 {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+// bitCount counts the set bits between the bits start and end included.
+func bitCount(buf []byte, start, end uint64) int {
+	n := 0
+	for i := start; i <= end; {
+		if i&7 == 0 && i+7 <= end {
+			n += bits.OnesCount8(buf[i>>3])
+			i += 8
+			continue
+		}
+		n += getBit(buf, i)
+		i++
+	}
+	return n
+}
+
+// bitPos finds the first bit set to bit between the bits start and end
+// included, or -1.
+func bitPos(buf []byte, bit int, start, end uint64) int64 {
+	for i := start; i <= end; {
+		// skip the bytes which can not contain the bit
+		if i&7 == 0 && i+7 <= end {
+			b := buf[i>>3]
+			if (bit == 1 && b == 0) || (bit == 0 && b == 0xff) {
+				i += 8
+				continue
+			}
+		}
+		if getBit(buf, i) == bit {
+			return int64(i)
+		}
+		i++
+	}
+	return -1
+}
+
+// bitOp applies a bitwise operation to the sources, shorter sources are
+// padded with zero bytes.
+func bitOp(op string, srcs [][]byte) []byte {
+	n := 0
+	for _, src := range srcs {
+		if len(src) > n {
+			n = len(src)
+		}
+	}
+	res := make([]byte, n)
+	if op == "not" {
+		for i := range res {
+			res[i] = ^srcs[0][i]
+		}
+		return res
+	}
+
+	for i := range res {
+		var b byte
+		for j, src := range srcs {
+			var v byte
+			if i < len(src) {
+				v = src[i]
+			}
+			if j == 0 {
+				b = v
+				continue
+			}
+			switch op {
+			case "and":
+				b &= v
+			case "or":
+				b |= v
+			case "xor":
+				b ^= v
+			}
+		}
+		res[i] = b
+	}
+	return res
+}
+
+// bitfieldType is a signed or unsigned integer type of BITFIELD, like i8 or u16.
+type bitfieldType struct {
+	signed bool
+	bits   uint
+}
+
+func parseBitfieldType(b []byte) (bitfieldType, error) {
+	t := strings.ToLower(string(b))
+	if len(t) < 2 || (t[0] != 'i' && t[0] != 'u') {
+		return bitfieldType{}, ErrBitfieldType
+	}
+	n, err := strconv.Atoi(t[1:])
+	signed := t[0] == 'i'
+	if err != nil || n < 1 || (signed && n > 64) || (!signed && n > 63) {
+		return bitfieldType{}, ErrBitfieldType
+	}
+	return bitfieldType{signed: signed, bits: uint(n)}, nil
+}
+
+// parseBitfieldOffset parses an offset in bits, or in multiples of the
+// type width when prefixed by '#'.
+func parseBitfieldOffset(b []byte, t bitfieldType) (uint64, error) {
+	s := string(b)
+	mul := uint64(1)
+	if strings.HasPrefix(s, "#") {
+		s = s[1:]
+		mul = uint64(t.bits)
+	}
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, ErrBitOffset
+	}
+	return n * mul, nil
+}
+
+func (t bitfieldType) bounds() (*big.Int, *big.Int) {
+	one := big.NewInt(1)
+	if !t.signed {
+		max := new(big.Int).Lsh(one, t.bits)
+		return big.NewInt(0), max.Sub(max, one)
+	}
+	max := new(big.Int).Lsh(one, t.bits-1)
+	min := new(big.Int).Neg(max)
+	return min, max.Sub(max, one)
+}
+
+// fit brings v into the range of the type according to the overflow
+// policy, ok is false when the FAIL policy rejects it.
+func (t bitfieldType) fit(v *big.Int, overflow string) (*big.Int, bool) {
+	min, max := t.bounds()
+	if v.Cmp(min) >= 0 && v.Cmp(max) <= 0 {
+		return v, true
+	}
+	switch overflow {
+	case "sat":
+		if v.Cmp(min) < 0 {
+			return min, true
+		}
+		return max, true
+	case "fail":
+		return nil, false
+	}
+	// wrap around as two's complement
+	m := new(big.Int).Lsh(big.NewInt(1), t.bits)
+	r := new(big.Int).Mod(v, m)
+	if t.signed && r.Cmp(max) > 0 {
+		r.Sub(r, m)
+	}
+	return r, true
+}
+
+func getField(buf []byte, offset uint64, t bitfieldType) *big.Int {
+	var raw uint64
+	for i := uint64(0); i < uint64(t.bits); i++ {
+		raw = raw<<1 | uint64(getBit(buf, offset+i))
+	}
+	if t.signed && raw>>(t.bits-1)&1 == 1 {
+		// sign extend
+		return big.NewInt(int64(raw | ^uint64(0)<<(t.bits-1)))
+	}
+	return new(big.Int).SetUint64(raw)
+}
+
+func setField(buf []byte, offset uint64, t bitfieldType, v *big.Int) []byte {
+	raw := uint64(v.Int64())
+	for i := uint64(0); i < uint64(t.bits); i++ {
+		buf, _ = setBit(buf, offset+i, int(raw>>(uint64(t.bits)-1-i))&1)
+	}
+	return buf
+}
+
+// bitfield runs the BITFIELD operations on buf, the results are nil for
+// the operations rejected by the FAIL overflow policy. changed reports
+// whether buf was written.
+func bitfield(buf []byte, ops [][]byte, maxSize uint64) ([]byte, []*big.Int, bool, error) {
+	var res []*big.Int
+	changed := false
+	overflow := "wrap"
+	for i := 0; i < len(ops); {
+		op := strings.ToLower(string(ops[i]))
+		if op == "overflow" {
+			if i+1 >= len(ops) {
+				return nil, nil, false, ErrSyntax
+			}
+			overflow = strings.ToLower(string(ops[i+1]))
+			if overflow != "wrap" && overflow != "sat" && overflow != "fail" {
+				return nil, nil, false, errors.New("ERR invalid OVERFLOW type specified")
+			}
+			i += 2
+			continue
+		}
+
+		argc := 3
+		if op == "get" {
+			argc = 2
+		} else if op != "set" && op != "incrby" {
+			return nil, nil, false, ErrSyntax
+		}
+		if i+argc >= len(ops) {
+			return nil, nil, false, ErrSyntax
+		}
+		t, err := parseBitfieldType(ops[i+1])
+		if err != nil {
+			return nil, nil, false, err
+		}
+		offset, err := parseBitfieldOffset(ops[i+2], t)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		if op != "get" && (offset+uint64(t.bits)+7)>>3 > maxSize {
+			return nil, nil, false, errors.New("ERR string exceeds maximum allowed size")
+		}
+
+		old := getField(buf, offset, t)
+		switch op {
+		case "get":
+			res = append(res, old)
+		case "set", "incrby":
+			n, err := parseInt(ops[i+3])
+			if err != nil {
+				return nil, nil, false, err
+			}
+			v := big.NewInt(n)
+			if op == "incrby" {
+				v.Add(v, old)
+			}
+			v, ok := t.fit(v, overflow)
+			if !ok {
+				res = append(res, nil)
+				break
+			}
+			buf = setField(buf, offset, t, v)
+			changed = true
+			// SET replies with the old value, INCRBY with the new one
+			if op == "set" {
+				res = append(res, old)
+			} else {
+				res = append(res, v)
+			}
+		}
+		i += argc + 1
+	}
+	return buf, res, changed, nil
+}
+
+// parseBitRange parses the optional start, end and BYTE|BIT arguments of
+// BITCOUNT and BITPOS into a range of bits over buf.
+func parseBitRange(buf []byte, c [][]byte) (uint64, uint64, bool, error) {
+	n := len(buf)
+	if len(c) == 0 {
+		if n == 0 {
+			return 0, 0, false, nil
+		}
+		return 0, uint64(n)*8 - 1, true, nil
+	}
+
+	isBit := false
+	if len(c) == 3 {
+		switch strings.ToLower(string(c[2])) {
+		case "bit":
+			isBit = true
+		case "byte":
+		default:
+			return 0, 0, false, ErrSyntax
+		}
+	} else if len(c) > 3 {
+		return 0, 0, false, ErrSyntax
+	}
+
+	start, err := strconv.Atoi(string(c[0]))
+	if err != nil {
+		return 0, 0, false, ErrNotInteger
+	}
+	end := -1
+	if len(c) > 1 {
+		if end, err = strconv.Atoi(string(c[1])); err != nil {
+			return 0, 0, false, ErrNotInteger
+		}
+	}
+
+	if isBit {
+		start, end, ok := normalizeRange(start, end, n*8)
+		return uint64(start), uint64(end), ok, nil
+	}
+	start, end, ok := normalizeRange(start, end, n)
+	return uint64(start) * 8, uint64(end)*8 + 7, ok, nil
+}
+
+type SetBitRouter struct {
+	knet.BaseRouter
+}
+
+func (sbr *SetBitRouter) Handle(req kiface.IRequest) {
+	log.Println("handle SetBit")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	offset, err := strconv.ParseUint(string(c[1]), 10, 32)
+	if err != nil || offset>>3 >= uint64(s.dbCfg.MaxValueSize) {
+		if err = req.GetConnection().SendMessage(400, []byte(ErrBitOffset.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	if string(c[2]) != "0" && string(c[2]) != "1" {
+		if err = req.GetConnection().SendMessage(400, []byte(ErrBitValue.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	var old int
+	res, err := getString(s.db(req), c[0])
+	if err == nil {
+		res, old = setBit(res, offset, int(c[2][0]-'0'))
+		err = s.db(req).Set(c[0], res)
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte(strconv.Itoa(old))); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+type GetBitRouter struct {
+	knet.BaseRouter
+}
+
+func (gbr *GetBitRouter) Handle(req kiface.IRequest) {
+	log.Println("handle GetBit")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	offset, err := strconv.ParseUint(string(c[1]), 10, 32)
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(ErrBitOffset.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	res, err := getString(s.db(req), c[0])
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte(strconv.Itoa(getBit(res, offset)))); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+type BitCountRouter struct {
+	knet.BaseRouter
+}
+
+func (bcr *BitCountRouter) Handle(req kiface.IRequest) {
+	log.Println("handle BitCount")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	n := 0
+	res, err := getString(s.db(req), c[0])
+	if err == nil {
+		var start, end uint64
+		var ok bool
+		if start, end, ok, err = parseBitRange(res, c[1:]); err == nil && ok {
+			n = bitCount(res, start, end)
+		}
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte(strconv.Itoa(n))); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+type BitPosRouter struct {
+	knet.BaseRouter
+}
+
+func (bpr *BitPosRouter) Handle(req kiface.IRequest) {
+	log.Println("handle BitPos")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	if string(c[1]) != "0" && string(c[1]) != "1" {
+		if err := req.GetConnection().SendMessage(400, []byte("ERR The bit argument must be 1 or 0.")); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	bit := int(c[1][0] - '0')
+
+	pos := int64(-1)
+	res, err := getString(s.db(req), c[0])
+	if err == nil {
+		var start, end uint64
+		var ok bool
+		start, end, ok, err = parseBitRange(res, c[2:])
+		switch {
+		case err != nil:
+		case len(res) == 0:
+			// a missing key is an infinite string of clear bits
+			if bit == 0 {
+				pos = 0
+			}
+		case ok:
+			pos = bitPos(res, bit, start, end)
+			// without an explicit end the string is padded with clear bits
+			// on the right, so one is found right after it
+			if pos == -1 && bit == 0 && len(c) < 4 {
+				pos = int64(len(res)) * 8
+			}
+		}
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte(strconv.FormatInt(pos, 10))); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+type BitOpRouter struct {
+	knet.BaseRouter
+}
+
+func (bor *BitOpRouter) sources(args [][]byte) [][]byte {
+	return args[2:]
+}
+
+func (bor *BitOpRouter) Handle(req kiface.IRequest) {
+	log.Println("handle BitOp")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	op := strings.ToLower(string(c[0]))
+	if op != "and" && op != "or" && op != "xor" && op != "not" {
+		if err := req.GetConnection().SendMessage(400, []byte(ErrSyntax.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	if op == "not" && len(c) != 3 {
+		if err := req.GetConnection().SendMessage(400, []byte("ERR BITOP NOT must be called with a single source key.")); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	var res []byte
+	var err error
+	var srcs [][]byte
+	for _, key := range c[2:] {
+		var src []byte
+		if src, err = getString(s.db(req), key); err != nil {
+			break
+		}
+		srcs = append(srcs, src)
+	}
+	// the destination is overwritten whatever its type, an empty result
+	// deletes it
+	if err == nil {
+		res = bitOp(op, srcs)
+		_, err = delKey(s.db(req), c[1])
+	}
+	if err == nil && len(res) > 0 {
+		err = s.db(req).Set(c[1], res)
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte(strconv.Itoa(len(res)))); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+type BitFieldRouter struct {
+	knet.BaseRouter
+}
+
+func (bfr *BitFieldRouter) Handle(req kiface.IRequest) {
+	log.Println("handle BitField")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	res, err := getString(s.db(req), c[0])
+	var vals []*big.Int
+	if err == nil {
+		var changed bool
+		if res, vals, changed, err = bitfield(res, c[1:], uint64(s.dbCfg.MaxValueSize)); err == nil && changed {
+			err = s.db(req).Set(c[0], res)
+		}
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	if len(vals) == 0 {
+		if err = req.GetConnection().SendMessage(200, []byte("(empty list)")); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	b := strings.Builder{}
+	for i, v := range vals {
+		b.WriteString(strconv.Itoa(i))
+		if v == nil {
+			b.WriteString(") (nil)")
+		} else {
+			b.WriteString(") ")
+			b.WriteString(v.String())
+		}
+		if i < len(vals)-1 {
+			b.WriteString("\n")
+		}
+	}
+	if err = req.GetConnection().SendMessage(200, []byte(b.String())); err != nil {
+		log.Println(err)
+	}
+}
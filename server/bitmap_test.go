@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+// The expected values below are the replies of Redis to the same commands.
+
+func TestSetGetBit(t *testing.T) {
+	var buf []byte
+	var old int
+	buf, old = setBit(buf, 7, 1)
+	if old != 0 || !bytes.Equal(buf, []byte{0x01}) {
+		t.Fatalf("SETBIT 7 1: got %d %q", old, buf)
+	}
+	buf, old = setBit(buf, 7, 0)
+	if old != 1 || !bytes.Equal(buf, []byte{0x00}) {
+		t.Fatalf("SETBIT 7 0: got %d %q", old, buf)
+	}
+	buf, _ = setBit(buf, 17, 1)
+	if !bytes.Equal(buf, []byte{0x00, 0x00, 0x40}) {
+		t.Fatalf("SETBIT 17 1: got %q", buf)
+	}
+
+	tests := []struct {
+		offset uint64
+		want   int
+	}{
+		{0, 0},
+		{7, 0},
+		{17, 1},
+		{18, 0},
+		{100, 0},
+	}
+	for _, tt := range tests {
+		if got := getBit(buf, tt.offset); got != tt.want {
+			t.Errorf("GETBIT %d: got %d, want %d", tt.offset, got, tt.want)
+		}
+	}
+}
+
+func TestBitCount(t *testing.T) {
+	tests := []struct {
+		buf  string
+		args string
+		want int
+	}{
+		{"foobar", "", 26},
+		{"foobar", "0 0", 4},
+		{"foobar", "1 1", 6},
+		{"foobar", "1 1 BYTE", 6},
+		{"foobar", "-2 -1", 7},
+		{"foobar", "5 30 BIT", 17},
+		{"foobar", "0 -1 bit", 26},
+		{"foobar", "2 1", 0},
+		{"foobar", "100 200", 0},
+		{"", "", 0},
+		{"", "0 -1", 0},
+	}
+	for _, tt := range tests {
+		start, end, ok, err := parseBitRange([]byte(tt.buf), splitArgs(tt.args))
+		if err != nil {
+			t.Errorf("BITCOUNT %q %s: %v", tt.buf, tt.args, err)
+			continue
+		}
+		got := 0
+		if ok {
+			got = bitCount([]byte(tt.buf), start, end)
+		}
+		if got != tt.want {
+			t.Errorf("BITCOUNT %q %s: got %d, want %d", tt.buf, tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestBitRangeErrors(t *testing.T) {
+	tests := []struct {
+		args string
+		want error
+	}{
+		{"a 1", ErrNotInteger},
+		{"0 b", ErrNotInteger},
+		{"0 1 WORD", ErrSyntax},
+		{"0 1 BIT 2", ErrSyntax},
+	}
+	for _, tt := range tests {
+		if _, _, _, err := parseBitRange([]byte("foobar"), splitArgs(tt.args)); err != tt.want {
+			t.Errorf("range %s: got %v, want %v", tt.args, err, tt.want)
+		}
+	}
+}
+
+func TestBitPos(t *testing.T) {
+	tests := []struct {
+		buf  string
+		bit  int
+		args string
+		want int64
+	}{
+		{"\xff\xf0\x00", 0, "", 12},
+		{"\x00\xff\xf0", 1, "0", 8},
+		{"\x00\xff\xf0", 1, "2", 16},
+		{"\x00\xff\xf0", 1, "2 -1 BYTE", 16},
+		{"\x00\xff\xf0", 1, "7 15 BIT", 8},
+		{"\x00\xff\xf0", 1, "7 -3 BIT", 8},
+		{"\x00\x00\x00", 1, "", -1},
+		{"\xff\xff\xff", 0, "0 -1", -1},
+	}
+	for _, tt := range tests {
+		start, end, ok, err := parseBitRange([]byte(tt.buf), splitArgs(tt.args))
+		if err != nil {
+			t.Errorf("BITPOS %q %d %s: %v", tt.buf, tt.bit, tt.args, err)
+			continue
+		}
+		got := int64(-1)
+		if ok {
+			got = bitPos([]byte(tt.buf), tt.bit, start, end)
+		}
+		if got != tt.want {
+			t.Errorf("BITPOS %q %d %s: got %d, want %d", tt.buf, tt.bit, tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestBitOp(t *testing.T) {
+	tests := []struct {
+		op   string
+		srcs []string
+		want string
+	}{
+		{"and", []string{"foobar", "abcdef"}, "`bc`ab"},
+		{"or", []string{"foobar", "abcdef"}, "goofev"},
+		{"xor", []string{"foobar", "abcdef"}, "\x07\x0d\x0c\x06\x04\x14"},
+		{"not", []string{"\x0f\xf0"}, "\xf0\x0f"},
+		{"and", []string{"\xff\xff", "\xff"}, "\xff\x00"},
+		{"or", []string{"\x01", "", "\x00\x02"}, "\x01\x02"},
+		{"and", []string{"", ""}, ""},
+	}
+	for _, tt := range tests {
+		var srcs [][]byte
+		for _, src := range tt.srcs {
+			srcs = append(srcs, []byte(src))
+		}
+		if got := bitOp(tt.op, srcs); string(got) != tt.want {
+			t.Errorf("BITOP %s %q: got %q, want %q", tt.op, tt.srcs, got, tt.want)
+		}
+	}
+}
+
+func TestBitfield(t *testing.T) {
+	// each test runs its commands in turn on the same string
+	tests := []struct {
+		name string
+		cmds []string
+		want [][]string
+	}{
+		{
+			name: "get and set",
+			cmds: []string{"INCRBY i5 100 1 GET u4 0", "SET i8 0 -100 GET i8 0", "SET u8 #1 255 GET u16 0"},
+			want: [][]string{{"1", "0"}, {"0", "-100"}, {"0", "40191"}},
+		},
+		{
+			name: "overflow",
+			cmds: []string{
+				"INCRBY u2 100 1 OVERFLOW SAT INCRBY u2 102 1",
+				"INCRBY u2 100 1 OVERFLOW SAT INCRBY u2 102 1",
+				"INCRBY u2 100 1 OVERFLOW SAT INCRBY u2 102 1",
+				"INCRBY u2 100 1 OVERFLOW SAT INCRBY u2 102 1",
+				"OVERFLOW FAIL INCRBY u2 102 1",
+				"OVERFLOW FAIL INCRBY u2 102 -3 GET u2 102",
+			},
+			want: [][]string{{"1", "1"}, {"2", "2"}, {"3", "3"}, {"0", "3"}, {"nil"}, {"0", "0"}},
+		},
+		{
+			name: "signed overflow",
+			cmds: []string{
+				"SET i8 0 127",
+				"INCRBY i8 0 1",
+				"OVERFLOW SAT INCRBY i8 0 -1000",
+				"OVERFLOW WRAP INCRBY i8 0 -1",
+				"OVERFLOW FAIL INCRBY i8 0 200 GET i8 0",
+				"OVERFLOW SAT SET i8 0 1000 GET u8 0",
+			},
+			want: [][]string{{"0"}, {"-128"}, {"-128"}, {"127"}, {"nil", "127"}, {"127", "127"}},
+		},
+	}
+	for _, tt := range tests {
+		var buf []byte
+		for i, cmd := range tt.cmds {
+			var vals []*big.Int
+			var err error
+			if buf, vals, _, err = bitfield(buf, splitArgs(cmd), 512<<20); err != nil {
+				t.Fatalf("%s: BITFIELD %s: %v", tt.name, cmd, err)
+			}
+			if got := bitfieldReply(vals); strings.Join(got, " ") != strings.Join(tt.want[i], " ") {
+				t.Errorf("%s: BITFIELD %s: got %v, want %v", tt.name, cmd, got, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestBitfieldErrors(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		want string
+	}{
+		{"GET u64 0", ErrBitfieldType.Error()},
+		{"GET i65 0", ErrBitfieldType.Error()},
+		{"GET x8 0", ErrBitfieldType.Error()},
+		{"GET u8 -1", ErrBitOffset.Error()},
+		{"OVERFLOW CLAMP", "ERR invalid OVERFLOW type specified"},
+		{"SET u8 0", ErrSyntax.Error()},
+		{"SET u8 4096 1", "ERR string exceeds maximum allowed size"},
+	}
+	for _, tt := range tests {
+		_, _, _, err := bitfield(nil, splitArgs(tt.cmd), 512)
+		if err == nil || err.Error() != tt.want {
+			t.Errorf("BITFIELD %s: got %v, want %s", tt.cmd, err, tt.want)
+		}
+	}
+}
+
+func splitArgs(args string) [][]byte {
+	var c [][]byte
+	for _, arg := range strings.Fields(args) {
+		c = append(c, []byte(arg))
+	}
+	return c
+}
+
+func bitfieldReply(vals []*big.Int) []string {
+	var res []string
+	for _, v := range vals {
+		if v == nil {
+			res = append(res, "nil")
+		} else {
+			res = append(res, v.String())
+		}
+	}
+	return res
+}
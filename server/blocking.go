@@ -0,0 +1,326 @@
+package main
+
+import (
+	"errors"
+	"github.com/k-si/CaskDB"
+	"github.com/k-si/Kinx/kiface"
+	"github.com/k-si/Kinx/knet"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrTimeout         = errors.New("ERR timeout is not a float or out of range")
+	ErrNegativeTimeout = errors.New("ERR timeout is negative")
+	ErrTimeoutRange    = errors.New("ERR timeout is out of range")
+)
+
+// blockKey identifies a list of one database.
+type blockKey struct {
+	db  int
+	key string
+}
+
+// waiter is a connection parked by a blocking command until one of its keys
+// receives an element or its timeout expires. The client keeps sending heart
+// beats while it waits, so the connection is not reaped meanwhile.
+type waiter struct {
+	conn  kiface.IConnection
+	db    int
+	keys  [][]byte
+	serve func(db *CaskDB.DB, key []byte) ([]byte, error) // consumes from key and builds the reply
+	timer *time.Timer
+	done  bool
+}
+
+func parseTimeout(b []byte) (time.Duration, error) {
+	f, err := strconv.ParseFloat(string(b), 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, ErrTimeout
+	}
+	if f < 0 {
+		return 0, ErrNegativeTimeout
+	}
+	if f*float64(time.Second) >= math.MaxInt64 {
+		return 0, ErrTimeoutRange
+	}
+	return time.Duration(f * float64(time.Second)), nil
+}
+
+// msDuration converts a non negative number of milliseconds, ok is false
+// when the duration overflows.
+func msDuration(ms int64) (time.Duration, bool) {
+	if ms > math.MaxInt64/int64(time.Millisecond) {
+		return 0, false
+	}
+	return time.Duration(ms) * time.Millisecond, true
+}
+
+// popFrom pops an element from the head or the tail of a list.
+func popFrom(db *CaskDB.DB, key []byte, left bool) ([]byte, error) {
+	if left {
+		return db.LPop(key)
+	}
+	return db.RPop(key)
+}
+
+// pushTo pushes an element to the head or the tail of a list.
+func pushTo(db *CaskDB.DB, key, val []byte, left bool) error {
+	if left {
+		return db.LPush(key, val)
+	}
+	return db.RPush(key, val)
+}
+
+// parseSide parses the LEFT|RIGHT arguments of the move commands.
+func parseSide(b []byte) (bool, error) {
+	switch strings.ToLower(string(b)) {
+	case "left":
+		return true, nil
+	case "right":
+		return false, nil
+	}
+	return false, ErrSyntax
+}
+
+// listMove atomically pops an element from src and pushes it to dst, the
+// waiters blocked on dst are served afterwards.
+func (s *Server) listMove(dbIndex int, src, dst []byte, fromLeft, toLeft bool) ([]byte, error) {
+	db := s.dbs[dbIndex]
+	val, err := popFrom(db, src, fromLeft)
+	if err != nil || len(val) == 0 {
+		return nil, err
+	}
+	if err = pushTo(db, dst, val, toLeft); err != nil {
+		return nil, err
+	}
+	s.wakeUp(dbIndex, dst)
+	return val, nil
+}
+
+// block parks w on its keys, a zero timeout waits forever.
+func (s *Server) block(w *waiter, timeout time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range w.keys {
+		bk := blockKey{db: w.db, key: string(key)}
+		s.blocked[bk] = append(s.blocked[bk], w)
+	}
+	if timeout > 0 {
+		w.timer = time.AfterFunc(timeout, func() {
+			if !s.unblock(w) {
+				return
+			}
+			if err := w.conn.SendMessage(200, []byte("(nil)")); err != nil {
+				log.Println(err)
+			}
+		})
+	}
+}
+
+// unblock removes w from all its keys, it reports false if w was already
+// served, timed out or dropped.
+func (s *Server) unblock(w *waiter) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.unblockLocked(w)
+}
+
+func (s *Server) unblockLocked(w *waiter) bool {
+	if w.done {
+		return false
+	}
+	w.done = true
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	for _, key := range w.keys {
+		bk := blockKey{db: w.db, key: string(key)}
+		ws := s.blocked[bk]
+		for i := range ws {
+			if ws[i] == w {
+				ws = append(ws[:i], ws[i+1:]...)
+				break
+			}
+		}
+		if len(ws) == 0 {
+			delete(s.blocked, bk)
+		} else {
+			s.blocked[bk] = ws
+		}
+	}
+	return true
+}
+
+// nextWaiter takes the connection blocked for the longest time on key.
+func (s *Server) nextWaiter(dbIndex int, key []byte) *waiter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ws := s.blocked[blockKey{db: dbIndex, key: string(key)}]
+	if len(ws) == 0 {
+		return nil
+	}
+	w := ws[0]
+	s.unblockLocked(w)
+	return w
+}
+
+// dropWaiters forgets the waiters of a closed connection, s.mu must be held.
+func (s *Server) dropWaiters(conn kiface.IConnection) {
+	var drop []*waiter
+	for _, ws := range s.blocked {
+		for _, w := range ws {
+			if w.conn.GetConnID() == conn.GetConnID() {
+				drop = append(drop, w)
+			}
+		}
+	}
+	for _, w := range drop {
+		s.unblockLocked(w)
+	}
+}
+
+// wakeUp serves the waiters of a list in arrival order for as long as the
+// list has elements, it must be called after pushing to a list.
+func (s *Server) wakeUp(dbIndex int, key []byte) {
+	db := s.dbs[dbIndex]
+	for db.LLen(key) > 0 {
+		w := s.nextWaiter(dbIndex, key)
+		if w == nil {
+			return
+		}
+		res, err := w.serve(db, key)
+		if err != nil {
+			if err = w.conn.SendMessage(400, []byte(err.Error())); err != nil {
+				log.Println(err)
+			}
+		} else {
+			if err = w.conn.SendMessage(200, res); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// blockingPop serves BLPOP and BRPOP, from the first non empty list or
+// from the first list receiving an element.
+func blockingPop(req kiface.IRequest, left bool) {
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+	keys := c[:len(c)-1]
+
+	timeout, err := parseTimeout(c[len(c)-1])
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	serve := func(db *CaskDB.DB, key []byte) ([]byte, error) {
+		val, err := popFrom(db, key, left)
+		if err != nil {
+			return nil, err
+		}
+		b := strings.Builder{}
+		writeList(&b, [][]byte{key, val})
+		return []byte(b.String()), nil
+	}
+
+	db := s.db(req)
+	for _, key := range keys {
+		if db.LLen(key) == 0 {
+			continue
+		}
+		res, err := serve(db, key)
+		if err != nil {
+			if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+				log.Println(err)
+			}
+		} else {
+			if err = req.GetConnection().SendMessage(200, res); err != nil {
+				log.Println(err)
+			}
+		}
+		return
+	}
+
+	s.block(&waiter{
+		conn:  req.GetConnection(),
+		db:    s.session(req.GetConnection()).db,
+		keys:  keys,
+		serve: serve,
+	}, timeout)
+}
+
+type BLPopRouter struct {
+	knet.BaseRouter
+}
+
+func (blpr *BLPopRouter) Handle(req kiface.IRequest) {
+	log.Println("handle BLPop")
+	blockingPop(req, true)
+}
+
+type BRPopRouter struct {
+	knet.BaseRouter
+}
+
+func (brpr *BRPopRouter) Handle(req kiface.IRequest) {
+	log.Println("handle BRPop")
+	blockingPop(req, false)
+}
+
+type BLMoveRouter struct {
+	knet.BaseRouter
+}
+
+func (blmr *BLMoveRouter) Handle(req kiface.IRequest) {
+	log.Println("handle BLMove")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	fromLeft, err := parseSide(c[2])
+	var toLeft bool
+	if err == nil {
+		toLeft, err = parseSide(c[3])
+	}
+	var timeout time.Duration
+	if err == nil {
+		timeout, err = parseTimeout(c[4])
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	dbIndex := s.session(req.GetConnection()).db
+	if s.dbs[dbIndex].LLen(c[0]) > 0 {
+		res, err := s.listMove(dbIndex, c[0], c[1], fromLeft, toLeft)
+		if err != nil {
+			if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+				log.Println(err)
+			}
+		} else {
+			if err = req.GetConnection().SendMessage(200, res); err != nil {
+				log.Println(err)
+			}
+		}
+		return
+	}
+
+	s.block(&waiter{
+		conn: req.GetConnection(),
+		db:   dbIndex,
+		keys: c[:1],
+		serve: func(db *CaskDB.DB, key []byte) ([]byte, error) {
+			return s.listMove(dbIndex, c[0], c[1], fromLeft, toLeft)
+		},
+	}, timeout)
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/k-si/CaskDB"
+	"github.com/k-si/Kinx/kiface"
+	"github.com/k-si/Kinx/knet"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// A bloom filter is stored as a string: the magic, the expansion and the
+// layers. A layer holds capacity items at its error rate, once it is full a
+// new layer expansion times larger and with half the error rate is added, so
+// that the error rate of the whole filter stays under twice the one
+// reserved. A NONSCALING filter has an expansion of 0 and refuses items once
+// full.
+const (
+	bloomDefaultError    = 0.01
+	bloomDefaultCapacity = 100
+	bloomDefaultExpand   = 2
+	bloomSeed            = 0x5bd1e995
+	// encoded sizes of the filter header and of a layer header
+	bloomHeader      = 4 + 4 + 4
+	bloomLayerHeader = 8 + 8 + 4 + 8 + 8
+)
+
+var (
+	bloomMagic     = []byte("BLOM")
+	ErrNotBloom    = errors.New("WRONGTYPE Key is not a valid bloom filter value.")
+	ErrBloomExists = errors.New("ERR item exists")
+	ErrBloomFull   = errors.New("ERR non scaling filter is full")
+	ErrErrorRate   = errors.New("ERR error rate should be between 0 and 1")
+	ErrCapacity    = errors.New("ERR capacity should be larger than 0")
+	ErrExpansion   = errors.New("ERR expansion should be larger than 0")
+	ErrFilterSize  = errors.New("ERR filter exceeds maximum allowed size")
+)
+
+type bloomLayer struct {
+	capacity uint64
+	count    uint64
+	hashes   uint32
+	errRate  float64
+	bits     []byte
+}
+
+// newBloomLayer makes a layer, unless it takes more than room bytes once
+// encoded. The size is worked out before allocating anything, as the
+// capacity and the error rate come from the client.
+func newBloomLayer(capacity uint64, errRate float64, room int64) (*bloomLayer, error) {
+	// m = -n ln(p) / ln(2)^2 bits and k = m / n ln(2) hashes
+	m := math.Ceil(-float64(capacity) * math.Log(errRate) / (math.Ln2 * math.Ln2))
+	if m < 8 {
+		m = 8
+	}
+	size := math.Ceil(m / 8)
+	if size+bloomLayerHeader > float64(room) {
+		return nil, ErrFilterSize
+	}
+	k := uint32(math.Ceil(m / float64(capacity) * math.Ln2))
+	return &bloomLayer{capacity: capacity, hashes: k, errRate: errRate, bits: make([]byte, int64(size))}, nil
+}
+
+// positions are the bits of an item, by double hashing.
+func (l *bloomLayer) positions(h1, h2 uint64) []uint64 {
+	n := uint64(len(l.bits)) * 8
+	res := make([]uint64, l.hashes)
+	for i := range res {
+		res[i] = (h1 + uint64(i)*h2) % n
+	}
+	return res
+}
+
+func (l *bloomLayer) has(h1, h2 uint64) bool {
+	for _, p := range l.positions(h1, h2) {
+		if l.bits[p/8]&(1<<(p%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *bloomLayer) add(h1, h2 uint64) {
+	for _, p := range l.positions(h1, h2) {
+		l.bits[p/8] |= 1 << (p % 8)
+	}
+	l.count++
+}
+
+type bloom struct {
+	expansion uint32
+	layers    []*bloomLayer
+}
+
+// newBloom makes a filter taking at most maxSize bytes once encoded.
+func newBloom(errRate float64, capacity uint64, expansion uint32, maxSize uint32) (*bloom, error) {
+	l, err := newBloomLayer(capacity, errRate, int64(maxSize)-bloomHeader)
+	if err != nil {
+		return nil, err
+	}
+	return &bloom{expansion: expansion, layers: []*bloomLayer{l}}, nil
+}
+
+// size is the length of the encoded filter.
+func (b *bloom) size() int64 {
+	n := int64(bloomHeader)
+	for _, l := range b.layers {
+		n += bloomLayerHeader + int64(len(l.bits))
+	}
+	return n
+}
+
+func bloomHashes(item []byte) (uint64, uint64) {
+	return murmurHash64A(item, bloomSeed), murmurHash64A(item, bloomSeed<<1|1)
+}
+
+func (b *bloom) exists(item []byte) bool {
+	h1, h2 := bloomHashes(item)
+	for _, l := range b.layers {
+		if l.has(h1, h2) {
+			return true
+		}
+	}
+	return false
+}
+
+// add adds an item, reporting false when it may already be in the filter.
+// A new layer is refused when the filter would take more than maxSize bytes.
+func (b *bloom) add(item []byte, maxSize uint32) (bool, error) {
+	if b.exists(item) {
+		return false, nil
+	}
+	last := b.layers[len(b.layers)-1]
+	if last.count >= last.capacity {
+		if b.expansion == 0 {
+			return false, ErrBloomFull
+		}
+		if last.capacity > math.MaxUint64/uint64(b.expansion) {
+			return false, ErrFilterSize
+		}
+		var err error
+		if last, err = newBloomLayer(last.capacity*uint64(b.expansion), last.errRate/2, int64(maxSize)-b.size()); err != nil {
+			return false, err
+		}
+		b.layers = append(b.layers, last)
+	}
+	h1, h2 := bloomHashes(item)
+	last.add(h1, h2)
+	return true, nil
+}
+
+func (b *bloom) encode() []byte {
+	buf := bytes.Buffer{}
+	buf.Write(bloomMagic)
+	_ = binary.Write(&buf, binary.BigEndian, b.expansion)
+	_ = binary.Write(&buf, binary.BigEndian, uint32(len(b.layers)))
+	for _, l := range b.layers {
+		_ = binary.Write(&buf, binary.BigEndian, l.capacity)
+		_ = binary.Write(&buf, binary.BigEndian, l.count)
+		_ = binary.Write(&buf, binary.BigEndian, l.hashes)
+		_ = binary.Write(&buf, binary.BigEndian, math.Float64bits(l.errRate))
+		_ = binary.Write(&buf, binary.BigEndian, uint64(len(l.bits)))
+		buf.Write(l.bits)
+	}
+	return buf.Bytes()
+}
+
+func decodeBloom(v []byte) (*bloom, error) {
+	if !bytes.HasPrefix(v, bloomMagic) {
+		return nil, ErrNotBloom
+	}
+	r := bytes.NewReader(v[len(bloomMagic):])
+	b := &bloom{}
+	var n uint32
+	if binary.Read(r, binary.BigEndian, &b.expansion) != nil || binary.Read(r, binary.BigEndian, &n) != nil {
+		return nil, ErrNotBloom
+	}
+	for i := uint32(0); i < n; i++ {
+		l := &bloomLayer{}
+		var errBits, size uint64
+		for _, field := range []interface{}{&l.capacity, &l.count, &l.hashes, &errBits, &size} {
+			if binary.Read(r, binary.BigEndian, field) != nil {
+				return nil, ErrNotBloom
+			}
+		}
+		if size == 0 || size > uint64(r.Len()) {
+			return nil, ErrNotBloom
+		}
+		l.errRate = math.Float64frombits(errBits)
+		l.bits = make([]byte, size)
+		_, _ = r.Read(l.bits)
+		b.layers = append(b.layers, l)
+	}
+	if n == 0 || r.Len() != 0 {
+		return nil, ErrNotBloom
+	}
+	return b, nil
+}
+
+// loadBloom reads the bloom filter stored at key, or nil if there is none.
+func loadBloom(db *CaskDB.DB, key []byte) (*bloom, error) {
+	v, err := getString(db, key)
+	if err != nil || len(v) == 0 {
+		return nil, err
+	}
+	return decodeBloom(v)
+}
+
+func parseErrorRate(b []byte) (float64, error) {
+	errRate, err := strconv.ParseFloat(string(b), 64)
+	if err != nil || errRate <= 0 || errRate >= 1 {
+		return 0, ErrErrorRate
+	}
+	return errRate, nil
+}
+
+func parseCapacity(b []byte) (uint64, error) {
+	capacity, err := strconv.ParseUint(string(b), 10, 64)
+	if err != nil || capacity == 0 {
+		return 0, ErrCapacity
+	}
+	return capacity, nil
+}
+
+// BFReserveRouter creates an empty bloom filter:
+// BF.RESERVE key error_rate capacity [EXPANSION n] [NONSCALING]
+type BFReserveRouter struct {
+	knet.BaseRouter
+}
+
+func (bfrr *BFReserveRouter) Handle(req kiface.IRequest) {
+	log.Println("handle BFReserve")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	db := s.db(req)
+	errRate, err := parseErrorRate(c[1])
+	var capacity uint64
+	if err == nil {
+		capacity, err = parseCapacity(c[2])
+	}
+	expansion := uint32(bloomDefaultExpand)
+	for i := 3; i < len(c) && err == nil; i++ {
+		switch strings.ToLower(string(c[i])) {
+		case "expansion":
+			var n uint64
+			if i+1 >= len(c) {
+				err = ErrSyntax
+			} else if n, err = strconv.ParseUint(string(c[i+1]), 10, 32); err != nil || n == 0 {
+				err = ErrExpansion
+			}
+			expansion = uint32(n)
+			i++
+		case "nonscaling":
+			expansion = 0
+		default:
+			err = ErrSyntax
+		}
+	}
+	var v []byte
+	if err == nil {
+		v, err = getString(db, c[0])
+	}
+	if err == nil && len(v) > 0 {
+		err = ErrBloomExists
+	}
+	var b *bloom
+	if err == nil {
+		b, err = newBloom(errRate, capacity, expansion, s.dbCfg.MaxValueSize)
+	}
+	if err == nil {
+		err = db.Set(c[0], b.encode())
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte("\"OK\"")); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// bfAdd adds items to the bloom filter at key, creating it with the default
+// error rate and capacity, and reports for each whether it was added.
+func bfAdd(db *CaskDB.DB, key []byte, items [][]byte) ([][]byte, error) {
+	b, err := loadBloom(db, key)
+	if err != nil {
+		return nil, err
+	}
+	if b == nil {
+		if b, err = newBloom(bloomDefaultError, bloomDefaultCapacity, bloomDefaultExpand, s.dbCfg.MaxValueSize); err != nil {
+			return nil, err
+		}
+	}
+	var res [][]byte
+	for _, item := range items {
+		added, err := b.add(item, s.dbCfg.MaxValueSize)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, []byte(strconv.FormatBool(added)))
+	}
+	return res, db.Set(key, b.encode())
+}
+
+// BFAddRouter adds an item to a bloom filter, replying with false when it
+// may already have been added.
+type BFAddRouter struct {
+	knet.BaseRouter
+}
+
+func (bfar *BFAddRouter) Handle(req kiface.IRequest) {
+	log.Println("handle BFAdd")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	res, err := bfAdd(s.db(req), c[0], c[1:])
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, res[0]); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// BFMAddRouter adds items to a bloom filter, replying with a list like
+// BF.ADD does for each.
+type BFMAddRouter struct {
+	knet.BaseRouter
+}
+
+func (bfmar *BFMAddRouter) Handle(req kiface.IRequest) {
+	log.Println("handle BFMAdd")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	res, err := bfAdd(s.db(req), c[0], c[1:])
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		sendList(req, res)
+	}
+}
+
+// BFExistsRouter replies with whether an item may have been added to a
+// bloom filter.
+type BFExistsRouter struct {
+	knet.BaseRouter
+}
+
+func (bfer *BFExistsRouter) Handle(req kiface.IRequest) {
+	log.Println("handle BFExists")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	b, err := loadBloom(s.db(req), c[0])
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte(strconv.FormatBool(b != nil && b.exists(c[1])))); err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/k-si/CaskDB"
+	"github.com/k-si/Kinx/kiface"
+	"log"
+	"strings"
+)
+
+const (
+	CategoryRead       = "read"
+	CategoryWrite      = "write"
+	CategoryAdmin      = "admin"
+	CategoryConnection = "connection"
+)
+
+var categories = map[string]bool{
+	CategoryRead:       true,
+	CategoryWrite:      true,
+	CategoryAdmin:      true,
+	CategoryConnection: true,
+}
+
+// Command describes a router registered on the tcp server, every request
+// passes the authentication and permission checks before it is dispatched.
+type Command struct {
+	Id       uint32
+	Name     string
+	Category string
+	Arity    int // exact number of arguments, or the negated minimum
+	FirstKey int
+	LastKey  int    // negative values count from the end of the arguments
+	KeyStep  int    // zero means the command takes no keys
+	Type     string // type of the keys, TypeNone when any type goes
+	Router   kiface.IRouter
+}
+
+var commandTable = []*Command{
+	// string
+	{0, "set", CategoryWrite, 2, 0, 0, 1, TypeNone, &SetRouter{}},
+	{1, "mset", CategoryWrite, -2, 0, -1, 2, TypeNone, &MSetRouter{}},
+	{2, "setnx", CategoryWrite, 2, 0, 0, 1, TypeString, &SetNxRouter{}},
+	{3, "msetnx", CategoryWrite, -2, 0, -1, 2, TypeString, &MSetNxRouter{}},
+	{4, "get", CategoryRead, 1, 0, 0, 1, TypeString, &GetRouter{}},
+	{5, "mget", CategoryRead, -1, 0, -1, 1, TypeString, &MGetRouter{}},
+	{6, "getset", CategoryWrite, 2, 0, 0, 1, TypeString, &GetSetRouter{}},
+	{7, "remove", CategoryWrite, 1, 0, 0, 1, TypeString, &RemoveRouter{}},
+	{8, "slen", CategoryRead, 0, 0, 0, 0, TypeNone, &SLenRouter{}},
+	// hash
+	{9, "hset", CategoryWrite, 3, 0, 0, 1, TypeHash, &HSetRouter{}},
+	{10, "hsetnx", CategoryWrite, 3, 0, 0, 1, TypeHash, &HSetNxRouter{}},
+	{11, "hget", CategoryRead, 2, 0, 0, 1, TypeHash, &HGetRouter{}},
+	{12, "hgetall", CategoryRead, 1, 0, 0, 1, TypeHash, &HGetAllRouter{}},
+	{13, "hdel", CategoryWrite, 2, 0, 0, 1, TypeHash, &HDelRouter{}},
+	{14, "hlen", CategoryRead, 1, 0, 0, 1, TypeHash, &HLenRouter{}},
+	{15, "hexist", CategoryRead, 2, 0, 0, 1, TypeHash, &HExistRouter{}},
+	// list
+	{16, "lpush", CategoryWrite, -2, 0, 0, 1, TypeList, &LPushRouter{}},
+	{17, "lrpush", CategoryWrite, -2, 0, 0, 1, TypeList, &LRPushRouter{}},
+	{18, "lpop", CategoryWrite, 1, 0, 0, 1, TypeList, &LPopRouter{}},
+	{19, "lrpop", CategoryWrite, 1, 0, 0, 1, TypeList, &LRPopRouter{}},
+	{20, "linsert", CategoryWrite, 3, 0, 0, 1, TypeList, &LInsertRouter{}},
+	{21, "lrinsert", CategoryWrite, 3, 0, 0, 1, TypeList, &LRInsertRouter{}},
+	{22, "lset", CategoryWrite, 3, 0, 0, 1, TypeList, &LSetRouter{}},
+	{23, "lrem", CategoryWrite, 3, 0, 0, 1, TypeList, &LRemRouter{}},
+	{24, "llen", CategoryRead, 1, 0, 0, 1, TypeList, &LLenRouter{}},
+	{25, "lindex", CategoryRead, 2, 0, 0, 1, TypeList, &LIndexRouter{}},
+	{26, "lrange", CategoryRead, 3, 0, 0, 1, TypeList, &LRangeRouter{}},
+	{27, "lexist", CategoryRead, 2, 0, 0, 1, TypeList, &LExistRouter{}},
+	// set
+	{28, "sadd", CategoryWrite, -2, 0, 0, 1, TypeSet, &SAddRouter{}},
+	{29, "srem", CategoryWrite, 2, 0, 0, 1, TypeSet, &SRemRouter{}},
+	{30, "smove", CategoryWrite, 3, 0, 1, 1, TypeSet, &SMoveRouter{}},
+	{31, "sunion", CategoryRead, -1, 0, -1, 1, TypeSet, &SUnionRouter{}},
+	{32, "sdiff", CategoryRead, -1, 0, -1, 1, TypeSet, &SDiffRouter{}},
+	{33, "sscan", CategoryRead, 1, 0, 0, 1, TypeSet, &SScanRouter{}},
+	{34, "scard", CategoryRead, 1, 0, 0, 1, TypeSet, &SCardRouter{}},
+	{35, "sismember", CategoryRead, 2, 0, 0, 1, TypeSet, &SIsMemberRouter{}},
+	// zset
+	{36, "zadd", CategoryWrite, -3, 0, 0, 1, TypeZSet, &ZAddRouter{}},
+	{37, "zrem", CategoryWrite, 2, 0, 0, 1, TypeZSet, &ZRemRouter{}},
+	{38, "zscorerange", CategoryRead, 3, 0, 0, 1, TypeZSet, &ZScoreRangeRouter{}},
+	{39, "zscore", CategoryRead, 2, 0, 0, 1, TypeZSet, &ZScoreRouter{}},
+	{40, "zcard", CategoryRead, 1, 0, 0, 1, TypeZSet, &ZCardRouter{}},
+	{41, "zismember", CategoryRead, 2, 0, 0, 1, TypeZSet, &ZIsMemberRouter{}},
+	{42, "ztop", CategoryRead, 2, 0, 0, 1, TypeZSet, &ZTopRouter{}},
+	// connection
+	{43, "auth", CategoryConnection, -1, 0, 0, 0, TypeNone, &AuthRouter{}},
+	// admin
+	{44, "acl", CategoryAdmin, -1, 0, 0, 0, TypeNone, &AclRouter{}},
+	// database
+	{45, "select", CategoryConnection, 1, 0, 0, 0, TypeNone, &SelectRouter{}},
+	{46, "swapdb", CategoryAdmin, 2, 0, 0, 0, TypeNone, &SwapDBRouter{}},
+	{47, "flushdb", CategoryAdmin, 0, 0, 0, 0, TypeNone, &FlushDBRouter{}},
+	{48, "flushall", CategoryAdmin, 0, 0, 0, 0, TypeNone, &FlushAllRouter{}},
+	// counter
+	{49, "incr", CategoryWrite, 1, 0, 0, 1, TypeString, &IncrRouter{}},
+	{50, "decr", CategoryWrite, 1, 0, 0, 1, TypeString, &DecrRouter{}},
+	{51, "incrby", CategoryWrite, 2, 0, 0, 1, TypeString, &IncrByRouter{}},
+	{52, "decrby", CategoryWrite, 2, 0, 0, 1, TypeString, &DecrByRouter{}},
+	{53, "incrbyfloat", CategoryWrite, 2, 0, 0, 1, TypeString, &IncrByFloatRouter{}},
+	{54, "hincrby", CategoryWrite, 3, 0, 0, 1, TypeHash, &HIncrByRouter{}},
+	{55, "hincrbyfloat", CategoryWrite, 3, 0, 0, 1, TypeHash, &HIncrByFloatRouter{}},
+	// string range
+	{56, "strlen", CategoryRead, 1, 0, 0, 1, TypeString, &StrLenRouter{}},
+	{57, "append", CategoryWrite, 2, 0, 0, 1, TypeString, &AppendRouter{}},
+	{58, "getrange", CategoryRead, 3, 0, 0, 1, TypeString, &GetRangeRouter{}},
+	{59, "setrange", CategoryWrite, 3, 0, 0, 1, TypeString, &SetRangeRouter{}},
+	{60, "getdel", CategoryWrite, 1, 0, 0, 1, TypeString, &GetDelRouter{}},
+	{61, "getex", CategoryWrite, -1, 0, 0, 1, TypeString, &GetExRouter{}},
+	// bitmap
+	{62, "setbit", CategoryWrite, 3, 0, 0, 1, TypeString, &SetBitRouter{}},
+	{63, "getbit", CategoryRead, 2, 0, 0, 1, TypeString, &GetBitRouter{}},
+	{64, "bitcount", CategoryRead, -1, 0, 0, 1, TypeString, &BitCountRouter{}},
+	{65, "bitpos", CategoryRead, -2, 0, 0, 1, TypeString, &BitPosRouter{}},
+	{66, "bitop", CategoryWrite, -3, 1, -1, 1, TypeString, &BitOpRouter{}},
+	{67, "bitfield", CategoryWrite, -1, 0, 0, 1, TypeString, &BitFieldRouter{}},
+	// hash
+	{68, "hmset", CategoryWrite, -3, 0, 0, 1, TypeHash, &HMSetRouter{}},
+	{69, "hmget", CategoryRead, -2, 0, 0, 1, TypeHash, &HMGetRouter{}},
+	{70, "hkeys", CategoryRead, 1, 0, 0, 1, TypeHash, &HKeysRouter{}},
+	{71, "hvals", CategoryRead, 1, 0, 0, 1, TypeHash, &HValsRouter{}},
+	{72, "hrandfield", CategoryRead, -1, 0, 0, 1, TypeHash, &HRandFieldRouter{}},
+	{73, "hscan", CategoryRead, -2, 0, 0, 1, TypeHash, &HScanRouter{}},
+	{74, "hstrlen", CategoryRead, 2, 0, 0, 1, TypeHash, &HStrLenRouter{}},
+	// blocking list
+	{75, "blpop", CategoryWrite, -2, 0, -2, 1, TypeList, &BLPopRouter{}},
+	{76, "brpop", CategoryWrite, -2, 0, -2, 1, TypeList, &BRPopRouter{}},
+	{77, "blmove", CategoryWrite, 5, 0, 1, 1, TypeList, &BLMoveRouter{}},
+	// list move and trim
+	{78, "lmove", CategoryWrite, 4, 0, 1, 1, TypeList, &LMoveRouter{}},
+	{79, "rpoplpush", CategoryWrite, 2, 0, 1, 1, TypeList, &RPopLPushRouter{}},
+	{80, "ltrim", CategoryWrite, 3, 0, 0, 1, TypeList, &LTrimRouter{}},
+	{81, "lpos", CategoryRead, -2, 0, 0, 1, TypeList, &LPosRouter{}},
+	{82, "lpushx", CategoryWrite, -2, 0, 0, 1, TypeList, &LPushXRouter{}},
+	{83, "rpushx", CategoryWrite, -2, 0, 0, 1, TypeList, &RPushXRouter{}},
+	// set algebra
+	{84, "sinter", CategoryRead, -1, 0, -1, 1, TypeSet, &SInterRouter{}},
+	{85, "sintercard", CategoryRead, -2, 1, -1, 1, TypeSet, &SInterCardRouter{}},
+	{86, "sinterstore", CategoryWrite, -2, 0, -1, 1, TypeSet, &SInterStoreRouter{}},
+	{87, "sunionstore", CategoryWrite, -2, 0, -1, 1, TypeSet, &SUnionStoreRouter{}},
+	{88, "sdiffstore", CategoryWrite, -2, 0, -1, 1, TypeSet, &SDiffStoreRouter{}},
+	{89, "spop", CategoryWrite, -1, 0, 0, 1, TypeSet, &SPopRouter{}},
+	{90, "srandmember", CategoryRead, -1, 0, 0, 1, TypeSet, &SRandMemberRouter{}},
+	{91, "smismember", CategoryRead, -2, 0, 0, 1, TypeSet, &SMIsMemberRouter{}},
+	// zset rank and score ranges
+	{92, "zrange", CategoryRead, -3, 0, 0, 1, TypeZSet, &ZRangeRouter{}},
+	{93, "zrevrange", CategoryRead, -3, 0, 0, 1, TypeZSet, &ZRevRangeRouter{}},
+	{94, "zrangebyscore", CategoryRead, -3, 0, 0, 1, TypeZSet, &ZRangeByScoreRouter{}},
+	{95, "zrevrangebyscore", CategoryRead, -3, 0, 0, 1, TypeZSet, &ZRevRangeByScoreRouter{}},
+	{96, "zrank", CategoryRead, -2, 0, 0, 1, TypeZSet, &ZRankRouter{}},
+	{97, "zrevrank", CategoryRead, -2, 0, 0, 1, TypeZSet, &ZRevRankRouter{}},
+	{98, "zcount", CategoryRead, 3, 0, 0, 1, TypeZSet, &ZCountRouter{}},
+	// zset mutation
+	{99, "zincrby", CategoryWrite, 3, 0, 0, 1, TypeZSet, &ZIncrByRouter{}},
+	// 100 is left to the heart beat package, see DefaultHeartPackageId
+	{167, "zpopmin", CategoryWrite, -1, 0, 0, 1, TypeZSet, &ZPopMinRouter{}},
+	{101, "zpopmax", CategoryWrite, -1, 0, 0, 1, TypeZSet, &ZPopMaxRouter{}},
+	{102, "zremrangebyscore", CategoryWrite, 3, 0, 0, 1, TypeZSet, &ZRemRangeByScoreRouter{}},
+	{103, "zremrangebyrank", CategoryWrite, 3, 0, 0, 1, TypeZSet, &ZRemRangeByRankRouter{}},
+	// zset aggregation
+	{104, "zunion", CategoryRead, -2, 1, -1, 1, TypeZSet, &ZUnionRouter{}},
+	{105, "zinter", CategoryRead, -2, 1, -1, 1, TypeZSet, &ZInterRouter{}},
+	{106, "zdiff", CategoryRead, -2, 1, -1, 1, TypeZSet, &ZDiffRouter{}},
+	{107, "zunionstore", CategoryWrite, -3, 0, -1, 1, TypeZSet, &ZUnionStoreRouter{}},
+	{108, "zinterstore", CategoryWrite, -3, 0, -1, 1, TypeZSet, &ZInterStoreRouter{}},
+	{109, "zdiffstore", CategoryWrite, -3, 0, -1, 1, TypeZSet, &ZDiffStoreRouter{}},
+	// zset lexicographic ranges
+	{110, "zrangebylex", CategoryRead, -3, 0, 0, 1, TypeZSet, &ZRangeByLexRouter{}},
+	{111, "zrevrangebylex", CategoryRead, -3, 0, 0, 1, TypeZSet, &ZRevRangeByLexRouter{}},
+	{112, "zlexcount", CategoryRead, 3, 0, 0, 1, TypeZSet, &ZLexCountRouter{}},
+	{113, "zremrangebylex", CategoryWrite, 3, 0, 0, 1, TypeZSet, &ZRemRangeByLexRouter{}},
+	// keyspace
+	{114, "type", CategoryRead, 1, 0, 0, 1, TypeNone, &TypeRouter{}},
+	{115, "exists", CategoryRead, -1, 0, -1, 1, TypeNone, &ExistsRouter{}},
+	{116, "del", CategoryWrite, -1, 0, -1, 1, TypeNone, &DelRouter{}},
+	{117, "unlink", CategoryWrite, -1, 0, -1, 1, TypeNone, &UnlinkRouter{}},
+	{118, "rename", CategoryWrite, 2, 0, 1, 1, TypeNone, &RenameRouter{}},
+	{119, "renamenx", CategoryWrite, 2, 0, 1, 1, TypeNone, &RenameNxRouter{}},
+	{120, "copy", CategoryWrite, -2, 0, 1, 1, TypeNone, &CopyRouter{}},
+	// stream
+	{121, "xadd", CategoryWrite, -4, 0, 0, 1, TypeStream, &XAddRouter{}},
+	{122, "xlen", CategoryRead, 1, 0, 0, 1, TypeStream, &XLenRouter{}},
+	{123, "xrange", CategoryRead, -3, 0, 0, 1, TypeStream, &XRangeRouter{}},
+	{124, "xrevrange", CategoryRead, -3, 0, 0, 1, TypeStream, &XRevRangeRouter{}},
+	{125, "xread", CategoryRead, -3, 0, 0, 1, TypeStream, &XReadRouter{}},
+	{126, "xreadgroup", CategoryWrite, -6, 0, 0, 1, TypeStream, &XReadGroupRouter{}},
+	{127, "xgroup", CategoryWrite, -3, 1, 1, 1, TypeStream, &XGroupRouter{}},
+	{128, "xack", CategoryWrite, -3, 0, 0, 1, TypeStream, &XAckRouter{}},
+	{129, "xpending", CategoryRead, -2, 0, 0, 1, TypeStream, &XPendingRouter{}},
+	{130, "xclaim", CategoryWrite, -5, 0, 0, 1, TypeStream, &XClaimRouter{}},
+	// hyperloglog
+	{131, "pfadd", CategoryWrite, -1, 0, 0, 1, TypeString, &PFAddRouter{}},
+	{132, "pfcount", CategoryRead, -1, 0, -1, 1, TypeString, &PFCountRouter{}},
+	{133, "pfmerge", CategoryWrite, -1, 0, -1, 1, TypeString, &PFMergeRouter{}},
+	// geo
+	{134, "geoadd", CategoryWrite, -4, 0, 0, 1, TypeZSet, &GeoAddRouter{}},
+	{135, "geopos", CategoryRead, -1, 0, 0, 1, TypeZSet, &GeoPosRouter{}},
+	{136, "geohash", CategoryRead, -1, 0, 0, 1, TypeZSet, &GeoHashRouter{}},
+	{137, "geodist", CategoryRead, -3, 0, 0, 1, TypeZSet, &GeoDistRouter{}},
+	{138, "geosearch", CategoryRead, -6, 0, 0, 1, TypeZSet, &GeoSearchRouter{}},
+	// json
+	{139, "json.set", CategoryWrite, -3, 0, 0, 1, TypeJSON, &JSONSetRouter{}},
+	{140, "json.get", CategoryRead, -1, 0, 0, 1, TypeJSON, &JSONGetRouter{}},
+	{141, "json.del", CategoryWrite, -1, 0, 0, 1, TypeJSON, &JSONDelRouter{}},
+	{142, "json.arrappend", CategoryWrite, -3, 0, 0, 1, TypeJSON, &JSONArrAppendRouter{}},
+	{143, "json.numincrby", CategoryWrite, 3, 0, 0, 1, TypeJSON, &JSONNumIncrByRouter{}},
+	// time series
+	{144, "ts.create", CategoryWrite, -1, 0, 0, 1, TypeTS, &TSCreateRouter{}},
+	{145, "ts.add", CategoryWrite, -3, 0, 0, 1, TypeTS, &TSAddRouter{}},
+	{146, "ts.range", CategoryRead, -3, 0, 0, 1, TypeTS, &TSRangeRouter{}},
+	{147, "ts.createrule", CategoryWrite, 5, 0, 1, 1, TypeTS, &TSCreateRuleRouter{}},
+	{148, "ts.deleterule", CategoryWrite, 2, 0, 1, 1, TypeTS, &TSDeleteRuleRouter{}},
+	{149, "ts.info", CategoryRead, 1, 0, 0, 1, TypeTS, &TSInfoRouter{}},
+	// bloom and cuckoo filters
+	{150, "bf.reserve", CategoryWrite, -3, 0, 0, 1, TypeString, &BFReserveRouter{}},
+	{151, "bf.add", CategoryWrite, 2, 0, 0, 1, TypeString, &BFAddRouter{}},
+	{152, "bf.madd", CategoryWrite, -2, 0, 0, 1, TypeString, &BFMAddRouter{}},
+	{153, "bf.exists", CategoryRead, 2, 0, 0, 1, TypeString, &BFExistsRouter{}},
+	{154, "cf.reserve", CategoryWrite, -2, 0, 0, 1, TypeString, &CFReserveRouter{}},
+	{155, "cf.add", CategoryWrite, 2, 0, 0, 1, TypeString, &CFAddRouter{}},
+	{156, "cf.addnx", CategoryWrite, 2, 0, 0, 1, TypeString, &CFAddNxRouter{}},
+	{157, "cf.exists", CategoryRead, 2, 0, 0, 1, TypeString, &CFExistsRouter{}},
+	{158, "cf.del", CategoryWrite, 2, 0, 0, 1, TypeString, &CFDelRouter{}},
+	// locks
+	{159, "lock", CategoryWrite, -3, 1, 1, 1, TypeNone, &LockRouter{}},
+	// queues
+	{160, "q.create", CategoryWrite, -1, 0, 0, 1, TypeQueue, &QCreateRouter{}},
+	{161, "q.push", CategoryWrite, -2, 0, 0, 1, TypeQueue, &QPushRouter{}},
+	{162, "q.pop", CategoryWrite, -1, 0, 0, 1, TypeQueue, &QPopRouter{}},
+	{163, "q.ack", CategoryWrite, -2, 0, 0, 1, TypeQueue, &QAckRouter{}},
+	{164, "q.nack", CategoryWrite, -2, 0, 0, 1, TypeQueue, &QNackRouter{}},
+	{165, "q.stats", CategoryRead, 1, 0, 0, 1, TypeQueue, &QStatsRouter{}},
+	// rate limiting
+	{166, "ratelimit", CategoryWrite, -4, 0, 0, 1, TypeString, &RateLimitRouter{}},
+}
+
+// lookupCommand finds a command of the table by name.
+func lookupCommand(name string) *Command {
+	for _, cmd := range commandTable {
+		if cmd.Name == name {
+			return cmd
+		}
+	}
+	return nil
+}
+
+// keysRouter is implemented by the routers whose keys can not be described
+// by FirstKey, LastKey and KeyStep.
+type keysRouter interface {
+	keys(args [][]byte) [][]byte
+}
+
+// sourcesRouter is implemented by the routers storing their result in a
+// destination key, which they overwrite whatever its type, so that only the
+// source keys are type checked.
+type sourcesRouter interface {
+	sources(args [][]byte) [][]byte
+}
+
+// keys picks the keys out of the command arguments.
+func (cmd *Command) keys(args [][]byte) [][]byte {
+	if kr, ok := cmd.Router.(keysRouter); ok {
+		return kr.keys(args)
+	}
+	if cmd.KeyStep == 0 {
+		return nil
+	}
+	last := cmd.LastKey
+	if last < 0 {
+		last += len(args)
+	}
+	var keys [][]byte
+	for i := cmd.FirstKey; i <= last && i < len(args); i += cmd.KeyStep {
+		keys = append(keys, args[i])
+	}
+	return keys
+}
+
+func (cmd *Command) checkArity(n int) bool {
+	if cmd.Arity < 0 {
+		return n >= -cmd.Arity
+	}
+	return n == cmd.Arity
+}
+
+// check verifies that the connection may run the command with args.
+func (cmd *Command) check(conn kiface.IConnection, args [][]byte) error {
+	if !cmd.checkArity(len(args)) {
+		return fmt.Errorf("ERR wrong number of arguments for '%s' command", cmd.Name)
+	}
+	if cmd.Name == "auth" {
+		return nil
+	}
+
+	u := s.sessionUser(conn)
+	if u == nil {
+		return ErrNoAuth
+	}
+	if !u.canRun(cmd) {
+		return fmt.Errorf("NOPERM this user has no permissions to run the '%s' command", cmd.Name)
+	}
+	for _, key := range cmd.keys(args) {
+		if strings.HasPrefix(string(key), internalPrefix) {
+			return ErrReservedKey
+		}
+		if !u.canAccess(string(key)) {
+			return errors.New("NOPERM this user has no permissions to access one of the keys used as arguments")
+		}
+	}
+	return nil
+}
+
+// checkType verifies that the existing keys of args hold the type of values
+// the command works on.
+func (cmd *Command) checkType(db *CaskDB.DB, args [][]byte) error {
+	if cmd.Type == TypeNone {
+		return nil
+	}
+	keys := cmd.keys(args)
+	if sr, ok := cmd.Router.(sourcesRouter); ok {
+		keys = sr.sources(args)
+	}
+	for _, key := range keys {
+		t, err := keyType(db, key)
+		if err != nil {
+			return err
+		}
+		if t != TypeNone && t != cmd.Type {
+			return ErrWrongType
+		}
+	}
+	return nil
+}
+
+func (cmd *Command) PreHandle(req kiface.IRequest) {
+	cmd.Router.PreHandle(req)
+}
+
+func (cmd *Command) Handle(req kiface.IRequest) {
+	var args [][]byte
+	if data := req.GetMsg().GetMsgData(); len(data) > 0 {
+		args = parseCommand(string(data))
+	}
+
+	if err := cmd.check(req.GetConnection(), args); err != nil {
+		if err := req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	// commands run one at a time, which makes read-modify-write commands atomic
+	s.exec.Lock()
+	defer s.exec.Unlock()
+	if err := cmd.checkType(s.db(req), args); err != nil {
+		if err := req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	cmd.Router.Handle(req)
+}
+
+func (cmd *Command) PostHandle(req kiface.IRequest) {
+	cmd.Router.PostHandle(req)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"github.com/k-si/Kinx/kiface"
+	"github.com/k-si/Kinx/knet"
+	"log"
+	"math"
+	"strconv"
+)
+
+var (
+	ErrNotInteger = errors.New("ERR value is not an integer or out of range")
+	ErrNotFloat   = errors.New("ERR value is not a valid float")
+	ErrOverflow   = errors.New("ERR increment or decrement would overflow")
+	ErrNaNOrInf   = errors.New("ERR increment would produce NaN or Infinity")
+)
+
+func parseInt(b []byte) (int64, error) {
+	n, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		return 0, ErrNotInteger
+	}
+	return n, nil
+}
+
+func parseFloat(b []byte) (float64, error) {
+	f, err := strconv.ParseFloat(string(b), 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, ErrNotFloat
+	}
+	return f, nil
+}
+
+// incrBy adds incr to the integer stored in val, a missing value counts as 0.
+func incrBy(val []byte, incr int64) ([]byte, error) {
+	var n int64
+	if len(val) > 0 {
+		var err error
+		if n, err = parseInt(val); err != nil {
+			return nil, err
+		}
+	}
+	if (incr > 0 && n > math.MaxInt64-incr) || (incr < 0 && n < math.MinInt64-incr) {
+		return nil, ErrOverflow
+	}
+	return []byte(strconv.FormatInt(n+incr, 10)), nil
+}
+
+// incrByFloat adds incr to the float stored in val, a missing value counts as 0.
+func incrByFloat(val []byte, incr float64) ([]byte, error) {
+	var f float64
+	if len(val) > 0 {
+		var err error
+		if f, err = parseFloat(val); err != nil {
+			return nil, err
+		}
+	}
+	f += incr
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, ErrNaNOrInf
+	}
+	return []byte(strconv.FormatFloat(f, 'f', -1, 64)), nil
+}
+
+// handleIncrBy updates a string counter and replies with its new value.
+func handleIncrBy(req kiface.IRequest, key []byte, incr func([]byte) ([]byte, error)) {
+	db := s.db(req)
+	val, err := getString(db, key)
+	if err == nil {
+		if val, err = incr(val); err == nil {
+			err = db.Set(key, val)
+		}
+	}
+
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, val); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// handleHIncrBy updates a hash field counter and replies with its new value.
+func handleHIncrBy(req kiface.IRequest, key, field []byte, incr func([]byte) ([]byte, error)) {
+	db := s.db(req)
+	val, err := db.HGet(key, field)
+	if err == nil {
+		if val, err = incr(val); err == nil {
+			err = db.HSet(key, field, val)
+		}
+	}
+
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, val); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+type IncrRouter struct {
+	knet.BaseRouter
+}
+
+func (ir *IncrRouter) Handle(req kiface.IRequest) {
+	log.Println("handle Incr")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	handleIncrBy(req, c[0], func(val []byte) ([]byte, error) {
+		return incrBy(val, 1)
+	})
+}
+
+type DecrRouter struct {
+	knet.BaseRouter
+}
+
+func (dr *DecrRouter) Handle(req kiface.IRequest) {
+	log.Println("handle Decr")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	handleIncrBy(req, c[0], func(val []byte) ([]byte, error) {
+		return incrBy(val, -1)
+	})
+}
+
+type IncrByRouter struct {
+	knet.BaseRouter
+}
+
+func (ibr *IncrByRouter) Handle(req kiface.IRequest) {
+	log.Println("handle IncrBy")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	handleIncrBy(req, c[0], func(val []byte) ([]byte, error) {
+		n, err := parseInt(c[1])
+		if err != nil {
+			return nil, err
+		}
+		return incrBy(val, n)
+	})
+}
+
+type DecrByRouter struct {
+	knet.BaseRouter
+}
+
+func (dbr *DecrByRouter) Handle(req kiface.IRequest) {
+	log.Println("handle DecrBy")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	handleIncrBy(req, c[0], func(val []byte) ([]byte, error) {
+		n, err := parseInt(c[1])
+		if err != nil {
+			return nil, err
+		}
+		if n == math.MinInt64 {
+			return nil, ErrOverflow
+		}
+		return incrBy(val, -n)
+	})
+}
+
+type IncrByFloatRouter struct {
+	knet.BaseRouter
+}
+
+func (ibfr *IncrByFloatRouter) Handle(req kiface.IRequest) {
+	log.Println("handle IncrByFloat")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	handleIncrBy(req, c[0], func(val []byte) ([]byte, error) {
+		f, err := parseFloat(c[1])
+		if err != nil {
+			return nil, err
+		}
+		return incrByFloat(val, f)
+	})
+}
+
+type HIncrByRouter struct {
+	knet.BaseRouter
+}
+
+func (hibr *HIncrByRouter) Handle(req kiface.IRequest) {
+	log.Println("handle HIncrBy")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	handleHIncrBy(req, c[0], c[1], func(val []byte) ([]byte, error) {
+		n, err := parseInt(c[2])
+		if err != nil {
+			return nil, err
+		}
+		return incrBy(val, n)
+	})
+}
+
+type HIncrByFloatRouter struct {
+	knet.BaseRouter
+}
+
+func (hibfr *HIncrByFloatRouter) Handle(req kiface.IRequest) {
+	log.Println("handle HIncrByFloat")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	handleHIncrBy(req, c[0], c[1], func(val []byte) ([]byte, error) {
+		f, err := parseFloat(c[2])
+		if err != nil {
+			return nil, err
+		}
+		return incrByFloat(val, f)
+	})
+}
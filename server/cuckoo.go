@@ -0,0 +1,414 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"github.com/k-si/CaskDB"
+	"github.com/k-si/Kinx/kiface"
+	"github.com/k-si/Kinx/knet"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// A cuckoo filter is stored as a string: the magic, the parameters and the
+// slots of its sub filters. An item is a fingerprint held in one of two
+// buckets, the second one being the first xored with the hash of the
+// fingerprint, so that a fingerprint moves between its buckets without the
+// item. Unlike a bloom filter, items can be deleted. When an item finds no
+// room after MaxIterations moves, a sub filter of the same size is added.
+// The error rate of a sub filter is about 2 * bucket size / 2^fingerprint
+// bits, the fingerprint size is chosen from the error rate reserved.
+const (
+	cuckooDefaultCapacity   = 1024
+	cuckooDefaultBucketSize = 2
+	cuckooDefaultMaxIter    = 20
+	cuckooDefaultBits       = 8
+	cuckooSeed              = 0x1b873593
+	// encoded size of the magic and the parameters
+	cuckooHeader = 4 + 1 + 1 + 2 + 4 + 8
+)
+
+var (
+	cuckooMagic     = []byte("CUCK")
+	ErrNotCuckoo    = errors.New("WRONGTYPE Key is not a valid cuckoo filter value.")
+	ErrCuckooExists = errors.New("ERR item exists")
+	ErrBucketSize   = errors.New("ERR bucket size should be between 1 and 255")
+	ErrMaxIter      = errors.New("ERR max iterations should be between 1 and 65535")
+	ErrNoFilter     = errors.New("ERR not found")
+)
+
+type cuckoo struct {
+	bucketSize uint8
+	fpBits     uint8
+	maxIter    uint16
+	buckets    uint32 // per sub filter, a power of 2
+	count      uint64
+	// slots of all the sub filters, 0 is an empty slot
+	slots []uint32
+}
+
+// newCuckoo makes a filter, unless it takes more than maxSize bytes once
+// encoded. The size is worked out before allocating the slots.
+func newCuckoo(capacity uint64, bucketSize uint8, maxIter uint16, fpBits uint8, maxSize uint32) (*cuckoo, error) {
+	buckets := uint32(1)
+	for uint64(buckets)*uint64(bucketSize) < capacity && buckets < 1<<31 {
+		buckets <<= 1
+	}
+	cf := &cuckoo{
+		bucketSize: bucketSize,
+		fpBits:     fpBits,
+		maxIter:    maxIter,
+		buckets:    buckets,
+	}
+	if cuckooHeader+cf.filterSize() > uint64(maxSize) {
+		return nil, ErrFilterSize
+	}
+	cf.slots = make([]uint32, uint64(buckets)*uint64(bucketSize))
+	return cf, nil
+}
+
+// filterSize is the length of an encoded sub filter.
+func (cf *cuckoo) filterSize() uint64 {
+	return uint64(cf.buckets) * uint64(cf.bucketSize) * uint64(cf.width())
+}
+
+// width is the number of bytes a slot is encoded on.
+func (cf *cuckoo) width() int {
+	return int(cf.fpBits+7) / 8
+}
+
+// fingerprintBits is the fingerprint size giving errRate for bucketSize.
+func fingerprintBits(errRate float64, bucketSize uint8) uint8 {
+	bits := math.Ceil(math.Log2(2 * float64(bucketSize) / errRate))
+	return uint8(math.Max(1, math.Min(32, bits)))
+}
+
+func (cf *cuckoo) filters() int {
+	return len(cf.slots) / (int(cf.buckets) * int(cf.bucketSize))
+}
+
+// locate hashes an item into its fingerprint and its first bucket.
+func (cf *cuckoo) locate(item []byte) (uint32, uint32) {
+	h := murmurHash64A(item, cuckooSeed)
+	fp := uint32(h>>32) & (1<<cf.fpBits - 1)
+	if fp == 0 {
+		fp = 1
+	}
+	return fp, uint32(h) & (cf.buckets - 1)
+}
+
+// alt is the other bucket of a fingerprint.
+func (cf *cuckoo) alt(i, fp uint32) uint32 {
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint32(b, fp)
+	return (i ^ uint32(murmurHash64A(b, cuckooSeed))) & (cf.buckets - 1)
+}
+
+// bucket is the slots of bucket i of sub filter f.
+func (cf *cuckoo) bucket(f int, i uint32) []uint32 {
+	start := (f*int(cf.buckets) + int(i)) * int(cf.bucketSize)
+	return cf.slots[start : start+int(cf.bucketSize)]
+}
+
+// matches counts the slots holding the fingerprint of item.
+func (cf *cuckoo) matches(item []byte) int {
+	fp, i1 := cf.locate(item)
+	i2 := cf.alt(i1, fp)
+	n := 0
+	for f := 0; f < cf.filters(); f++ {
+		for _, i := range []uint32{i1, i2} {
+			for _, slot := range cf.bucket(f, i) {
+				if slot == fp {
+					n++
+				}
+			}
+			if i1 == i2 {
+				break
+			}
+		}
+	}
+	return n
+}
+
+// put stores fp in an empty slot of bucket i of sub filter f.
+func (cf *cuckoo) put(f int, i, fp uint32) bool {
+	b := cf.bucket(f, i)
+	for j := range b {
+		if b[j] == 0 {
+			b[j] = fp
+			return true
+		}
+	}
+	return false
+}
+
+// add adds an item. A new sub filter is refused when the filter would take
+// more than maxSize bytes, the filter is then left changed and must not be
+// stored.
+func (cf *cuckoo) add(item []byte, maxSize uint32) error {
+	fp, i := cf.locate(item)
+	cf.count++
+	for f := 0; f < cf.filters(); f++ {
+		if cf.put(f, i, fp) || cf.put(f, cf.alt(i, fp), fp) {
+			return nil
+		}
+	}
+	// kick fingerprints of the last sub filter to their other bucket
+	f := cf.filters() - 1
+	for n := 0; n < int(cf.maxIter); n++ {
+		b := cf.bucket(f, i)
+		j := random.Intn(len(b))
+		fp, b[j] = b[j], fp
+		i = cf.alt(i, fp)
+		if cf.put(f, i, fp) {
+			return nil
+		}
+	}
+	// the homeless fingerprint goes to a new sub filter, in the same bucket
+	if cuckooHeader+uint64(cf.filters()+1)*cf.filterSize() > uint64(maxSize) {
+		return ErrFilterSize
+	}
+	cf.slots = append(cf.slots, make([]uint32, int(cf.buckets)*int(cf.bucketSize))...)
+	cf.put(f+1, i, fp)
+	return nil
+}
+
+// del removes one occurrence of item, reporting whether it was found.
+func (cf *cuckoo) del(item []byte) bool {
+	fp, i1 := cf.locate(item)
+	i2 := cf.alt(i1, fp)
+	for f := cf.filters() - 1; f >= 0; f-- {
+		for _, i := range []uint32{i1, i2} {
+			b := cf.bucket(f, i)
+			for j := range b {
+				if b[j] == fp {
+					b[j] = 0
+					cf.count--
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// encode stores the slots on as few bytes as the fingerprints need.
+func (cf *cuckoo) encode() []byte {
+	buf := bytes.Buffer{}
+	buf.Write(cuckooMagic)
+	buf.WriteByte(cf.bucketSize)
+	buf.WriteByte(cf.fpBits)
+	_ = binary.Write(&buf, binary.BigEndian, cf.maxIter)
+	_ = binary.Write(&buf, binary.BigEndian, cf.buckets)
+	_ = binary.Write(&buf, binary.BigEndian, cf.count)
+	width := cf.width()
+	slot := make([]byte, 4)
+	for _, fp := range cf.slots {
+		binary.BigEndian.PutUint32(slot, fp)
+		buf.Write(slot[4-width:])
+	}
+	return buf.Bytes()
+}
+
+func decodeCuckoo(v []byte) (*cuckoo, error) {
+	if len(v) < cuckooHeader || !bytes.HasPrefix(v, cuckooMagic) {
+		return nil, ErrNotCuckoo
+	}
+	cf := &cuckoo{
+		bucketSize: v[4],
+		fpBits:     v[5],
+		maxIter:    binary.BigEndian.Uint16(v[6:]),
+		buckets:    binary.BigEndian.Uint32(v[8:]),
+		count:      binary.BigEndian.Uint64(v[12:]),
+	}
+	width := cf.width()
+	data := v[cuckooHeader:]
+	size := int(cf.buckets) * int(cf.bucketSize) * width
+	if cf.bucketSize == 0 || cf.fpBits == 0 || cf.fpBits > 32 || cf.buckets == 0 ||
+		cf.buckets&(cf.buckets-1) != 0 || len(data) == 0 || len(data)%size != 0 {
+		return nil, ErrNotCuckoo
+	}
+	slot := make([]byte, 4)
+	cf.slots = make([]uint32, len(data)/width)
+	for i := range cf.slots {
+		copy(slot[4-width:], data[i*width:(i+1)*width])
+		cf.slots[i] = binary.BigEndian.Uint32(slot)
+	}
+	return cf, nil
+}
+
+// loadCuckoo reads the cuckoo filter stored at key, or nil if there is none.
+func loadCuckoo(db *CaskDB.DB, key []byte) (*cuckoo, error) {
+	v, err := getString(db, key)
+	if err != nil || len(v) == 0 {
+		return nil, err
+	}
+	return decodeCuckoo(v)
+}
+
+// CFReserveRouter creates an empty cuckoo filter:
+// CF.RESERVE key capacity [BUCKETSIZE n] [MAXITERATIONS n] [ERROR rate]
+type CFReserveRouter struct {
+	knet.BaseRouter
+}
+
+func (cfrr *CFReserveRouter) Handle(req kiface.IRequest) {
+	log.Println("handle CFReserve")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	db := s.db(req)
+	capacity, err := parseCapacity(c[1])
+	bucketSize, maxIter := uint64(cuckooDefaultBucketSize), uint64(cuckooDefaultMaxIter)
+	errRate := 0.0
+	for i := 2; i < len(c) && err == nil; i += 2 {
+		if i+1 >= len(c) {
+			err = ErrSyntax
+			break
+		}
+		switch strings.ToLower(string(c[i])) {
+		case "bucketsize":
+			if bucketSize, err = strconv.ParseUint(string(c[i+1]), 10, 8); err != nil || bucketSize == 0 {
+				err = ErrBucketSize
+			}
+		case "maxiterations":
+			if maxIter, err = strconv.ParseUint(string(c[i+1]), 10, 16); err != nil || maxIter == 0 {
+				err = ErrMaxIter
+			}
+		case "error":
+			errRate, err = parseErrorRate(c[i+1])
+		default:
+			err = ErrSyntax
+		}
+	}
+	fpBits := uint8(cuckooDefaultBits)
+	if errRate > 0 {
+		fpBits = fingerprintBits(errRate, uint8(bucketSize))
+	}
+	var v []byte
+	if err == nil {
+		v, err = getString(db, c[0])
+	}
+	if err == nil && len(v) > 0 {
+		err = ErrCuckooExists
+	}
+	var cf *cuckoo
+	if err == nil {
+		cf, err = newCuckoo(capacity, uint8(bucketSize), uint16(maxIter), fpBits, s.dbCfg.MaxValueSize)
+	}
+	if err == nil {
+		err = db.Set(c[0], cf.encode())
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte("\"OK\"")); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// cfAdd serves CF.ADD and CF.ADDNX, the filter is created with the default
+// parameters when it does not exist. CF.ADDNX replies with false when the
+// item may already be in the filter.
+func cfAdd(req kiface.IRequest, nx bool) {
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	db := s.db(req)
+	cf, err := loadCuckoo(db, c[0])
+	if err == nil && cf == nil {
+		cf, err = newCuckoo(cuckooDefaultCapacity, cuckooDefaultBucketSize, cuckooDefaultMaxIter, cuckooDefaultBits, s.dbCfg.MaxValueSize)
+	}
+	added := false
+	if err == nil && (!nx || cf.matches(c[1]) == 0) {
+		if err = cf.add(c[1], s.dbCfg.MaxValueSize); err == nil {
+			added = true
+			err = db.Set(c[0], cf.encode())
+		}
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte(strconv.FormatBool(added))); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// CFAddRouter adds an item to a cuckoo filter, even if it is already there.
+type CFAddRouter struct {
+	knet.BaseRouter
+}
+
+func (cfar *CFAddRouter) Handle(req kiface.IRequest) {
+	log.Println("handle CFAdd")
+	cfAdd(req, false)
+}
+
+// CFAddNxRouter adds an item to a cuckoo filter unless it may be there.
+type CFAddNxRouter struct {
+	knet.BaseRouter
+}
+
+func (cfanr *CFAddNxRouter) Handle(req kiface.IRequest) {
+	log.Println("handle CFAddNx")
+	cfAdd(req, true)
+}
+
+// CFExistsRouter replies with whether an item may be in a cuckoo filter.
+type CFExistsRouter struct {
+	knet.BaseRouter
+}
+
+func (cfer *CFExistsRouter) Handle(req kiface.IRequest) {
+	log.Println("handle CFExists")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	cf, err := loadCuckoo(s.db(req), c[0])
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte(strconv.FormatBool(cf != nil && cf.matches(c[1]) > 0))); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// CFDelRouter removes an item added to a cuckoo filter, replying with false
+// when it was not found.
+type CFDelRouter struct {
+	knet.BaseRouter
+}
+
+func (cfdr *CFDelRouter) Handle(req kiface.IRequest) {
+	log.Println("handle CFDel")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	db := s.db(req)
+	cf, err := loadCuckoo(db, c[0])
+	if err == nil && cf == nil {
+		err = ErrNoFilter
+	}
+	deleted := false
+	if err == nil && cf.del(c[1]) {
+		deleted = true
+		err = db.Set(c[0], cf.encode())
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte(strconv.FormatBool(deleted))); err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/k-si/CaskDB"
+	"github.com/k-si/Kinx/kiface"
+	"github.com/k-si/Kinx/knet"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+var (
+	ErrInvalidDBIndex = errors.New("ERR invalid DB index")
+	ErrDBIndexRange   = errors.New("ERR DB index is out of range")
+)
+
+// db returns the database selected by the connection of req.
+func (s *Server) db(req kiface.IRequest) *CaskDB.DB {
+	return s.dbs[s.session(req.GetConnection()).db]
+}
+
+func (s *Server) dbDir(i int) string {
+	return filepath.Join(s.dbCfg.DBDir, strconv.Itoa(i))
+}
+
+// migrateDB moves the data files left in db_dir by the versions with a
+// single database to db_dir/0, where database 0 lives.
+func (s *Server) migrateDB() error {
+	infos, err := ioutil.ReadDir(s.dbCfg.DBDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var files []string
+	for _, info := range infos {
+		if !info.IsDir() {
+			files = append(files, info.Name())
+		}
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	if _, err = os.Stat(s.dbDir(0)); err == nil {
+		return fmt.Errorf("both %s and %s hold data files of database 0", s.dbCfg.DBDir, s.dbDir(0))
+	}
+	if err = os.MkdirAll(s.dbDir(0), os.ModePerm); err != nil {
+		return err
+	}
+	for _, name := range files {
+		if err = os.Rename(filepath.Join(s.dbCfg.DBDir, name), filepath.Join(s.dbDir(0), name)); err != nil {
+			return err
+		}
+	}
+	log.Printf("moved the data files of %s to %s", s.dbCfg.DBDir, s.dbDir(0))
+	return nil
+}
+
+func (s *Server) openDB(i int) (*CaskDB.DB, error) {
+	cfg := s.dbCfg
+	cfg.DBDir = s.dbDir(i)
+	if err := os.MkdirAll(cfg.DBDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return CaskDB.Open(cfg)
+}
+
+// openSys opens the store of the server state, in db_dir/sys where FLUSHDB
+// and SWAPDB do not reach.
+func (s *Server) openSys() (*CaskDB.DB, error) {
+	cfg := s.dbCfg
+	cfg.DBDir = filepath.Join(s.dbCfg.DBDir, "sys")
+	if err := os.MkdirAll(cfg.DBDir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	return CaskDB.Open(cfg)
+}
+
+// Close closes every database and the server store.
+func (s *Server) Close() {
+	for _, db := range s.dbs {
+		if err := db.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+	if s.sys != nil {
+		if err := s.sys.Close(); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// parseDBIndex parses a database index sent by the client.
+func (s *Server) parseDBIndex(b []byte) (int, error) {
+	i, err := strconv.Atoi(string(b))
+	if err != nil {
+		return 0, ErrInvalidDBIndex
+	}
+	if i < 0 || i >= len(s.dbs) {
+		return 0, ErrDBIndexRange
+	}
+	return i, nil
+}
+
+// flushDB drops all the data files of database i. The database is opened
+// again even when removing them fails, over the files left.
+func (s *Server) flushDB(i int) error {
+	if err := s.dbs[i].Close(); err != nil {
+		return err
+	}
+	return s.reopenDB(os.RemoveAll(s.dbDir(i)), i)
+}
+
+// swapDB exchanges the directories of two databases, so that the swap
+// survives a restart. When a rename fails the ones done are undone, and the
+// databases are opened again either way.
+func (s *Server) swapDB(i, j int) error {
+	if i == j {
+		return nil
+	}
+	if err := s.dbs[i].Close(); err != nil {
+		return err
+	}
+	if err := s.dbs[j].Close(); err != nil {
+		return s.reopenDB(err, i)
+	}
+
+	undo := func(from, to string) {
+		if err := os.Rename(from, to); err != nil {
+			log.Println(err)
+		}
+	}
+	tmp := s.dbDir(i) + ".swap"
+	err := os.Rename(s.dbDir(i), tmp)
+	if err == nil {
+		if err = os.Rename(s.dbDir(j), s.dbDir(i)); err != nil {
+			undo(tmp, s.dbDir(i))
+		}
+	}
+	if err == nil {
+		if err = os.Rename(tmp, s.dbDir(j)); err != nil {
+			undo(s.dbDir(i), s.dbDir(j))
+			undo(tmp, s.dbDir(i))
+		}
+	}
+	return s.reopenDB(err, i, j)
+}
+
+// reopenDB opens the closed databases again, returning err or else the
+// first error opening them.
+func (s *Server) reopenDB(err error, is ...int) error {
+	for _, i := range is {
+		db, openErr := s.openDB(i)
+		if openErr != nil {
+			if err == nil {
+				err = openErr
+			}
+			continue
+		}
+		s.dbs[i] = db
+	}
+	return err
+}
+
+type SelectRouter struct {
+	knet.BaseRouter
+}
+
+func (sr *SelectRouter) Handle(req kiface.IRequest) {
+	log.Println("handle Select")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	i, err := s.parseDBIndex(c[0])
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		s.session(req.GetConnection()).db = i
+		if err = req.GetConnection().SendMessage(200, []byte("\"OK\"")); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+type SwapDBRouter struct {
+	knet.BaseRouter
+}
+
+func (sdr *SwapDBRouter) Handle(req kiface.IRequest) {
+	log.Println("handle SwapDB")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	i, err := s.parseDBIndex(c[0])
+	if err == nil {
+		var j int
+		if j, err = s.parseDBIndex(c[1]); err == nil {
+			err = s.swapDB(i, j)
+		}
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte("\"OK\"")); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+type FlushDBRouter struct {
+	knet.BaseRouter
+}
+
+func (fdr *FlushDBRouter) Handle(req kiface.IRequest) {
+	log.Println("handle FlushDB")
+
+	err := s.flushDB(s.session(req.GetConnection()).db)
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte("\"OK\"")); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+type FlushAllRouter struct {
+	knet.BaseRouter
+}
+
+func (far *FlushAllRouter) Handle(req kiface.IRequest) {
+	log.Println("handle FlushAll")
+
+	var err error
+	for i := range s.dbs {
+		if err = s.flushDB(i); err != nil {
+			break
+		}
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte("\"OK\"")); err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"github.com/k-si/CaskDB"
+	"log"
+	"math"
+	"time"
+)
+
+const (
+	expireCycleInterval = time.Second
+	// expireCycleKeys bounds the keys a database removes per cycle, the
+	// ones left wait for the next cycle or for a read
+	expireCycleKeys = 200
+)
+
+// expireKey is the sorted set of the string keys with a ttl, scored by
+// their deadline in unix milliseconds, so that the expired ones are a range.
+// It goes with its database on FLUSHDB and SWAPDB, and the clients can not
+// reach it.
+var expireKey = []byte(internalPrefix + "expire")
+
+func nowMs() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// setExpire makes the string key expire at the unix time at in milliseconds.
+func setExpire(db *CaskDB.DB, key []byte, at int64) error {
+	return db.ZAdd(expireKey, float64(at), key)
+}
+
+// getExpire returns the deadline of key, ok is false without a ttl.
+func getExpire(db *CaskDB.DB, key []byte) (int64, bool) {
+	ok, at := db.ZScore(expireKey, key)
+	return int64(at), ok
+}
+
+// persist removes the ttl of key.
+func persist(db *CaskDB.DB, key []byte) error {
+	if !db.ZIsMember(expireKey, key) {
+		return nil
+	}
+	return db.ZRem(expireKey, key)
+}
+
+// expireIfNeeded removes key once its deadline has passed, reporting
+// whether it did.
+func expireIfNeeded(db *CaskDB.DB, key []byte) (bool, error) {
+	at, ok := getExpire(db, key)
+	if !ok || at > nowMs() {
+		return false, nil
+	}
+	if err := db.Remove(key); err != nil {
+		return false, err
+	}
+	return true, db.ZRem(expireKey, key)
+}
+
+// getString reads a string key, treating expired keys as missing.
+func getString(db *CaskDB.DB, key []byte) ([]byte, error) {
+	if ok, err := expireIfNeeded(db, key); ok || err != nil {
+		return nil, err
+	}
+	return db.Get(key)
+}
+
+// expireCycle actively removes the expired keys nobody reads anymore, only
+// reading the range of the deadlines passed.
+func (s *Server) expireCycle() {
+	for range time.Tick(expireCycleInterval) {
+		s.exec.Lock()
+		for _, db := range s.dbs {
+			res, err := db.ZScoreRange(expireKey, math.Inf(-1), float64(nowMs()))
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			// the reply alternates members and scores
+			for i := 0; i+1 < len(res) && i < 2*expireCycleKeys; i += 2 {
+				key := []byte(res[i].(string))
+				if err = db.Remove(key); err == nil {
+					err = db.ZRem(expireKey, key)
+				}
+				if err != nil {
+					log.Println(err)
+				}
+			}
+		}
+		s.exec.Unlock()
+	}
+}
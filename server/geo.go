@@ -0,0 +1,461 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/k-si/CaskDB"
+	"github.com/k-si/Kinx/kiface"
+	"github.com/k-si/Kinx/knet"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Geo members are sorted set members scored with the 52 bits geohash of
+// their position, interleaving 26 bits of latitude and 26 bits of longitude,
+// so that the positions are kept by ZAdd like any other score.
+const (
+	geoStep      = 26
+	geoLatMin    = -85.05112878
+	geoLatMax    = 85.05112878
+	geoLonMin    = -180.0
+	geoLonMax    = 180.0
+	earthRadiusM = 6372797.560856
+	geoAlphabet  = "0123456789bcdefghjkmnpqrstuvwxyz"
+)
+
+var ErrGeoUnit = errors.New("ERR unsupported unit provided. please use M, KM, FT, MI")
+
+// interleave spreads the bits of x over the even bits and y over the odd
+// bits of the result.
+func interleave(x, y uint32) uint64 {
+	spread := func(v uint32) uint64 {
+		u := uint64(v)
+		u = (u | u<<16) & 0x0000FFFF0000FFFF
+		u = (u | u<<8) & 0x00FF00FF00FF00FF
+		u = (u | u<<4) & 0x0F0F0F0F0F0F0F0F
+		u = (u | u<<2) & 0x3333333333333333
+		u = (u | u<<1) & 0x5555555555555555
+		return u
+	}
+	return spread(x) | spread(y)<<1
+}
+
+// deinterleave is the inverse of interleave.
+func deinterleave(u uint64) (uint32, uint32) {
+	squash := func(u uint64) uint32 {
+		u &= 0x5555555555555555
+		u = (u | u>>1) & 0x3333333333333333
+		u = (u | u>>2) & 0x0F0F0F0F0F0F0F0F
+		u = (u | u>>4) & 0x00FF00FF00FF00FF
+		u = (u | u>>8) & 0x0000FFFF0000FFFF
+		u = (u | u>>16) & 0x00000000FFFFFFFF
+		return uint32(u)
+	}
+	return squash(u), squash(u >> 1)
+}
+
+// geohashEncode encodes a position within the latitude range given.
+func geohashEncode(lon, lat, latMin, latMax float64) uint64 {
+	latOffset := (lat - latMin) / (latMax - latMin) * (1 << geoStep)
+	lonOffset := (lon - geoLonMin) / (geoLonMax - geoLonMin) * (1 << geoStep)
+	return interleave(uint32(latOffset), uint32(lonOffset))
+}
+
+// geohashDecode returns the center of the cell of hash.
+func geohashDecode(hash uint64) (float64, float64) {
+	latBits, lonBits := deinterleave(hash)
+	latScale, lonScale := geoLatMax-geoLatMin, geoLonMax-geoLonMin
+	latMin := geoLatMin + float64(latBits)/(1<<geoStep)*latScale
+	latMax := geoLatMin + float64(latBits+1)/(1<<geoStep)*latScale
+	lonMin := geoLonMin + float64(lonBits)/(1<<geoStep)*lonScale
+	lonMax := geoLonMin + float64(lonBits+1)/(1<<geoStep)*lonScale
+	lon := math.Max(geoLonMin, math.Min(geoLonMax, (lonMin+lonMax)/2))
+	lat := math.Max(geoLatMin, math.Min(geoLatMax, (latMin+latMax)/2))
+	return lon, lat
+}
+
+// geohashString renders a position as the standard 11 characters geohash,
+// which uses the whole latitude range.
+func geohashString(lon, lat float64) string {
+	hash := geohashEncode(lon, lat, -90, 90)
+	b := make([]byte, 11)
+	for i := range b {
+		idx := 0
+		if i < 10 {
+			idx = int(hash>>uint(52-(i+1)*5)) & 0x1f
+		}
+		b[i] = geoAlphabet[idx]
+	}
+	return string(b)
+}
+
+// geoDistance is the haversine distance in meters.
+func geoDistance(lon1, lat1, lon2, lat2 float64) float64 {
+	rad := math.Pi / 180
+	u := math.Sin((lat2 - lat1) * rad / 2)
+	v := math.Sin((lon2 - lon1) * rad / 2)
+	a := u*u + math.Cos(lat1*rad)*math.Cos(lat2*rad)*v*v
+	return 2 * earthRadiusM * math.Asin(math.Sqrt(a))
+}
+
+// geoUnit is the number of meters of a distance unit.
+func geoUnit(b []byte) (float64, error) {
+	switch strings.ToLower(string(b)) {
+	case "m":
+		return 1, nil
+	case "km":
+		return 1000, nil
+	case "ft":
+		return 0.3048, nil
+	case "mi":
+		return 1609.34, nil
+	}
+	return 0, ErrGeoUnit
+}
+
+func parseLonLat(lonArg, latArg []byte) (float64, float64, error) {
+	lon, err := strconv.ParseFloat(string(lonArg), 64)
+	if err != nil {
+		return 0, 0, ErrNotFloat
+	}
+	lat, err := strconv.ParseFloat(string(latArg), 64)
+	if err != nil {
+		return 0, 0, ErrNotFloat
+	}
+	if lon < geoLonMin || lon > geoLonMax || lat < geoLatMin || lat > geoLatMax {
+		return 0, 0, fmt.Errorf("ERR invalid longitude,latitude pair %f,%f", lon, lat)
+	}
+	return lon, lat, nil
+}
+
+func formatCoord(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func formatDistance(f float64) string {
+	return strconv.FormatFloat(f, 'f', 4, 64)
+}
+
+// geoPos returns the position of a member, reporting whether it exists.
+func geoPos(db *CaskDB.DB, key, member []byte) (float64, float64, bool) {
+	ok, score := db.ZScore(key, member)
+	if !ok {
+		return 0, 0, false
+	}
+	lon, lat := geohashDecode(uint64(score))
+	return lon, lat, true
+}
+
+// GeoAddRouter adds positions to a sorted set:
+// GEOADD key [NX|XX] [CH] longitude latitude member [longitude latitude member ...]
+type GeoAddRouter struct {
+	knet.BaseRouter
+}
+
+func (gar *GeoAddRouter) Handle(req kiface.IRequest) {
+	log.Println("handle GeoAdd")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	flags, i, err := parseZAddFlags(c[1:])
+	if err == nil && (flags.gt || flags.lt || flags.incr) {
+		err = ErrSyntax
+	}
+	triples := c[1+i:]
+	if err == nil && (len(triples) == 0 || len(triples)%3 != 0) {
+		err = ErrSyntax
+	}
+	// parse all the positions before writing anything
+	scores := make([]float64, len(triples)/3)
+	for j := 0; j < len(scores) && err == nil; j++ {
+		var lon, lat float64
+		if lon, lat, err = parseLonLat(triples[3*j], triples[3*j+1]); err == nil {
+			scores[j] = float64(geohashEncode(lon, lat, geoLatMin, geoLatMax))
+		}
+	}
+	n := 0
+	for j := 0; j < len(scores) && err == nil; j++ {
+		var result int
+		_, result, err = zAdd(s.db(req), c[0], flags, scores[j], triples[3*j+2])
+		if result == zAdded || flags.ch && result == zChanged {
+			n++
+		}
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte(strconv.Itoa(n))); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// GeoPosRouter replies with the longitude and latitude of each member.
+type GeoPosRouter struct {
+	knet.BaseRouter
+}
+
+func (gpr *GeoPosRouter) Handle(req kiface.IRequest) {
+	log.Println("handle GeoPos")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	var res [][]byte
+	for _, member := range c[1:] {
+		lon, lat, ok := geoPos(s.db(req), c[0], member)
+		if !ok {
+			res = append(res, nil)
+			continue
+		}
+		res = append(res, []byte(formatCoord(lon)+" "+formatCoord(lat)))
+	}
+	sendList(req, res)
+}
+
+// GeoHashRouter replies with the standard geohash of each member.
+type GeoHashRouter struct {
+	knet.BaseRouter
+}
+
+func (ghr *GeoHashRouter) Handle(req kiface.IRequest) {
+	log.Println("handle GeoHash")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	var res [][]byte
+	for _, member := range c[1:] {
+		lon, lat, ok := geoPos(s.db(req), c[0], member)
+		if !ok {
+			res = append(res, nil)
+			continue
+		}
+		res = append(res, []byte(geohashString(lon, lat)))
+	}
+	sendList(req, res)
+}
+
+// GeoDistRouter replies with the distance between two members, in meters
+// unless a unit is given.
+type GeoDistRouter struct {
+	knet.BaseRouter
+}
+
+func (gdr *GeoDistRouter) Handle(req kiface.IRequest) {
+	log.Println("handle GeoDist")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	unit := 1.0
+	var err error
+	if len(c) == 4 {
+		unit, err = geoUnit(c[3])
+	} else if len(c) > 4 {
+		err = ErrSyntax
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	lon1, lat1, ok1 := geoPos(s.db(req), c[0], c[1])
+	lon2, lat2, ok2 := geoPos(s.db(req), c[0], c[2])
+	res := []byte("(nil)")
+	if ok1 && ok2 {
+		res = []byte(formatDistance(geoDistance(lon1, lat1, lon2, lat2) / unit))
+	}
+	if err = req.GetConnection().SendMessage(200, res); err != nil {
+		log.Println(err)
+	}
+}
+
+// geoSearch are the arguments of GEOSEARCH.
+type geoSearch struct {
+	lon, lat      float64
+	radius        float64 // meters, zero for a box
+	width, height float64 // meters
+	unit          float64
+	desc, sorted  bool
+	count         int
+	withCoord     bool
+	withDist      bool
+	withHash      bool
+}
+
+func parseGeoSearch(db *CaskDB.DB, key []byte, c [][]byte) (geoSearch, error) {
+	gs := geoSearch{unit: 1}
+	from, by := false, false
+	var err error
+	for i := 0; i < len(c); i++ {
+		switch strings.ToLower(string(c[i])) {
+		case "frommember":
+			if from || i+1 >= len(c) {
+				return gs, ErrSyntax
+			}
+			var ok bool
+			if gs.lon, gs.lat, ok = geoPos(db, key, c[i+1]); !ok {
+				return gs, errors.New("ERR could not decode requested zset member")
+			}
+			from = true
+			i++
+		case "fromlonlat":
+			if from || i+2 >= len(c) {
+				return gs, ErrSyntax
+			}
+			if gs.lon, gs.lat, err = parseLonLat(c[i+1], c[i+2]); err != nil {
+				return gs, err
+			}
+			from = true
+			i += 2
+		case "byradius":
+			if by || i+2 >= len(c) {
+				return gs, ErrSyntax
+			}
+			if gs.radius, err = strconv.ParseFloat(string(c[i+1]), 64); err != nil || gs.radius < 0 {
+				return gs, errors.New("ERR need numeric radius")
+			}
+			if gs.unit, err = geoUnit(c[i+2]); err != nil {
+				return gs, err
+			}
+			gs.radius *= gs.unit
+			by = true
+			i += 2
+		case "bybox":
+			if by || i+3 >= len(c) {
+				return gs, ErrSyntax
+			}
+			if gs.width, err = strconv.ParseFloat(string(c[i+1]), 64); err != nil || gs.width < 0 {
+				return gs, errors.New("ERR need numeric width")
+			}
+			if gs.height, err = strconv.ParseFloat(string(c[i+2]), 64); err != nil || gs.height < 0 {
+				return gs, errors.New("ERR need numeric height")
+			}
+			if gs.unit, err = geoUnit(c[i+3]); err != nil {
+				return gs, err
+			}
+			gs.width, gs.height = gs.width*gs.unit, gs.height*gs.unit
+			by = true
+			i += 3
+		case "asc":
+			gs.sorted, gs.desc = true, false
+		case "desc":
+			gs.sorted, gs.desc = true, true
+		case "count":
+			if i+1 >= len(c) {
+				return gs, ErrSyntax
+			}
+			if gs.count, err = strconv.Atoi(string(c[i+1])); err != nil || gs.count <= 0 {
+				return gs, errors.New("ERR COUNT must be > 0")
+			}
+			i++
+			// ANY is accepted, the search visits all the members anyway
+			if i+1 < len(c) && strings.ToLower(string(c[i+1])) == "any" {
+				i++
+			}
+		case "withcoord":
+			gs.withCoord = true
+		case "withdist":
+			gs.withDist = true
+		case "withhash":
+			gs.withHash = true
+		default:
+			return gs, ErrSyntax
+		}
+	}
+	if !from {
+		return gs, errors.New("ERR exactly one of FROMMEMBER or FROMLONLAT can be specified for GEOSEARCH")
+	}
+	if !by {
+		return gs, errors.New("ERR exactly one of BYRADIUS and BYBOX can be specified for GEOSEARCH")
+	}
+	return gs, nil
+}
+
+// distance reports the distance in meters of a position to the center of
+// the search, and whether it lies within the search area.
+func (gs geoSearch) distance(lon, lat float64) (float64, bool) {
+	if gs.width == 0 && gs.height == 0 {
+		d := geoDistance(gs.lon, gs.lat, lon, lat)
+		return d, d <= gs.radius
+	}
+	// the box is measured along the meridian and along the parallel
+	if geoDistance(lon, gs.lat, lon, lat) > gs.height/2 {
+		return 0, false
+	}
+	if geoDistance(gs.lon, lat, lon, lat) > gs.width/2 {
+		return 0, false
+	}
+	return geoDistance(gs.lon, gs.lat, lon, lat), true
+}
+
+// GeoSearchRouter finds the members within a radius or a box:
+// GEOSEARCH key <FROMMEMBER member | FROMLONLAT longitude latitude>
+// <BYRADIUS radius unit | BYBOX width height unit> [ASC|DESC] [COUNT n [ANY]]
+// [WITHCOORD] [WITHDIST] [WITHHASH]
+// each match is replied on a line, followed by the options asked for.
+type GeoSearchRouter struct {
+	knet.BaseRouter
+}
+
+func (gsr *GeoSearchRouter) Handle(req kiface.IRequest) {
+	log.Println("handle GeoSearch")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	db := s.db(req)
+	gs, err := parseGeoSearch(db, c[0], c[1:])
+	var ms []zMember
+	if err == nil {
+		ms, err = zMembers(db, c[0])
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	type match struct {
+		member   []byte
+		hash     uint64
+		lon, lat float64
+		dist     float64
+	}
+	var matches []match
+	for _, m := range ms {
+		hash := uint64(m.score)
+		lon, lat := geohashDecode(hash)
+		if d, ok := gs.distance(lon, lat); ok {
+			matches = append(matches, match{m.member, hash, lon, lat, d})
+		}
+	}
+	// COUNT keeps the closest matches unless an order is given
+	if gs.sorted || gs.count > 0 {
+		sort.SliceStable(matches, func(i, j int) bool {
+			if gs.desc {
+				return matches[i].dist > matches[j].dist
+			}
+			return matches[i].dist < matches[j].dist
+		})
+	}
+	if gs.count > 0 && gs.count < len(matches) {
+		matches = matches[:gs.count]
+	}
+
+	var res [][]byte
+	for _, m := range matches {
+		line := string(m.member)
+		if gs.withDist {
+			line += " " + formatDistance(m.dist/gs.unit)
+		}
+		if gs.withHash {
+			line += " " + strconv.FormatUint(m.hash, 10)
+		}
+		if gs.withCoord {
+			line += " " + formatCoord(m.lon) + " " + formatCoord(m.lat)
+		}
+		res = append(res, []byte(line))
+	}
+	sendList(req, res)
+}
@@ -0,0 +1,84 @@
+package main
+
+// matchPattern reports whether str matches the glob-style pattern.
+// It supports '*', '?', '[...]' classes with ranges and '^' negation,
+// and '\' to escape the next character.
+func matchPattern(pattern, str string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(str); i++ {
+				if matchPattern(pattern[1:], str[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(str) == 0 {
+				return false
+			}
+			pattern, str = pattern[1:], str[1:]
+		case '[':
+			if len(str) == 0 {
+				return false
+			}
+			pattern = pattern[1:]
+			not := len(pattern) > 0 && pattern[0] == '^'
+			if not {
+				pattern = pattern[1:]
+			}
+			match := false
+			for len(pattern) > 0 && pattern[0] != ']' {
+				switch {
+				case pattern[0] == '\\' && len(pattern) > 1:
+					if pattern[1] == str[0] {
+						match = true
+					}
+					pattern = pattern[2:]
+				case len(pattern) > 2 && pattern[1] == '-' && pattern[2] != ']':
+					lo, hi := pattern[0], pattern[2]
+					if lo > hi {
+						lo, hi = hi, lo
+					}
+					if str[0] >= lo && str[0] <= hi {
+						match = true
+					}
+					pattern = pattern[3:]
+				default:
+					if pattern[0] == str[0] {
+						match = true
+					}
+					pattern = pattern[1:]
+				}
+			}
+			if not {
+				match = !match
+			}
+			if !match {
+				return false
+			}
+			// skip the closing bracket, an unterminated class ends the pattern
+			if len(pattern) > 0 {
+				pattern = pattern[1:]
+			}
+			str = str[1:]
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(str) == 0 || pattern[0] != str[0] {
+				return false
+			}
+			pattern, str = pattern[1:], str[1:]
+		}
+	}
+	return len(str) == 0
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"github.com/k-si/Kinx/kiface"
+	"github.com/k-si/Kinx/knet"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const DefaultScanCount = 10
+
+// hashPairs reads all the fields of a hash, sorted by field.
+func hashPairs(req kiface.IRequest, key []byte) ([][2][]byte, error) {
+	res, err := s.db(req).HGetAll(key)
+	if err != nil {
+		return nil, err
+	}
+	// the reply alternates fields and values
+	var pairs [][2][]byte
+	for i := 0; i+1 < len(res); i += 2 {
+		pairs = append(pairs, [2][]byte{res[i], res[i+1]})
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return string(pairs[i][0]) < string(pairs[j][0])
+	})
+	return pairs, nil
+}
+
+type HMSetRouter struct {
+	knet.BaseRouter
+}
+
+func (hmsr *HMSetRouter) Handle(req kiface.IRequest) {
+	log.Println("handle HMSet")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	if len(c)%2 != 1 {
+		if err := req.GetConnection().SendMessage(400, []byte("ERR wrong number of arguments for 'hmset' command")); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	var err error
+	for i := 1; i < len(c) && err == nil; i += 2 {
+		err = s.db(req).HSet(c[0], c[i], c[i+1])
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte("\"OK\"")); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+type HMGetRouter struct {
+	knet.BaseRouter
+}
+
+func (hmgr *HMGetRouter) Handle(req kiface.IRequest) {
+	log.Println("handle HMGet")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	var res [][]byte
+	var err error
+	for _, field := range c[1:] {
+		var v []byte
+		if v, err = s.db(req).HGet(c[0], field); err != nil {
+			break
+		}
+		if len(v) == 0 {
+			v = nil
+		}
+		res = append(res, v)
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	sendList(req, res)
+}
+
+type HKeysRouter struct {
+	knet.BaseRouter
+}
+
+func (hkr *HKeysRouter) Handle(req kiface.IRequest) {
+	log.Println("handle HKeys")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	pairs, err := hashPairs(req, c[0])
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	var res [][]byte
+	for _, p := range pairs {
+		res = append(res, p[0])
+	}
+	sendList(req, res)
+}
+
+type HValsRouter struct {
+	knet.BaseRouter
+}
+
+func (hvr *HValsRouter) Handle(req kiface.IRequest) {
+	log.Println("handle HVals")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	pairs, err := hashPairs(req, c[0])
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	var res [][]byte
+	for _, p := range pairs {
+		res = append(res, p[1])
+	}
+	sendList(req, res)
+}
+
+type HStrLenRouter struct {
+	knet.BaseRouter
+}
+
+func (hslr *HStrLenRouter) Handle(req kiface.IRequest) {
+	log.Println("handle HStrLen")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	res, err := s.db(req).HGet(c[0], c[1])
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte(strconv.Itoa(len(res)))); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+type HRandFieldRouter struct {
+	knet.BaseRouter
+}
+
+func (hrfr *HRandFieldRouter) Handle(req kiface.IRequest) {
+	log.Println("handle HRandField")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	count, withValues := 1, false
+	var err error
+	if len(c) > 1 {
+		if count, err = strconv.Atoi(string(c[1])); err != nil {
+			err = ErrNotInteger
+		}
+	}
+	if err == nil && len(c) > 2 {
+		if len(c) != 3 || strings.ToLower(string(c[2])) != "withvalues" {
+			err = ErrSyntax
+		}
+		withValues = true
+	}
+
+	var pairs [][2][]byte
+	if err == nil {
+		pairs, err = hashPairs(req, c[0])
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	// without count a single field is returned, or nil
+	if len(c) == 1 {
+		if len(pairs) == 0 {
+			if err = req.GetConnection().SendMessage(200, []byte("(nil)")); err != nil {
+				log.Println(err)
+			}
+			return
+		}
+		if err = req.GetConnection().SendMessage(200, pairs[random.Intn(len(pairs))][0]); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	// a positive count picks distinct fields, a negative one may repeat them
+	var picked [][2][]byte
+	if count >= 0 {
+		random.Shuffle(len(pairs), func(i, j int) {
+			pairs[i], pairs[j] = pairs[j], pairs[i]
+		})
+		if count > len(pairs) {
+			count = len(pairs)
+		}
+		picked = pairs[:count]
+	} else if len(pairs) > 0 {
+		for i := 0; i < -count; i++ {
+			picked = append(picked, pairs[random.Intn(len(pairs))])
+		}
+	}
+
+	var res [][]byte
+	for _, p := range picked {
+		res = append(res, p[0])
+		if withValues {
+			res = append(res, p[1])
+		}
+	}
+	sendList(req, res)
+}
+
+// parseScanArgs parses the MATCH and COUNT options of the scan commands.
+func parseScanArgs(c [][]byte) (string, int, error) {
+	pattern, count := "*", DefaultScanCount
+	for i := 0; i < len(c); i += 2 {
+		if i+1 >= len(c) {
+			return "", 0, ErrSyntax
+		}
+		switch strings.ToLower(string(c[i])) {
+		case "match":
+			pattern = string(c[i+1])
+		case "count":
+			n, err := strconv.Atoi(string(c[i+1]))
+			if err != nil || n < 1 {
+				return "", 0, ErrSyntax
+			}
+			count = n
+		default:
+			return "", 0, ErrSyntax
+		}
+	}
+	return pattern, count, nil
+}
+
+// HScanRouter iterates a hash in field order, the cursor is the hex encoded
+// last field returned so that fields present during the whole iteration are
+// returned exactly once. The cursor "0" starts and ends an iteration.
+type HScanRouter struct {
+	knet.BaseRouter
+}
+
+func (hsr *HScanRouter) Handle(req kiface.IRequest) {
+	log.Println("handle HScan")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	var after []byte
+	var err error
+	if string(c[1]) != "0" {
+		if after, err = hex.DecodeString(string(c[1])); err != nil || len(after) == 0 {
+			err = errors.New("ERR invalid cursor")
+		}
+	}
+
+	var pattern string
+	var count int
+	if err == nil {
+		pattern, count, err = parseScanArgs(c[2:])
+	}
+	var pairs [][2][]byte
+	if err == nil {
+		pairs, err = hashPairs(req, c[0])
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	i := sort.Search(len(pairs), func(i int) bool {
+		return after == nil || string(pairs[i][0]) > string(after)
+	})
+	cursor := []byte("0")
+	var res [][]byte
+	// COUNT bounds the fields visited, MATCH filters them afterwards
+	for n := 0; i < len(pairs) && n < count; i, n = i+1, n+1 {
+		if matchPattern(pattern, string(pairs[i][0])) {
+			res = append(res, pairs[i][0], pairs[i][1])
+		}
+		if i < len(pairs)-1 && n == count-1 {
+			cursor = []byte(hex.EncodeToString(pairs[i][0]))
+		}
+	}
+
+	// the next cursor comes first
+	b := strings.Builder{}
+	writeList(&b, append([][]byte{cursor}, res...))
+	if err = req.GetConnection().SendMessage(200, []byte(b.String())); err != nil {
+		log.Println(err)
+	}
+}
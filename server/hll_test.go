@@ -0,0 +1,155 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func newTestHLL(from, to int) *hll {
+	h := newHLL()
+	for i := from; i < to; i++ {
+		h.add([]byte("elem:" + strconv.Itoa(i)))
+	}
+	return h
+}
+
+// roundTrip encodes and decodes h the way PFADD and PFCOUNT do.
+func roundTrip(t *testing.T, h *hll) (*hll, byte) {
+	v := h.encode()
+	d, err := decodeHLL(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, v[len(hllMagic)]
+}
+
+func checkCount(t *testing.T, h *hll, n int) {
+	got := h.count()
+	if e := math.Abs(float64(got)-float64(n)) / float64(n); e > 0.02 {
+		t.Errorf("count of %d elements: got %d, error %.2f%%", n, got, e*100)
+	}
+}
+
+func TestHLLCount(t *testing.T) {
+	for _, n := range []int{100, 10000, 1000000} {
+		h := newTestHLL(0, n)
+		checkCount(t, h, n)
+		d, _ := roundTrip(t, h)
+		if d.count() != h.count() {
+			t.Errorf("count of %d elements: %d after decoding, %d before", n, d.count(), h.count())
+		}
+	}
+	if n := newHLL().count(); n != 0 {
+		t.Errorf("count of an empty HyperLogLog: got %d", n)
+	}
+}
+
+func TestHLLAdd(t *testing.T) {
+	h := newHLL()
+	if !h.add([]byte("a")) {
+		t.Error("first add did not change the registers")
+	}
+	if h.add([]byte("a")) {
+		t.Error("second add changed the registers")
+	}
+}
+
+func TestHLLPromotion(t *testing.T) {
+	h := newTestHLL(0, 100)
+	d, enc := roundTrip(t, h)
+	if enc != hllSparse || d.dense {
+		t.Fatalf("100 elements: got encoding %d, want sparse", enc)
+	}
+
+	// the sparse encoding holds up to hllSparseMaxBytes/3 registers
+	h = newTestHLL(0, 5000)
+	v := h.encode()
+	if v[len(hllMagic)] != hllDense || len(v) != len(hllMagic)+1+hllDenseBytes {
+		t.Fatalf("5000 elements: got encoding %d of %d bytes, want dense", v[len(hllMagic)], len(v))
+	}
+	d, err := decodeHLL(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range h.regs {
+		if d.regs[i] != h.regs[i] {
+			t.Fatalf("register %d: got %d after decoding, want %d", i, d.regs[i], h.regs[i])
+		}
+	}
+	checkCount(t, d, 5000)
+
+	// a dense value does not turn sparse again
+	if _, enc = roundTrip(t, d); enc != hllDense {
+		t.Errorf("decoded dense value encoded as %d", enc)
+	}
+}
+
+func TestHLLDenseRegisters(t *testing.T) {
+	data := make([]byte, hllDenseBytes)
+	for i := 0; i < hllRegisters; i++ {
+		setDenseRegister(data, i, uint8(i%64))
+	}
+	for i := 0; i < hllRegisters; i++ {
+		if got := denseRegister(data, i); got != uint8(i%64) {
+			t.Fatalf("register %d: got %d, want %d", i, got, i%64)
+		}
+	}
+	// overwriting a register leaves its neighbours alone
+	setDenseRegister(data, 5, 0)
+	if denseRegister(data, 4) != 4 || denseRegister(data, 5) != 0 || denseRegister(data, 6) != 6 {
+		t.Error("setDenseRegister changed the neighbour registers")
+	}
+}
+
+func TestHLLMerge(t *testing.T) {
+	// PFMERGE of a sparse and a dense HyperLogLog with overlapping elements,
+	// in both orders
+	sparse, enc := roundTrip(t, newTestHLL(0, 500))
+	if enc != hllSparse {
+		t.Fatalf("500 elements: got encoding %d, want sparse", enc)
+	}
+	dense, enc := roundTrip(t, newTestHLL(250, 20000))
+	if enc != hllDense {
+		t.Fatalf("19750 elements: got encoding %d, want dense", enc)
+	}
+
+	for _, srcs := range [][]*hll{{sparse, dense}, {dense, sparse}} {
+		h := newHLL()
+		for _, src := range srcs {
+			h.merge(src)
+		}
+		d, enc := roundTrip(t, h)
+		if enc != hllDense {
+			t.Errorf("merge: got encoding %d, want dense", enc)
+		}
+		checkCount(t, d, 20000)
+	}
+
+	// merging sparse values only stays sparse
+	h := newHLL()
+	h.merge(sparse)
+	h.merge(newTestHLL(400, 600))
+	d, enc := roundTrip(t, h)
+	if enc != hllSparse {
+		t.Errorf("merge of sparse values: got encoding %d, want sparse", enc)
+	}
+	checkCount(t, d, 600)
+}
+
+func TestDecodeHLLErrors(t *testing.T) {
+	tests := []string{
+		"foobar",
+		"HYLL",
+		"HYLL\x02",
+		"HYLL\x00\x00",
+		"HYLL\x01\x00\x01",
+		"HYLL\x01\xff\xff\x01",
+		"HYLL\x01\x00\x01\x40",
+	}
+	for _, v := range tests {
+		if _, err := decodeHLL([]byte(v)); err != ErrNotHLL {
+			t.Errorf("decode %q: got %v, want %v", v, err, ErrNotHLL)
+		}
+	}
+}
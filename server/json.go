@@ -0,0 +1,590 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/k-si/CaskDB"
+	"github.com/k-si/Kinx/kiface"
+	"github.com/k-si/Kinx/knet"
+	"io"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A json document is kept compact in an internal string key, so a field
+// change rewrites it here rather than on the client. Numbers are decoded as
+// json.Number, which keeps them as they were written.
+const jsonPrefix = internalPrefix + "json:"
+
+var (
+	ErrInvalidJSON  = errors.New("ERR invalid JSON value")
+	ErrInvalidPath  = errors.New("ERR invalid JSON path")
+	ErrNewJSONRoot  = errors.New("ERR new objects must be created at the root")
+	ErrJSONNotANum  = errors.New("ERR result is not a number")
+	ErrJSONNotFound = errors.New("ERR key does not exist")
+)
+
+func jsonKey(key []byte) []byte {
+	return []byte(jsonPrefix + string(key))
+}
+
+// decodeJSON parses a single json value.
+func decodeJSON(b []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, ErrInvalidJSON
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, ErrInvalidJSON
+	}
+	return v, nil
+}
+
+func encodeJSON(v interface{}) []byte {
+	b := bytes.Buffer{}
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	// the values were decoded from json, they always encode
+	_ = enc.Encode(v)
+	return bytes.TrimRight(b.Bytes(), "\n")
+}
+
+// loadJSON reads the document stored at key, reporting whether it exists.
+func loadJSON(db *CaskDB.DB, key []byte) (interface{}, bool, error) {
+	v, err := db.Get(jsonKey(key))
+	if err != nil || len(v) == 0 {
+		return nil, false, err
+	}
+	doc, err := decodeJSON(v)
+	return doc, err == nil, err
+}
+
+func saveJSON(db *CaskDB.DB, key []byte, doc interface{}) error {
+	return db.Set(jsonKey(key), encodeJSON(doc))
+}
+
+// delJSON removes the document stored at key, reporting whether it existed.
+func delJSON(db *CaskDB.DB, key []byte) (bool, error) {
+	v, err := db.Get(jsonKey(key))
+	if err != nil || len(v) == 0 {
+		return false, err
+	}
+	return true, db.Remove(jsonKey(key))
+}
+
+func copyJSON(srcDB *CaskDB.DB, src []byte, dstDB *CaskDB.DB, dst []byte) error {
+	v, err := srcDB.Get(jsonKey(src))
+	if err != nil || len(v) == 0 {
+		return err
+	}
+	return dstDB.Set(jsonKey(dst), v)
+}
+
+// path steps
+const (
+	stepField = iota
+	stepIndex
+	stepWildcard
+)
+
+type pathStep struct {
+	kind  int
+	field string
+	index int
+}
+
+// parseJSONPath parses a JSONPath subset: $ is the root, followed by .field,
+// ['field'], [index] with negative indexes counting from the end, and .* or
+// [*] for all the children. A path without the leading $ is relative to the
+// root, so "." and "a.b" are accepted as well.
+func parseJSONPath(p string) ([]pathStep, error) {
+	if strings.HasPrefix(p, "$") {
+		p = p[1:]
+	} else if p == "." {
+		p = ""
+	} else if !strings.HasPrefix(p, ".") && !strings.HasPrefix(p, "[") {
+		p = "." + p
+	}
+
+	var steps []pathStep
+	for len(p) > 0 {
+		switch p[0] {
+		case '.':
+			p = p[1:]
+			if strings.HasPrefix(p, "*") {
+				steps = append(steps, pathStep{kind: stepWildcard})
+				p = p[1:]
+				continue
+			}
+			n := strings.IndexAny(p, ".[")
+			if n < 0 {
+				n = len(p)
+			}
+			if n == 0 {
+				return nil, ErrInvalidPath
+			}
+			steps = append(steps, pathStep{kind: stepField, field: p[:n]})
+			p = p[n:]
+		case '[':
+			end := strings.IndexByte(p, ']')
+			if end < 0 {
+				return nil, ErrInvalidPath
+			}
+			in := p[1:end]
+			p = p[end+1:]
+			switch {
+			case in == "*":
+				steps = append(steps, pathStep{kind: stepWildcard})
+			case len(in) >= 2 && (in[0] == '\'' || in[0] == '"') && in[len(in)-1] == in[0]:
+				steps = append(steps, pathStep{kind: stepField, field: in[1 : len(in)-1]})
+			default:
+				i, err := strconv.Atoi(in)
+				if err != nil {
+					return nil, ErrInvalidPath
+				}
+				steps = append(steps, pathStep{kind: stepIndex, index: i})
+			}
+		default:
+			return nil, ErrInvalidPath
+		}
+	}
+	return steps, nil
+}
+
+// jsonLoc is where a value sits: a field of an object or an element of an
+// array. The document itself is the element of a one element array, so the
+// root is replaced like any other value.
+type jsonLoc struct {
+	object map[string]interface{}
+	array  []interface{}
+	field  string
+	index  int
+}
+
+func (l jsonLoc) get() interface{} {
+	if l.object != nil {
+		return l.object[l.field]
+	}
+	return l.array[l.index]
+}
+
+func (l jsonLoc) set(v interface{}) {
+	if l.object != nil {
+		l.object[l.field] = v
+	} else {
+		l.array[l.index] = v
+	}
+}
+
+// children finds the children of v a step leads to. When create is set, a
+// missing field of an object is returned too.
+func (step pathStep) children(v interface{}, create bool) []jsonLoc {
+	var locs []jsonLoc
+	switch v := v.(type) {
+	case map[string]interface{}:
+		switch step.kind {
+		case stepField:
+			if _, ok := v[step.field]; ok || create {
+				locs = append(locs, jsonLoc{object: v, field: step.field})
+			}
+		case stepWildcard:
+			fields := make([]string, 0, len(v))
+			for f := range v {
+				fields = append(fields, f)
+			}
+			sort.Strings(fields)
+			for _, f := range fields {
+				locs = append(locs, jsonLoc{object: v, field: f})
+			}
+		}
+	case []interface{}:
+		switch step.kind {
+		case stepIndex:
+			i := step.index
+			if i < 0 {
+				i += len(v)
+			}
+			if i >= 0 && i < len(v) {
+				locs = append(locs, jsonLoc{array: v, index: i})
+			}
+		case stepWildcard:
+			for i := range v {
+				locs = append(locs, jsonLoc{array: v, index: i})
+			}
+		}
+	}
+	return locs
+}
+
+// matchJSON finds the values of root a path leads to, creating the last
+// field when create is set.
+func matchJSON(root []interface{}, steps []pathStep, create bool) []jsonLoc {
+	locs := []jsonLoc{{array: root}}
+	for i, step := range steps {
+		var next []jsonLoc
+		for _, l := range locs {
+			next = append(next, step.children(l.get(), create && i == len(steps)-1)...)
+		}
+		locs = next
+	}
+	return locs
+}
+
+// jsonDoc loads the document of key and matches a path against it.
+func jsonDoc(db *CaskDB.DB, key []byte, path []byte) ([]interface{}, []jsonLoc, error) {
+	steps, err := parseJSONPath(string(path))
+	if err != nil {
+		return nil, nil, err
+	}
+	doc, ok, err := loadJSON(db, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ok {
+		return nil, nil, ErrJSONNotFound
+	}
+	root := []interface{}{doc}
+	return root, matchJSON(root, steps, false), nil
+}
+
+// JSONSetRouter sets the value at a path: JSON.SET key path value [NX|XX]
+// a new document is created at the root only, and a missing field is added
+// to the object holding it.
+type JSONSetRouter struct {
+	knet.BaseRouter
+}
+
+func (jsr *JSONSetRouter) Handle(req kiface.IRequest) {
+	log.Println("handle JSONSet")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	var nx, xx bool
+	var err error
+	for _, arg := range c[3:] {
+		switch strings.ToLower(string(arg)) {
+		case "nx":
+			nx = true
+		case "xx":
+			xx = true
+		default:
+			err = ErrSyntax
+		}
+	}
+	if nx && xx {
+		err = ErrSyntax
+	}
+
+	var steps []pathStep
+	var v, doc interface{}
+	exists := false
+	if err == nil {
+		steps, err = parseJSONPath(string(c[1]))
+	}
+	if err == nil {
+		v, err = decodeJSON(c[2])
+	}
+	if err == nil {
+		doc, exists, err = loadJSON(s.db(req), c[0])
+	}
+	if err == nil && !exists && len(steps) > 0 {
+		err = ErrNewJSONRoot
+	}
+
+	done := false
+	if err == nil {
+		root := []interface{}{doc}
+		var locs []jsonLoc
+		if exists {
+			locs = matchJSON(root, steps, !xx)
+		} else {
+			locs = []jsonLoc{{array: root}}
+		}
+		for _, l := range locs {
+			// an object field is missing when it is not in the object
+			found := exists
+			if l.object != nil {
+				_, found = l.object[l.field]
+			}
+			if nx && found || xx && !found {
+				continue
+			}
+			l.set(v)
+			done = true
+		}
+		if done {
+			err = saveJSON(s.db(req), c[0], root[0])
+		}
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		res := []byte("(nil)")
+		if done {
+			res = []byte("\"OK\"")
+		}
+		if err = req.GetConnection().SendMessage(200, res); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// JSONGetRouter replies with the values at paths: JSON.GET key [path ...]
+// without a path the whole document is replied, with one path the json array
+// of the values it matches, and with several an object of these arrays by
+// path.
+type JSONGetRouter struct {
+	knet.BaseRouter
+}
+
+func (jgr *JSONGetRouter) Handle(req kiface.IRequest) {
+	log.Println("handle JSONGet")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	doc, exists, err := loadJSON(s.db(req), c[0])
+	var res []byte
+	if err == nil && !exists {
+		res = []byte("(nil)")
+	} else if err == nil && len(c) == 1 {
+		res = encodeJSON(doc)
+	} else if err == nil {
+		root := []interface{}{doc}
+		byPath := make(map[string]interface{})
+		var last []interface{}
+		for _, path := range c[1:] {
+			var steps []pathStep
+			if steps, err = parseJSONPath(string(path)); err != nil {
+				break
+			}
+			last = []interface{}{}
+			for _, l := range matchJSON(root, steps, false) {
+				last = append(last, l.get())
+			}
+			byPath[string(path)] = last
+		}
+		if len(c) == 2 {
+			res = encodeJSON(last)
+		} else {
+			res = encodeJSON(byPath)
+		}
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, res); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// JSONDelRouter deletes the values at a path, the whole document by default,
+// replying with the number of values deleted.
+type JSONDelRouter struct {
+	knet.BaseRouter
+}
+
+func (jdr *JSONDelRouter) Handle(req kiface.IRequest) {
+	log.Println("handle JSONDel")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	db := s.db(req)
+	path := []byte("$")
+	if len(c) == 2 {
+		path = c[1]
+	}
+	n := 0
+	steps, err := parseJSONPath(string(path))
+	if len(c) > 2 {
+		err = ErrSyntax
+	}
+	if err == nil && len(steps) == 0 {
+		var ok bool
+		if ok, err = delJSON(db, c[0]); ok {
+			n = 1
+		}
+	} else if err == nil {
+		var doc interface{}
+		var exists bool
+		if doc, exists, err = loadJSON(db, c[0]); err == nil && exists {
+			n, err = delJSONPath(db, c[0], doc, steps)
+		}
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte(strconv.Itoa(n))); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// delJSONPath removes the values a path matches in doc and saves it.
+func delJSONPath(db *CaskDB.DB, key []byte, doc interface{}, steps []pathStep) (int, error) {
+	root := []interface{}{doc}
+	last := steps[len(steps)-1]
+	n := 0
+	for _, p := range matchJSON(root, steps[:len(steps)-1], false) {
+		locs := last.children(p.get(), false)
+		n += len(locs)
+		switch v := p.get().(type) {
+		case map[string]interface{}:
+			for _, l := range locs {
+				delete(v, l.field)
+			}
+		case []interface{}:
+			// the array is rebuilt without the elements, in its place
+			removed := make(map[int]bool)
+			for _, l := range locs {
+				removed[l.index] = true
+			}
+			kept := make([]interface{}, 0, len(v))
+			for i, e := range v {
+				if !removed[i] {
+					kept = append(kept, e)
+				}
+			}
+			p.set(kept)
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return n, saveJSON(db, key, root[0])
+}
+
+// JSONArrAppendRouter appends values to the arrays at a path:
+// JSON.ARRAPPEND key path value [value ...]
+// replying with the new length of each array, or (nil) for a value that is
+// not an array.
+type JSONArrAppendRouter struct {
+	knet.BaseRouter
+}
+
+func (jaar *JSONArrAppendRouter) Handle(req kiface.IRequest) {
+	log.Println("handle JSONArrAppend")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	var values []interface{}
+	var err error
+	for _, arg := range c[2:] {
+		var v interface{}
+		if v, err = decodeJSON(arg); err != nil {
+			break
+		}
+		values = append(values, v)
+	}
+	var root []interface{}
+	var locs []jsonLoc
+	if err == nil {
+		root, locs, err = jsonDoc(s.db(req), c[0], c[1])
+	}
+	var res [][]byte
+	for _, l := range locs {
+		if err != nil {
+			break
+		}
+		a, ok := l.get().([]interface{})
+		if !ok {
+			res = append(res, nil)
+			continue
+		}
+		a = append(a, values...)
+		l.set(a)
+		res = append(res, []byte(strconv.Itoa(len(a))))
+	}
+	if err == nil && len(locs) > 0 {
+		err = saveJSON(s.db(req), c[0], root[0])
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		sendList(req, res)
+	}
+}
+
+// addNumbers adds two json numbers, as integers when both are.
+func addNumbers(a, b json.Number) (json.Number, error) {
+	x, errX := a.Int64()
+	y, errY := b.Int64()
+	if errX == nil && errY == nil && (y >= 0 && x <= math.MaxInt64-y || y < 0 && x >= math.MinInt64-y) {
+		return json.Number(strconv.FormatInt(x+y, 10)), nil
+	}
+	f, err := a.Float64()
+	if err != nil {
+		return "", err
+	}
+	g, err := b.Float64()
+	if err != nil {
+		return "", err
+	}
+	sum := f + g
+	if math.IsInf(sum, 0) || math.IsNaN(sum) {
+		return "", ErrJSONNotANum
+	}
+	return json.Number(strconv.FormatFloat(sum, 'g', -1, 64)), nil
+}
+
+// JSONNumIncrByRouter increments the numbers at a path:
+// JSON.NUMINCRBY key path value
+// replying with the json array of the new values, null for a value that is
+// not a number.
+type JSONNumIncrByRouter struct {
+	knet.BaseRouter
+}
+
+func (jnibr *JSONNumIncrByRouter) Handle(req kiface.IRequest) {
+	log.Println("handle JSONNumIncrBy")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	incr, err := decodeJSON(c[2])
+	by, ok := incr.(json.Number)
+	if err == nil && !ok {
+		err = fmt.Errorf("ERR expected a number but found %s", c[2])
+	}
+	var root []interface{}
+	var locs []jsonLoc
+	if err == nil {
+		root, locs, err = jsonDoc(s.db(req), c[0], c[1])
+	}
+	res := []interface{}{}
+	for _, l := range locs {
+		if err != nil {
+			break
+		}
+		n, ok := l.get().(json.Number)
+		if !ok {
+			res = append(res, nil)
+			continue
+		}
+		if n, err = addNumbers(n, by); err == nil {
+			l.set(n)
+			res = append(res, n)
+		}
+	}
+	if err == nil && len(locs) > 0 {
+		err = saveJSON(s.db(req), c[0], root[0])
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, encodeJSON(res)); err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"errors"
+	"github.com/k-si/CaskDB"
+	"github.com/k-si/Kinx/kiface"
+	"github.com/k-si/Kinx/knet"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// key types, CaskDB keeps one key space per type so a key is reported with
+// the first type holding it
+const (
+	TypeNone   = "none"
+	TypeString = "string"
+	TypeHash   = "hash"
+	TypeList   = "list"
+	TypeSet    = "set"
+	TypeZSet   = "zset"
+	TypeStream = "stream"
+	TypeJSON   = "json"
+	TypeTS     = "timeseries"
+	TypeQueue  = "queue"
+)
+
+// internalPrefix starts the keys the server keeps for itself, like the ttl
+// index or the parts of the streams, no command may name one.
+const internalPrefix = "caskdb-net:"
+
+var (
+	ErrWrongType   = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+	ErrNoSuchKey   = errors.New("ERR no such key")
+	ErrReservedKey = errors.New("ERR keys starting with " + internalPrefix + " are reserved")
+)
+
+// keyType reports the type of the value stored at key, or TypeNone.
+func keyType(db *CaskDB.DB, key []byte) (string, error) {
+	v, err := getString(db, key)
+	if err != nil {
+		return TypeNone, err
+	}
+	switch {
+	case len(v) > 0:
+		return TypeString, nil
+	case db.HLen(key) > 0:
+		return TypeHash, nil
+	case db.LLen(key) > 0:
+		return TypeList, nil
+	case db.SCard(key) > 0:
+		return TypeSet, nil
+	case db.ZCard(key) > 0:
+		return TypeZSet, nil
+	}
+	if m, err := loadStream(db, key); err != nil || m != nil {
+		return TypeStream, err
+	}
+	if _, ok, err := loadJSON(db, key); err != nil || ok {
+		return TypeJSON, err
+	}
+	if m, err := loadTS(db, key); err != nil || m != nil {
+		return TypeTS, err
+	}
+	if m, err := loadQueue(db, key); err != nil || m != nil {
+		return TypeQueue, err
+	}
+	return TypeNone, nil
+}
+
+// delKey removes key whatever its type, reporting whether it existed.
+func delKey(db *CaskDB.DB, key []byte) (bool, error) {
+	found := false
+	v, err := getString(db, key)
+	if err == nil && len(v) > 0 {
+		found = true
+		if err = db.Remove(key); err == nil {
+			err = persist(db, key)
+		}
+	}
+	if err == nil && db.HLen(key) > 0 {
+		found = true
+		var res [][]byte
+		res, err = db.HGetAll(key)
+		// the reply alternates fields and values
+		for i := 0; i+1 < len(res) && err == nil; i += 2 {
+			err = db.HDel(key, res[i])
+		}
+	}
+	for err == nil && db.LLen(key) > 0 {
+		found = true
+		_, err = db.LPop(key)
+	}
+	if err == nil && db.SCard(key) > 0 {
+		found = true
+		var ms [][]byte
+		ms, err = db.SScan(key)
+		for i := 0; i < len(ms) && err == nil; i++ {
+			err = db.SRem(key, ms[i])
+		}
+	}
+	if err == nil && db.ZCard(key) > 0 {
+		found = true
+		var ms []zMember
+		if ms, err = zMembers(db, key); err == nil {
+			err = zRem(db, key, ms)
+		}
+	}
+	if err == nil {
+		var ok bool
+		ok, err = delStream(db, key)
+		found = found || ok
+	}
+	if err == nil {
+		var ok bool
+		ok, err = delJSON(db, key)
+		found = found || ok
+	}
+	if err == nil {
+		var ok bool
+		ok, err = delTS(db, key)
+		found = found || ok
+	}
+	if err == nil {
+		var ok bool
+		ok, err = delQueue(db, key)
+		found = found || ok
+	}
+	return found, err
+}
+
+// copyKey copies the value and the ttl of src in srcDB to dst in dstDB,
+// which must not exist.
+func copyKey(srcDB *CaskDB.DB, src []byte, dstDB *CaskDB.DB, dst []byte) error {
+	t, err := keyType(srcDB, src)
+	if err != nil {
+		return err
+	}
+	switch t {
+	case TypeString:
+		var v []byte
+		if v, err = getString(srcDB, src); err == nil {
+			err = dstDB.Set(dst, v)
+		}
+		if at, ok := getExpire(srcDB, src); err == nil && ok {
+			err = setExpire(dstDB, dst, at)
+		}
+	case TypeHash:
+		var res [][]byte
+		res, err = srcDB.HGetAll(src)
+		for i := 0; i+1 < len(res) && err == nil; i += 2 {
+			err = dstDB.HSet(dst, res[i], res[i+1])
+		}
+	case TypeList:
+		var elems [][]byte
+		if elems, err = listAll(srcDB, src); err == nil && len(elems) > 0 {
+			err = dstDB.RPush(dst, elems...)
+		}
+	case TypeSet:
+		var ms [][]byte
+		if ms, err = srcDB.SScan(src); err == nil && len(ms) > 0 {
+			err = dstDB.SAdd(dst, ms...)
+		}
+	case TypeZSet:
+		var ms []zMember
+		ms, err = zMembers(srcDB, src)
+		for i := 0; i < len(ms) && err == nil; i++ {
+			err = dstDB.ZAdd(dst, ms[i].score, ms[i].member)
+		}
+	case TypeStream:
+		err = copyStream(srcDB, src, dstDB, dst)
+	case TypeJSON:
+		err = copyJSON(srcDB, src, dstDB, dst)
+	case TypeTS:
+		err = copyTS(srcDB, src, dstDB, dst)
+	case TypeQueue:
+		err = copyQueue(srcDB, src, dstDB, dst)
+	}
+	return err
+}
+
+type TypeRouter struct {
+	knet.BaseRouter
+}
+
+func (tr *TypeRouter) Handle(req kiface.IRequest) {
+	log.Println("handle Type")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	t, err := keyType(s.db(req), c[0])
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte(t)); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+type ExistsRouter struct {
+	knet.BaseRouter
+}
+
+func (er *ExistsRouter) Handle(req kiface.IRequest) {
+	log.Println("handle Exists")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	// a key repeated in the arguments is counted as many times
+	n := 0
+	var err error
+	for _, key := range c {
+		var t string
+		if t, err = keyType(s.db(req), key); err != nil {
+			break
+		}
+		if t != TypeNone {
+			n++
+		}
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte(strconv.Itoa(n))); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// del serves DEL and UNLINK, replying with the number of keys removed.
+func del(req kiface.IRequest) {
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	n := 0
+	var err error
+	for _, key := range c {
+		var ok bool
+		if ok, err = delKey(s.db(req), key); err != nil {
+			break
+		}
+		if ok {
+			n++
+		}
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte(strconv.Itoa(n))); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+type DelRouter struct {
+	knet.BaseRouter
+}
+
+func (dr *DelRouter) Handle(req kiface.IRequest) {
+	log.Println("handle Del")
+	del(req)
+}
+
+// UnlinkRouter is DEL, values are not freed in the background since the
+// storage engine has no such thing.
+type UnlinkRouter struct {
+	knet.BaseRouter
+}
+
+func (ur *UnlinkRouter) Handle(req kiface.IRequest) {
+	log.Println("handle Unlink")
+	del(req)
+}
+
+// rename moves src to dst, unless nx is set and dst exists. It reports
+// whether the key was renamed.
+func rename(db *CaskDB.DB, src, dst []byte, nx bool) (bool, error) {
+	t, err := keyType(db, src)
+	if err != nil {
+		return false, err
+	}
+	if t == TypeNone {
+		return false, ErrNoSuchKey
+	}
+	if string(src) == string(dst) {
+		return !nx, nil
+	}
+	if nx {
+		if t, err = keyType(db, dst); err != nil || t != TypeNone {
+			return false, err
+		}
+	}
+	if _, err = delKey(db, dst); err != nil {
+		return false, err
+	}
+	if err = copyKey(db, src, db, dst); err != nil {
+		return false, err
+	}
+	_, err = delKey(db, src)
+	return err == nil, err
+}
+
+type RenameRouter struct {
+	knet.BaseRouter
+}
+
+func (rr *RenameRouter) Handle(req kiface.IRequest) {
+	log.Println("handle Rename")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	_, err := rename(s.db(req), c[0], c[1], false)
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte("\"OK\"")); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+type RenameNxRouter struct {
+	knet.BaseRouter
+}
+
+func (rnr *RenameNxRouter) Handle(req kiface.IRequest) {
+	log.Println("handle RenameNx")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	ok, err := rename(s.db(req), c[0], c[1], true)
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte(strconv.FormatBool(ok))); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+type CopyRouter struct {
+	knet.BaseRouter
+}
+
+func (cr *CopyRouter) Handle(req kiface.IRequest) {
+	log.Println("handle Copy")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	srcDB, dstDB := s.db(req), s.db(req)
+	replace := false
+	var err error
+	for i := 2; i < len(c) && err == nil; i++ {
+		switch strings.ToLower(string(c[i])) {
+		case "db":
+			var n int
+			if i+1 >= len(c) {
+				err = ErrSyntax
+			} else if n, err = s.parseDBIndex(c[i+1]); err == nil {
+				dstDB = s.dbs[n]
+			}
+			i++
+		case "replace":
+			replace = true
+		default:
+			err = ErrSyntax
+		}
+	}
+
+	// the destination is left alone unless REPLACE is given
+	copied := false
+	var t string
+	if err == nil {
+		t, err = keyType(srcDB, c[0])
+	}
+	if err == nil && t != TypeNone && (srcDB != dstDB || string(c[0]) != string(c[1])) {
+		if t, err = keyType(dstDB, c[1]); err == nil && (t == TypeNone || replace) {
+			if _, err = delKey(dstDB, c[1]); err == nil {
+				err = copyKey(srcDB, c[0], dstDB, c[1])
+				copied = err == nil
+			}
+		}
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte(strconv.FormatBool(copied))); err != nil {
+			log.Println(err)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"github.com/k-si/CaskDB"
+	"github.com/k-si/Kinx/kiface"
+	"github.com/k-si/Kinx/knet"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// listAll reads all the elements of a list.
+func listAll(db *CaskDB.DB, key []byte) ([][]byte, error) {
+	n := db.LLen(key)
+	if n == 0 {
+		return nil, nil
+	}
+	return db.LRange(key, 0, n-1)
+}
+
+// sendMove replies to the move commands with the moved element, or nil.
+func sendMove(req kiface.IRequest, res []byte, err error) {
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if len(res) == 0 {
+			if err = req.GetConnection().SendMessage(200, []byte("(nil)")); err != nil {
+				log.Println(err)
+			}
+		} else {
+			if err = req.GetConnection().SendMessage(200, res); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+type LMoveRouter struct {
+	knet.BaseRouter
+}
+
+func (lmr *LMoveRouter) Handle(req kiface.IRequest) {
+	log.Println("handle LMove")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	fromLeft, err := parseSide(c[2])
+	var toLeft bool
+	if err == nil {
+		toLeft, err = parseSide(c[3])
+	}
+	var res []byte
+	if err == nil {
+		res, err = s.listMove(s.session(req.GetConnection()).db, c[0], c[1], fromLeft, toLeft)
+	}
+	sendMove(req, res, err)
+}
+
+type RPopLPushRouter struct {
+	knet.BaseRouter
+}
+
+func (rplpr *RPopLPushRouter) Handle(req kiface.IRequest) {
+	log.Println("handle RPopLPush")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	res, err := s.listMove(s.session(req.GetConnection()).db, c[0], c[1], false, true)
+	sendMove(req, res, err)
+}
+
+type LTrimRouter struct {
+	knet.BaseRouter
+}
+
+func (ltr *LTrimRouter) Handle(req kiface.IRequest) {
+	log.Println("handle LTrim")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	start, err := strconv.Atoi(string(c[1]))
+	var stop int
+	if err == nil {
+		stop, err = strconv.Atoi(string(c[2]))
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(ErrNotInteger.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	// pop what lies outside of the range, or everything for an empty range,
+	// an end before the head empties the list too
+	db := s.db(req)
+	n := db.LLen(c[0])
+	head, tail := n, 0
+	if from, to, ok := normalizeRange(start, stop, n); ok && stop+n >= 0 {
+		head, tail = from, n-1-to
+	}
+	for i := 0; i < head && err == nil; i++ {
+		_, err = db.LPop(c[0])
+	}
+	for i := 0; i < tail && err == nil; i++ {
+		_, err = db.RPop(c[0])
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte("\"OK\"")); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+type LPosRouter struct {
+	knet.BaseRouter
+}
+
+func (lpr *LPosRouter) Handle(req kiface.IRequest) {
+	log.Println("handle LPos")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	rank, count, maxLen := 1, 1, 0
+	withCount := false
+	var err error
+	for i := 2; i < len(c) && err == nil; i += 2 {
+		if i+1 >= len(c) {
+			err = ErrSyntax
+			break
+		}
+		var n int
+		if n, err = strconv.Atoi(string(c[i+1])); err != nil {
+			err = ErrNotInteger
+			break
+		}
+		switch strings.ToLower(string(c[i])) {
+		case "rank":
+			if n == 0 {
+				err = errors.New("ERR RANK can't be zero: use 1 to start from the first match, 2 from the second ... or use negative to start from the end of the list")
+			}
+			rank = n
+		case "count":
+			if n < 0 {
+				err = errors.New("ERR COUNT can't be negative")
+			}
+			count, withCount = n, true
+		case "maxlen":
+			if n < 0 {
+				err = errors.New("ERR MAXLEN can't be negative")
+			}
+			maxLen = n
+		default:
+			err = ErrSyntax
+		}
+	}
+
+	var elems [][]byte
+	if err == nil {
+		elems, err = listAll(s.db(req), c[0])
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	// a negative rank scans from the tail, skipping the first matches
+	var res [][]byte
+	skip := rank - 1
+	step, i := 1, 0
+	if rank < 0 {
+		skip = -rank - 1
+		step, i = -1, len(elems)-1
+	}
+	for n := 0; i >= 0 && i < len(elems) && (maxLen == 0 || n < maxLen); i, n = i+step, n+1 {
+		if string(elems[i]) != string(c[1]) {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		res = append(res, []byte(strconv.Itoa(i)))
+		if count > 0 && len(res) == count {
+			break
+		}
+	}
+
+	if withCount {
+		sendList(req, res)
+		return
+	}
+	if len(res) == 0 {
+		if err = req.GetConnection().SendMessage(200, []byte("(nil)")); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	if err = req.GetConnection().SendMessage(200, res[0]); err != nil {
+		log.Println(err)
+	}
+}
+
+// pushX pushes to a list only when it already exists.
+func pushX(req kiface.IRequest, left bool) {
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	db := s.db(req)
+	var err error
+	if db.LLen(c[0]) > 0 {
+		if left {
+			err = db.LPush(c[0], c[1:]...)
+		} else {
+			err = db.RPush(c[0], c[1:]...)
+		}
+		if err == nil {
+			s.wakeUp(s.session(req.GetConnection()).db, c[0])
+		}
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte(strconv.Itoa(db.LLen(c[0])))); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+type LPushXRouter struct {
+	knet.BaseRouter
+}
+
+func (lpxr *LPushXRouter) Handle(req kiface.IRequest) {
+	log.Println("handle LPushX")
+	pushX(req, true)
+}
+
+type RPushXRouter struct {
+	knet.BaseRouter
+}
+
+func (rpxr *RPushXRouter) Handle(req kiface.IRequest) {
+	log.Println("handle RPushX")
+	pushX(req, false)
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/k-si/CaskDB"
+	"github.com/k-si/Kinx/kiface"
+	"github.com/k-si/Kinx/knet"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrLeaseTime = errors.New("ERR lease time is not a positive number of milliseconds or out of range")
+
+// Locks live in their own name space, each one in a string key of the
+// server store holding the json encoded lockState. The state is kept after
+// a release so that the fencing token of a lock keeps increasing: every
+// grant to a new owner gets a greater token, which the resources guarded by
+// the lock can compare to refuse the writes of a former holder. Being out of
+// the databases, the state survives DEL, FLUSHDB and SWAPDB.
+const lockPrefix = internalPrefix + "lock:"
+
+// lockKey is the key of a lock of database dbIndex in the server store, the
+// connections waiting for the lock block on it.
+func lockKey(dbIndex int, name []byte) []byte {
+	return []byte(lockPrefix + strconv.Itoa(dbIndex) + ":" + string(name))
+}
+
+// lockState is the holder of a lock, Owner is empty when it is free. The
+// lease ends at Expires, in unix milliseconds.
+type lockState struct {
+	Owner   string `json:"owner"`
+	Expires int64  `json:"expires"`
+	Fencing uint64 `json:"fencing"`
+}
+
+func (l *lockState) held(now int64) bool {
+	return l.Owner != "" && l.Expires > now
+}
+
+func loadLock(dbIndex int, name []byte) (*lockState, error) {
+	l := &lockState{}
+	v, err := s.sys.Get(lockKey(dbIndex, name))
+	if err != nil || len(v) == 0 {
+		return l, err
+	}
+	return l, json.Unmarshal(v, l)
+}
+
+func saveLock(dbIndex int, name []byte, l *lockState) error {
+	v, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return s.sys.Set(lockKey(dbIndex, name), v)
+}
+
+// newToken makes a random token, for the lock owners and the queue receipts.
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// acquireLock grants the lock to owner for ttl, replying with the owner
+// token and the fencing token, or nil when someone else holds it. The
+// holder acquiring again extends its lease and keeps its fencing token.
+func acquireLock(dbIndex int, name []byte, owner string, ttl int64) ([]byte, error) {
+	l, err := loadLock(dbIndex, name)
+	if err != nil {
+		return nil, err
+	}
+	now := nowMs()
+	if l.held(now) && l.Owner != owner {
+		return nil, nil
+	}
+	if !l.held(now) {
+		l.Fencing++
+	}
+	l.Owner, l.Expires = owner, now+ttl
+	if err = saveLock(dbIndex, name, l); err != nil {
+		return nil, err
+	}
+	sb := strings.Builder{}
+	writeList(&sb, [][]byte{[]byte(owner), []byte(strconv.FormatUint(l.Fencing, 10))})
+	return []byte(sb.String()), nil
+}
+
+// grantLock serves the connection waiting for the longest time on a lock,
+// once the lock is released or its lease is over. While the lock is held,
+// it checks again when the lease ends. s.exec must be held.
+func (s *Server) grantLock(dbIndex int, name []byte) {
+	key := lockKey(dbIndex, name)
+	l, err := loadLock(dbIndex, name)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if now := nowMs(); l.held(now) {
+		s.mu.Lock()
+		waiting := len(s.blocked[blockKey{db: dbIndex, key: string(key)}]) > 0
+		s.mu.Unlock()
+		if waiting {
+			s.leaseTimer(dbIndex, name, time.Duration(l.Expires-now)*time.Millisecond)
+		}
+		return
+	}
+	w := s.nextWaiter(dbIndex, key)
+	if w == nil {
+		return
+	}
+	res, err := w.serve(s.dbs[dbIndex], key)
+	if err != nil {
+		if err = w.conn.SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = w.conn.SendMessage(200, res); err != nil {
+			log.Println(err)
+		}
+	}
+	// the new holder may let its lease end with others waiting
+	s.grantLock(dbIndex, name)
+}
+
+// leaseTimer makes grantLock run again for a lock in d. A lock has a single
+// timer, reset by each call. s.exec must be held.
+func (s *Server) leaseTimer(dbIndex int, name []byte, d time.Duration) {
+	bk := blockKey{db: dbIndex, key: string(name)}
+	if t := s.leases[bk]; t != nil {
+		t.Reset(d)
+		return
+	}
+	var t *time.Timer
+	t = time.AfterFunc(d, func() {
+		s.exec.Lock()
+		defer s.exec.Unlock()
+		// drops a reset made while waiting for s.exec, grantLock sets the
+		// timer again if the lock is still held
+		t.Stop()
+		if s.leases[bk] == t {
+			delete(s.leases, bk)
+		}
+		s.grantLock(dbIndex, name)
+	})
+	s.leases[bk] = t
+}
+
+// LockRouter serves the lock commands:
+// LOCK ACQUIRE name ttl [TOKEN token] [WAIT ms]
+// LOCK RENEW name token ttl
+// LOCK RELEASE name token
+// ACQUIRE replies with the owner token, generated unless given, and the
+// fencing token, or (nil) when the lock is held. With WAIT it waits for the
+// lock to be free, forever for WAIT 0. RENEW and RELEASE reply with false
+// when the token does not hold the lock. The times are in milliseconds.
+type LockRouter struct {
+	knet.BaseRouter
+}
+
+func (lr *LockRouter) Handle(req kiface.IRequest) {
+	log.Println("handle Lock")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	dbIndex := s.session(req.GetConnection()).db
+	var res []byte
+	var err error
+	switch sub := strings.ToLower(string(c[0])); sub {
+	case "acquire":
+		lockAcquire(req, c[1:])
+		return
+	case "renew", "release":
+		var ttl int64
+		if sub == "renew" && len(c) != 4 || sub == "release" && len(c) != 3 {
+			err = fmt.Errorf("ERR wrong number of arguments for 'lock|%s' command", sub)
+		} else if sub == "renew" {
+			ttl, err = parseLease(c[3])
+		}
+		var l *lockState
+		if err == nil {
+			l, err = loadLock(dbIndex, c[1])
+		}
+		ok := false
+		if err == nil && l.held(nowMs()) && l.Owner == string(c[2]) {
+			ok = true
+			if sub == "renew" {
+				l.Expires = nowMs() + ttl
+			} else {
+				l.Owner, l.Expires = "", 0
+			}
+			err = saveLock(dbIndex, c[1], l)
+		}
+		if err == nil && ok && sub == "release" {
+			s.grantLock(dbIndex, c[1])
+		}
+		res = []byte(strconv.FormatBool(ok))
+	default:
+		err = fmt.Errorf("ERR unknown subcommand '%s'", c[0])
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, res); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func parseLease(b []byte) (int64, error) {
+	ttl, err := strconv.ParseInt(string(b), 10, 64)
+	// the lease must fit in the duration of the lease timer
+	if _, ok := msDuration(ttl); err != nil || ttl <= 0 || !ok {
+		return 0, ErrLeaseTime
+	}
+	return ttl, nil
+}
+
+// lockAcquire serves LOCK ACQUIRE name ttl [TOKEN token] [WAIT ms].
+func lockAcquire(req kiface.IRequest, c [][]byte) {
+	var ttl int64
+	err := fmt.Errorf("ERR wrong number of arguments for 'lock|acquire' command")
+	if len(c) >= 2 {
+		ttl, err = parseLease(c[1])
+	}
+	owner := ""
+	var wait time.Duration
+	blocking := false
+	for i := 2; i < len(c) && err == nil; i += 2 {
+		if i+1 >= len(c) {
+			err = ErrSyntax
+			break
+		}
+		switch strings.ToLower(string(c[i])) {
+		case "token":
+			owner = string(c[i+1])
+		case "wait":
+			var ms int64
+			var ok bool
+			if ms, err = strconv.ParseInt(string(c[i+1]), 10, 64); err != nil || ms < 0 {
+				err = ErrTimeout
+			} else if wait, ok = msDuration(ms); !ok {
+				err = ErrTimeoutRange
+			}
+			blocking = true
+		default:
+			err = ErrSyntax
+		}
+	}
+	if err == nil && owner == "" {
+		owner, err = newToken()
+	}
+	dbIndex := s.session(req.GetConnection()).db
+	var res []byte
+	if err == nil {
+		res, err = acquireLock(dbIndex, c[0], owner, ttl)
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	if res == nil && blocking {
+		name := c[0]
+		s.block(&waiter{
+			conn: req.GetConnection(),
+			db:   dbIndex,
+			keys: [][]byte{lockKey(dbIndex, name)},
+			serve: func(db *CaskDB.DB, key []byte) ([]byte, error) {
+				return acquireLock(dbIndex, name, owner, ttl)
+			},
+		}, wait)
+		s.grantLock(dbIndex, name)
+		return
+	}
+	if res == nil {
+		res = []byte("(nil)")
+	}
+	if err = req.GetConnection().SendMessage(200, res); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,570 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/k-si/CaskDB"
+	"github.com/k-si/Kinx/kiface"
+	"github.com/k-si/Kinx/knet"
+	"log"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrQueueExists    = errors.New("ERR queue already exists")
+	ErrNoQueue        = errors.New("ERR no such queue")
+	ErrVisibility     = errors.New("ERR visibility timeout should be a positive number of milliseconds")
+	ErrMaxAttempts    = errors.New("ERR max attempts should be a positive integer")
+	ErrDeadLetterSelf = errors.New("ERR a queue can not be its own dead letter queue")
+	ErrReceipt        = errors.New("ERR invalid receipt")
+)
+
+// A queue is kept in four internal keys: a list of the ids of the ready
+// messages in delivery order, a hash of the json encoded queueMessage by id,
+// a sorted set of the ids of the leased messages scored with the end of
+// their lease, and a string holding the json encoded queueMeta. The meta key
+// exists for as long as the queue does, even when it has no messages.
+//
+// A pop leases the messages for the visibility timeout, an ack deletes them
+// and a nack, or the end of the lease, gives them back to the queue. Every
+// lease comes with a new receipt, which the ack or the nack has to give, so
+// that a consumer whose lease ended can not settle the message once it is
+// leased to another. A
+// message delivered MaxAttempts times goes to the dead letter queue instead,
+// or is dropped when there is none. Leases are collected lazily, by the
+// commands using the queue.
+const (
+	queuePrefix       = internalPrefix + "queue:"
+	queueMsgPrefix    = internalPrefix + "queue-msg:"
+	queueLeasedPrefix = internalPrefix + "queue-leased:"
+	queueMetaPrefix   = internalPrefix + "queue-meta:"
+
+	queueDefaultVisibility = 30000
+)
+
+func queueKey(key []byte) []byte {
+	return []byte(queuePrefix + string(key))
+}
+
+func queueMsgKey(key []byte) []byte {
+	return []byte(queueMsgPrefix + string(key))
+}
+
+func queueLeasedKey(key []byte) []byte {
+	return []byte(queueLeasedPrefix + string(key))
+}
+
+func queueMetaKey(key []byte) []byte {
+	return []byte(queueMetaPrefix + string(key))
+}
+
+// queueMeta is the configuration and the counters of a queue, a zero
+// MaxAttempts retries messages forever.
+type queueMeta struct {
+	NextID       uint64 `json:"next_id"`
+	Visibility   int64  `json:"visibility"`
+	MaxAttempts  int    `json:"max_attempts"`
+	DeadLetter   string `json:"dead_letter,omitempty"`
+	Pushed       uint64 `json:"pushed"`
+	Acked        uint64 `json:"acked"`
+	Nacked       uint64 `json:"nacked"`
+	Expired      uint64 `json:"expired"`
+	DeadLettered uint64 `json:"dead_lettered"`
+}
+
+type queueMessage struct {
+	Body     string `json:"body"`
+	Attempts int    `json:"attempts"`
+	Receipt  string `json:"receipt,omitempty"` // token of the last lease
+}
+
+// receipt identifies a lease as the message id and the token of the lease.
+func receipt(id []byte, token string) []byte {
+	return []byte(string(id) + ":" + token)
+}
+
+func parseReceipt(b []byte) ([]byte, string, error) {
+	i := strings.IndexByte(string(b), ':')
+	if i <= 0 || i == len(b)-1 {
+		return nil, "", ErrReceipt
+	}
+	return b[:i], string(b[i+1:]), nil
+}
+
+// loadQueue reads the meta of a queue, or nil if it does not exist.
+func loadQueue(db *CaskDB.DB, key []byte) (*queueMeta, error) {
+	v, err := db.Get(queueMetaKey(key))
+	if err != nil || len(v) == 0 {
+		return nil, err
+	}
+	m := &queueMeta{}
+	if err = json.Unmarshal(v, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func saveQueue(db *CaskDB.DB, key []byte, m *queueMeta) error {
+	v, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return db.Set(queueMetaKey(key), v)
+}
+
+func loadMessage(db *CaskDB.DB, key, id []byte) (*queueMessage, error) {
+	v, err := db.HGet(queueMsgKey(key), id)
+	if err != nil || len(v) == 0 {
+		return nil, err
+	}
+	msg := &queueMessage{}
+	return msg, json.Unmarshal(v, msg)
+}
+
+func saveMessage(db *CaskDB.DB, key, id []byte, msg *queueMessage) error {
+	v, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return db.HSet(queueMsgKey(key), id, v)
+}
+
+// pushMessage appends a message to the ready ones, returning its id.
+func pushMessage(db *CaskDB.DB, key []byte, m *queueMeta, body string) ([]byte, error) {
+	m.NextID++
+	m.Pushed++
+	id := []byte(strconv.FormatUint(m.NextID, 10))
+	if err := saveMessage(db, key, id, &queueMessage{Body: body}); err != nil {
+		return nil, err
+	}
+	return id, db.RPush(queueKey(key), id)
+}
+
+// giveBack ends the lease of a message, it returns to the head of the queue
+// when its lease ended and to the tail when it was nacked, unless it was
+// delivered too many times.
+func giveBack(db *CaskDB.DB, key []byte, m *queueMeta, id []byte, head bool) error {
+	if err := db.ZRem(queueLeasedKey(key), id); err != nil {
+		return err
+	}
+	msg, err := loadMessage(db, key, id)
+	if err != nil || msg == nil {
+		return err
+	}
+	if m.MaxAttempts == 0 || msg.Attempts < m.MaxAttempts {
+		if head {
+			return db.LPush(queueKey(key), id)
+		}
+		return db.RPush(queueKey(key), id)
+	}
+
+	m.DeadLettered++
+	if err = db.HDel(queueMsgKey(key), id); err != nil || m.DeadLetter == "" {
+		return err
+	}
+	dlq := []byte(m.DeadLetter)
+	dm, err := loadQueue(db, dlq)
+	if err != nil {
+		return err
+	}
+	if dm == nil {
+		dm = &queueMeta{Visibility: queueDefaultVisibility}
+	}
+	if _, err = pushMessage(db, dlq, dm, msg.Body); err != nil {
+		return err
+	}
+	return saveQueue(db, dlq, dm)
+}
+
+// reclaim gives back the messages whose lease ended.
+func reclaim(db *CaskDB.DB, key []byte, m *queueMeta) error {
+	res, err := db.ZScoreRange(queueLeasedKey(key), 0, float64(nowMs()))
+	if err != nil {
+		return err
+	}
+	var ms []zMember
+	// the reply alternates members and scores
+	for i := 0; i+1 < len(res); i += 2 {
+		ms = append(ms, zMember{member: []byte(res[i].(string)), score: res[i+1].(float64)})
+	}
+	// the oldest lease ends up at the head
+	zSortMembers(ms)
+	for i := len(ms) - 1; i >= 0; i-- {
+		m.Expired++
+		if err = giveBack(db, key, m, ms[i].member, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// openQueue loads a queue and collects its ended leases.
+func openQueue(db *CaskDB.DB, key []byte) (*queueMeta, error) {
+	m, err := loadQueue(db, key)
+	if err != nil || m == nil {
+		return nil, err
+	}
+	return m, reclaim(db, key, m)
+}
+
+// delQueue removes a queue and its messages, reporting whether it existed.
+func delQueue(db *CaskDB.DB, key []byte) (bool, error) {
+	m, err := loadQueue(db, key)
+	if err != nil || m == nil {
+		return false, err
+	}
+	for err == nil && db.LLen(queueKey(key)) > 0 {
+		_, err = db.LPop(queueKey(key))
+	}
+	var res [][]byte
+	if err == nil {
+		res, err = db.HGetAll(queueMsgKey(key))
+	}
+	// the reply alternates fields and values
+	for i := 0; i+1 < len(res) && err == nil; i += 2 {
+		err = db.HDel(queueMsgKey(key), res[i])
+	}
+	var ms []zMember
+	if err == nil {
+		ms, err = zMembers(db, queueLeasedKey(key))
+	}
+	if err == nil {
+		err = zRem(db, queueLeasedKey(key), ms)
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, db.Remove(queueMetaKey(key))
+}
+
+// copyQueue copies the messages, the leases and the meta of a queue.
+func copyQueue(srcDB *CaskDB.DB, src []byte, dstDB *CaskDB.DB, dst []byte) error {
+	m, err := loadQueue(srcDB, src)
+	if err != nil || m == nil {
+		return err
+	}
+	ids, err := listAll(srcDB, queueKey(src))
+	if err == nil && len(ids) > 0 {
+		err = dstDB.RPush(queueKey(dst), ids...)
+	}
+	var res [][]byte
+	if err == nil {
+		res, err = srcDB.HGetAll(queueMsgKey(src))
+	}
+	for i := 0; i+1 < len(res) && err == nil; i += 2 {
+		err = dstDB.HSet(queueMsgKey(dst), res[i], res[i+1])
+	}
+	var ms []zMember
+	if err == nil {
+		ms, err = zMembers(srcDB, queueLeasedKey(src))
+	}
+	for i := 0; i < len(ms) && err == nil; i++ {
+		err = dstDB.ZAdd(queueLeasedKey(dst), ms[i].score, ms[i].member)
+	}
+	if err != nil {
+		return err
+	}
+	return saveQueue(dstDB, dst, m)
+}
+
+func parseVisibility(b []byte) (int64, error) {
+	ms, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil || ms <= 0 {
+		return 0, ErrVisibility
+	}
+	return ms, nil
+}
+
+// QCreateRouter creates an empty queue:
+// Q.CREATE key [VISIBILITY ms] [MAXATTEMPTS n] [DEADLETTER queue]
+// Q.PUSH creates a queue with a visibility timeout of 30 seconds, no
+// attempts limit and no dead letter queue.
+type QCreateRouter struct {
+	knet.BaseRouter
+}
+
+// keys are the queue and its dead letter queue, which receives messages.
+func (qcr *QCreateRouter) keys(args [][]byte) [][]byte {
+	keys := args[:1]
+	for i := 1; i+1 < len(args); i += 2 {
+		if strings.ToLower(string(args[i])) == "deadletter" {
+			keys = append(keys[:1:1], args[i+1])
+		}
+	}
+	return keys
+}
+
+func (qcr *QCreateRouter) Handle(req kiface.IRequest) {
+	log.Println("handle QCreate")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	db := s.db(req)
+	m := &queueMeta{Visibility: queueDefaultVisibility}
+	var err error
+	for i := 1; i < len(c) && err == nil; i += 2 {
+		if i+1 >= len(c) {
+			err = ErrSyntax
+			break
+		}
+		switch strings.ToLower(string(c[i])) {
+		case "visibility":
+			m.Visibility, err = parseVisibility(c[i+1])
+		case "maxattempts":
+			if m.MaxAttempts, err = strconv.Atoi(string(c[i+1])); err != nil || m.MaxAttempts <= 0 {
+				err = ErrMaxAttempts
+			}
+		case "deadletter":
+			m.DeadLetter = string(c[i+1])
+		default:
+			err = ErrSyntax
+		}
+	}
+	if err == nil && m.DeadLetter == string(c[0]) {
+		err = ErrDeadLetterSelf
+	}
+	// the dead letter queue is created with the first message it gets, its
+	// type is checked with the one of the queue
+	var old *queueMeta
+	if err == nil {
+		old, err = loadQueue(db, c[0])
+	}
+	if err == nil && old != nil {
+		err = ErrQueueExists
+	}
+	// collecting the ended leases is housekeeping, like removing an expired
+	// key on GET, so the command stays a read
+	if err == nil {
+		err = saveQueue(db, c[0], m)
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte("\"OK\"")); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// QPushRouter appends messages to a queue, replying with their ids:
+// Q.PUSH key message [message ...]
+type QPushRouter struct {
+	knet.BaseRouter
+}
+
+func (qpr *QPushRouter) Handle(req kiface.IRequest) {
+	log.Println("handle QPush")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	db := s.db(req)
+	m, err := openQueue(db, c[0])
+	if err == nil && m == nil {
+		m = &queueMeta{Visibility: queueDefaultVisibility}
+	}
+	var ids [][]byte
+	for i := 1; i < len(c) && err == nil; i++ {
+		var id []byte
+		if id, err = pushMessage(db, c[0], m, string(c[i])); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	// collecting the ended leases is housekeeping, like removing an expired
+	// key on GET, so the command stays a read
+	if err == nil {
+		err = saveQueue(db, c[0], m)
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		sendList(req, ids)
+	}
+}
+
+// QPopRouter leases messages from the head of a queue:
+// Q.POP key [COUNT n] [VISIBILITY ms]
+// one "id receipt attempts message" per line, attempts counting this
+// delivery. The messages come back to the queue unless acked with their
+// receipt before the visibility timeout of the queue, or the one given.
+type QPopRouter struct {
+	knet.BaseRouter
+}
+
+func (qpr *QPopRouter) Handle(req kiface.IRequest) {
+	log.Println("handle QPop")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	db := s.db(req)
+	count := 1
+	var visibility int64
+	var err error
+	for i := 1; i < len(c) && err == nil; i += 2 {
+		if i+1 >= len(c) {
+			err = ErrSyntax
+			break
+		}
+		switch strings.ToLower(string(c[i])) {
+		case "count":
+			if count, err = strconv.Atoi(string(c[i+1])); err != nil || count <= 0 {
+				err = ErrNotInteger
+			}
+		case "visibility":
+			visibility, err = parseVisibility(c[i+1])
+		default:
+			err = ErrSyntax
+		}
+	}
+	var m *queueMeta
+	if err == nil {
+		m, err = openQueue(db, c[0])
+	}
+	var res [][]byte
+	if err == nil && m != nil {
+		if visibility == 0 {
+			visibility = m.Visibility
+		}
+		deadline := float64(nowMs() + visibility)
+		for len(res) < count && db.LLen(queueKey(c[0])) > 0 && err == nil {
+			var id []byte
+			var msg *queueMessage
+			if id, err = db.LPop(queueKey(c[0])); err != nil {
+				break
+			}
+			if msg, err = loadMessage(db, c[0], id); err != nil || msg == nil {
+				continue
+			}
+			msg.Attempts++
+			if msg.Receipt, err = newToken(); err != nil {
+				break
+			}
+			if err = saveMessage(db, c[0], id, msg); err == nil {
+				err = db.ZAdd(queueLeasedKey(c[0]), deadline, id)
+			}
+			res = append(res, []byte(string(id)+" "+string(receipt(id, msg.Receipt))+" "+strconv.Itoa(msg.Attempts)+" "+msg.Body))
+		}
+		if err == nil {
+			err = saveQueue(db, c[0], m)
+		}
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		sendList(req, res)
+	}
+}
+
+// queueAck serves Q.ACK and Q.NACK, replying with the number of receipts
+// of messages still leased under them.
+func queueAck(req kiface.IRequest, ack bool) {
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	db := s.db(req)
+	m, err := openQueue(db, c[0])
+	n := 0
+	for i := 1; i < len(c) && err == nil && m != nil; i++ {
+		var id []byte
+		var token string
+		if id, token, err = parseReceipt(c[i]); err != nil {
+			break
+		}
+		if ok, _ := db.ZScore(queueLeasedKey(c[0]), id); !ok {
+			continue
+		}
+		var msg *queueMessage
+		if msg, err = loadMessage(db, c[0], id); err != nil || msg == nil || msg.Receipt != token {
+			continue
+		}
+		n++
+		if ack {
+			m.Acked++
+			if err = db.ZRem(queueLeasedKey(c[0]), id); err == nil {
+				err = db.HDel(queueMsgKey(c[0]), id)
+			}
+		} else {
+			m.Nacked++
+			err = giveBack(db, c[0], m, id, false)
+		}
+	}
+	if err == nil && m != nil {
+		err = saveQueue(db, c[0], m)
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte(strconv.Itoa(n))); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// QAckRouter deletes leased messages: Q.ACK key receipt [receipt ...]
+type QAckRouter struct {
+	knet.BaseRouter
+}
+
+func (qar *QAckRouter) Handle(req kiface.IRequest) {
+	log.Println("handle QAck")
+	queueAck(req, true)
+}
+
+// QNackRouter gives leased messages back to the tail of the queue, or to
+// the dead letter queue: Q.NACK key receipt [receipt ...]
+type QNackRouter struct {
+	knet.BaseRouter
+}
+
+func (qnr *QNackRouter) Handle(req kiface.IRequest) {
+	log.Println("handle QNack")
+	queueAck(req, false)
+}
+
+// QStatsRouter replies with the messages ready and leased, the counters and
+// the configuration of a queue.
+type QStatsRouter struct {
+	knet.BaseRouter
+}
+
+func (qsr *QStatsRouter) Handle(req kiface.IRequest) {
+	log.Println("handle QStats")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	db := s.db(req)
+	m, err := openQueue(db, c[0])
+	if err == nil && m == nil {
+		err = ErrNoQueue
+	}
+	// collecting the ended leases is housekeeping, like removing an expired
+	// key on GET, so the command stays a read
+	if err == nil {
+		err = saveQueue(db, c[0], m)
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	stat := func(name string, v uint64) []byte {
+		return []byte(name + " " + strconv.FormatUint(v, 10))
+	}
+	sendList(req, [][]byte{
+		stat("ready", uint64(db.LLen(queueKey(c[0])))),
+		stat("leased", uint64(db.ZCard(queueLeasedKey(c[0])))),
+		stat("pushed", m.Pushed),
+		stat("acked", m.Acked),
+		stat("nacked", m.Nacked),
+		stat("expired", m.Expired),
+		stat("deadLettered", m.DeadLettered),
+		stat("visibility", uint64(m.Visibility)),
+		stat("maxAttempts", uint64(m.MaxAttempts)),
+		[]byte("deadLetter " + m.DeadLetter),
+	})
+}
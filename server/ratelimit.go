@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"github.com/k-si/Kinx/kiface"
+	"github.com/k-si/Kinx/knet"
+	"log"
+	"math"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrRateLimit      = errors.New("ERR count and period should be positive integers, burst and quantity non negative ones")
+	ErrRateLimitRange = errors.New("ERR rate limit is out of range")
+)
+
+// RateLimitRouter checks and consumes the quota of a bucket with the
+// generic cell rate algorithm: RATELIMIT key max_burst count period [quantity]
+// allows count requests per period seconds, with bursts of up to max_burst
+// more. The bucket is a string key holding its theoretical arrival time in
+// unix nanoseconds, which expires once the bucket is full again. The reply
+// gives whether the requests are allowed, the limit, the remaining quota,
+// and in milliseconds the time to wait before retrying, -1 when allowed or
+// when the quantity is over the limit, and the time for the bucket to be
+// full again.
+type RateLimitRouter struct {
+	knet.BaseRouter
+}
+
+func (rlr *RateLimitRouter) Handle(req kiface.IRequest) {
+	log.Println("handle RateLimit")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	var args [4]int64
+	args[3] = 1
+	var err error
+	if len(c) > 5 {
+		err = ErrSyntax
+	}
+	for i := 1; i < len(c) && err == nil; i++ {
+		args[i-1], err = strconv.ParseInt(string(c[i]), 10, 64)
+		if err != nil || args[i-1] < 0 || (i == 2 || i == 3) && args[i-1] == 0 {
+			err = ErrRateLimit
+		}
+	}
+	// a request is let through every emission, up to limit of them at once,
+	// the times are refused when they overflow
+	limit, quantity := args[0]+1, args[3]
+	var emission, tolerance, cost int64
+	if err == nil {
+		if args[0] == math.MaxInt64 || mulOverflows(args[2], int64(time.Second)) {
+			err = ErrRateLimitRange
+		} else if emission = args[2] * int64(time.Second) / args[1]; emission <= 0 {
+			err = ErrRateLimit
+		} else if mulOverflows(emission, limit) || mulOverflows(emission, quantity) {
+			err = ErrRateLimitRange
+		} else {
+			tolerance, cost = emission*limit, emission*quantity
+		}
+	}
+	var v []byte
+	if err == nil {
+		v, err = getString(s.db(req), c[0])
+	}
+	var tat int64
+	if err == nil && len(v) > 0 {
+		if tat, err = strconv.ParseInt(string(v), 10, 64); err != nil {
+			err = ErrNotInteger
+		}
+	}
+	now := time.Now().UnixNano()
+	if tat < now {
+		tat = now
+	}
+	// leaves room to round the deadline up to the millisecond
+	if err == nil && tat > math.MaxInt64-int64(time.Millisecond)-cost {
+		err = ErrRateLimitRange
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	newTat := tat + cost
+	allowed := newTat-tolerance <= now
+	retryAfter := int64(-1)
+	if allowed {
+		tat = newTat
+		db := s.db(req)
+		if err = db.Set(c[0], []byte(strconv.FormatInt(tat, 10))); err == nil {
+			err = setExpire(db, c[0], (tat+int64(time.Millisecond)-1)/int64(time.Millisecond))
+		}
+	} else if quantity <= limit {
+		retryAfter = newTat - tolerance - now
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	remaining := (tolerance - (tat - now)) / emission
+	ms := func(ns int64) string {
+		if ns < 0 {
+			return "-1"
+		}
+		return strconv.FormatInt((ns+int64(time.Millisecond)-1)/int64(time.Millisecond), 10)
+	}
+	sendList(req, [][]byte{
+		[]byte("allowed " + strconv.FormatBool(allowed)),
+		[]byte("limit " + strconv.FormatInt(limit, 10)),
+		[]byte("remaining " + strconv.FormatInt(remaining, 10)),
+		[]byte("retryAfter " + ms(retryAfter)),
+		[]byte("resetAfter " + ms(tat-now)),
+	})
+}
+
+// mulOverflows reports whether the product of the non negative a and b
+// overflows an int64.
+func mulOverflows(a, b int64) bool {
+	return b != 0 && a > math.MaxInt64/b
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"github.com/k-si/Kinx/kiface"
+	"log"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrSyntax  = errors.New("ERR syntax error")
+	ErrNumKeys = errors.New("ERR numkeys should be greater than 0")
+)
+
+// writeList writes res as a numbered list, one element per line.
+func writeList(sb *strings.Builder, res [][]byte) {
+	for i, r := range res {
+		sb.WriteString(strconv.Itoa(i))
+		if r == nil {
+			sb.WriteString(") (nil)")
+		} else {
+			sb.WriteString(") ")
+			sb.Write(r)
+		}
+		if i < len(res)-1 {
+			sb.WriteString("\n")
+		}
+	}
+}
+
+// sendList replies with a numbered list, or (empty list).
+func sendList(req kiface.IRequest, res [][]byte) {
+	if len(res) == 0 {
+		if err := req.GetConnection().SendMessage(200, []byte("(empty list)")); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	b := strings.Builder{}
+	writeList(&b, res)
+	if err := req.GetConnection().SendMessage(200, []byte(b.String())); err != nil {
+		log.Println(err)
+	}
+}
+
+// numKeys picks the keys following numkeys at the head of args, the
+// options coming after them are not keys.
+func numKeys(args [][]byte) [][]byte {
+	n, err := strconv.Atoi(string(args[0]))
+	if err != nil || n < 1 || n > len(args)-1 {
+		return nil
+	}
+	return args[1 : n+1]
+}
+
+// parseCount parses the optional count argument of SPOP and SRANDMEMBER.
+func parseCount(c [][]byte) (int, error) {
+	if len(c) > 2 {
+		return 0, ErrSyntax
+	}
+	if len(c) < 2 {
+		return 1, nil
+	}
+	n, err := strconv.Atoi(string(c[1]))
+	if err != nil {
+		return 0, ErrNotInteger
+	}
+	return n, nil
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/k-si/CaskDB"
@@ -9,10 +10,13 @@ import (
 	"github.com/pelletier/go-toml"
 	"io/ioutil"
 	"log"
+	"math/rand"
+	"net"
 	"net/http"
 	_ "net/http/pprof"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -32,15 +36,34 @@ const (
 	// db
 	DefaultDBDir         = "/tmp/caskdb"
 	DefaultMaxKeySize    = 1 * 1024 * 1024  // 1mb
-	DefaultMaxValueSize  = 4 * 1024 * 1024  // 8mb
+	DefaultMaxValueSize  = 4 * 1024 * 1024  // 4mb
 	DefaultMaxFileSize   = 16 * 1024 * 1024 // 16mb
 	DefaultMergeInterval = 24 * time.Hour
 	DefaultWriteSync     = false
+	DefaultDatabases     = 16
+
+	// security
+	DefaultRequirePass = ""
+	DefaultPprofAddr   = "127.0.0.1:6060"
+	DefaultTLSPort     = 0
+	LoopbackHost       = "127.0.0.1"
 )
 
 type Server struct {
 	netServer kiface.IServer
-	dbServer  *CaskDB.DB
+	dbs       []*CaskDB.DB
+	dbCfg     CaskDB.Config
+	acl       *ACL
+	tlsProxy  *TLSProxy
+
+	exec     sync.Mutex
+	mu       sync.Mutex
+	sessions map[uint32]*Session
+	blocked  map[blockKey][]*waiter
+
+	// state of the server kept out of the databases, like the locks
+	sys    *CaskDB.DB
+	leases map[blockKey]*time.Timer // lease timers of the locks, under exec
 }
 
 type ServerConfig struct {
@@ -63,6 +86,18 @@ type ServerConfig struct {
 	MaxFileSize   int64         `json:"max_file_size" yaml:"max_file_size" toml:"max_file_size"`
 	MergeInterval time.Duration `json:"gc_interval" yaml:"gc_interval" toml:"gc_interval"`
 	WriteSync     bool          `json:"sync_now" yaml:"sync_now" toml:"sync_now"`
+	Databases     int           `json:"databases" yaml:"databases" toml:"databases"`
+
+	// security
+	RequirePass string       `json:"requirepass" yaml:"requirepass" toml:"requirepass"`
+	PprofAddr   string       `json:"pprof_addr" yaml:"pprof_addr" toml:"pprof_addr"`
+	Users       []UserConfig `json:"users" yaml:"users" toml:"users"`
+
+	// tls
+	TLSPort       int    `json:"tls_port" yaml:"tls_port" toml:"tls_port"`
+	TLSCertFile   string `json:"tls_cert_file" yaml:"tls_cert_file" toml:"tls_cert_file"`
+	TLSKeyFile    string `json:"tls_key_file" yaml:"tls_key_file" toml:"tls_key_file"`
+	TLSCACertFile string `json:"tls_ca_cert_file" yaml:"tls_ca_cert_file" toml:"tls_ca_cert_file"`
 }
 
 func DefaultServerConfig() ServerConfig {
@@ -85,6 +120,12 @@ func DefaultServerConfig() ServerConfig {
 		MaxFileSize:   DefaultMaxFileSize,
 		MergeInterval: DefaultMergeInterval,
 		WriteSync:     DefaultWriteSync,
+		Databases:     DefaultDatabases,
+		// security
+		RequirePass: DefaultRequirePass,
+		PprofAddr:   DefaultPprofAddr,
+		// tls
+		TLSPort: DefaultTLSPort,
 	}
 }
 
@@ -97,7 +138,11 @@ func (sr *SetRouter) Handle(req kiface.IRequest) {
 	log.Println("handle Set")
 	c := parseCommand(string(req.GetMsg().GetMsgData()))
 
-	err := s.dbServer.Set(c[0], c[1])
+	// a key of any type is overwritten
+	_, err := delKey(s.db(req), c[0])
+	if err == nil {
+		err = s.db(req).Set(c[0], c[1])
+	}
 	if err != nil {
 		if err := req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
 			log.Println(err)
@@ -117,7 +162,13 @@ func (msr *MSetRouter) Handle(req kiface.IRequest) {
 	log.Println("handle MSet")
 	c := parseCommand(string(req.GetMsg().GetMsgData()))
 
-	err := s.dbServer.MSet(c...)
+	var err error
+	for i := 0; err == nil && i < len(c); i += 2 {
+		_, err = delKey(s.db(req), c[i])
+	}
+	if err == nil {
+		err = s.db(req).MSet(c...)
+	}
 	if err != nil {
 		if err := req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
 			log.Println(err)
@@ -137,7 +188,10 @@ func (snr *SetNxRouter) Handle(req kiface.IRequest) {
 	log.Println("handle SetNx")
 	c := parseCommand(string(req.GetMsg().GetMsgData()))
 
-	err := s.dbServer.SetNx(c[0], c[1])
+	_, err := expireIfNeeded(s.db(req), c[0])
+	if err == nil {
+		err = s.db(req).SetNx(c[0], c[1])
+	}
 	if err != nil {
 		if err := req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
 			log.Println(err)
@@ -157,7 +211,13 @@ func (msnr *MSetNxRouter) Handle(req kiface.IRequest) {
 	log.Println("handle MSetNx")
 	c := parseCommand(string(req.GetMsg().GetMsgData()))
 
-	err := s.dbServer.MSetNx(c...)
+	var err error
+	for i := 0; err == nil && i < len(c); i += 2 {
+		_, err = expireIfNeeded(s.db(req), c[i])
+	}
+	if err == nil {
+		err = s.db(req).MSetNx(c...)
+	}
 	if err != nil {
 		if err := req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
 			log.Println(err)
@@ -177,7 +237,7 @@ func (gr *GetRouter) Handle(req kiface.IRequest) {
 	log.Println("handle Get")
 	c := parseCommand(string(req.GetMsg().GetMsgData()))
 
-	res, err := s.dbServer.Get(c[0])
+	res, err := getString(s.db(req), c[0])
 	if err != nil {
 		if err := req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
 			log.Println(err)
@@ -203,7 +263,14 @@ func (mgr *MGetRouter) Handle(req kiface.IRequest) {
 	log.Println("handle MGet")
 	c := parseCommand(string(req.GetMsg().GetMsgData()))
 
-	res, err := s.dbServer.MGet(c...)
+	var err error
+	for i := 0; err == nil && i < len(c); i++ {
+		_, err = expireIfNeeded(s.db(req), c[i])
+	}
+	var res [][]byte
+	if err == nil {
+		res, err = s.db(req).MGet(c...)
+	}
 	if err != nil {
 		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
 			log.Println(err)
@@ -240,7 +307,14 @@ func (gsr *GetSetRouter) Handle(req kiface.IRequest) {
 	log.Println("handle GetSet")
 	c := parseCommand(string(req.GetMsg().GetMsgData()))
 
-	res, err := s.dbServer.GetSet(c[0], c[1])
+	_, err := expireIfNeeded(s.db(req), c[0])
+	var res []byte
+	if err == nil {
+		res, err = s.db(req).GetSet(c[0], c[1])
+	}
+	if err == nil {
+		err = persist(s.db(req), c[0])
+	}
 	if err != nil {
 		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
 			log.Println(err)
@@ -266,7 +340,10 @@ func (rr *RemoveRouter) Handle(req kiface.IRequest) {
 	log.Println("handle Remove")
 	c := parseCommand(string(req.GetMsg().GetMsgData()))
 
-	err := s.dbServer.Remove(c[0])
+	err := s.db(req).Remove(c[0])
+	if err == nil {
+		err = persist(s.db(req), c[0])
+	}
 	if err != nil {
 		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
 			log.Println(err)
@@ -285,12 +362,259 @@ type SLenRouter struct {
 func (slr *SLenRouter) Handle(req kiface.IRequest) {
 	log.Println("handle SLen")
 
-	l := s.dbServer.StrLen()
+	l := s.db(req).StrLen()
 	if err := req.GetConnection().SendMessage(200, []byte(strconv.Itoa(l))); err != nil {
 		log.Println(err)
 	}
 }
 
+type StrLenRouter struct {
+	knet.BaseRouter
+}
+
+func (slr *StrLenRouter) Handle(req kiface.IRequest) {
+	log.Println("handle StrLen")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	res, err := getString(s.db(req), c[0])
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte(strconv.Itoa(len(res)))); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+type AppendRouter struct {
+	knet.BaseRouter
+}
+
+func (ar *AppendRouter) Handle(req kiface.IRequest) {
+	log.Println("handle Append")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	res, err := getString(s.db(req), c[0])
+	if err == nil {
+		res = append(res, c[1]...)
+		err = s.db(req).Set(c[0], res)
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte(strconv.Itoa(len(res)))); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+type GetRangeRouter struct {
+	knet.BaseRouter
+}
+
+func (grr *GetRangeRouter) Handle(req kiface.IRequest) {
+	log.Println("handle GetRange")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	start, err := strconv.Atoi(string(c[1]))
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(ErrNotInteger.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	end, err := strconv.Atoi(string(c[2]))
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(ErrNotInteger.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	res, err := getString(s.db(req), c[0])
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	// negative offsets count from the end, both ends are inclusive
+	if start < 0 {
+		start += len(res)
+	}
+	if end < 0 {
+		end += len(res)
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end >= len(res) {
+		end = len(res) - 1
+	}
+	if start > end || len(res) == 0 {
+		if err = req.GetConnection().SendMessage(200, []byte("\"\"")); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	if err = req.GetConnection().SendMessage(200, res[start:end+1]); err != nil {
+		log.Println(err)
+	}
+}
+
+type SetRangeRouter struct {
+	knet.BaseRouter
+}
+
+func (srr *SetRangeRouter) Handle(req kiface.IRequest) {
+	log.Println("handle SetRange")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	offset, err := strconv.Atoi(string(c[1]))
+	if err != nil || offset < 0 {
+		if err = req.GetConnection().SendMessage(400, []byte("ERR offset is out of range")); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	if uint64(offset)+uint64(len(c[2])) > uint64(s.dbCfg.MaxValueSize) {
+		if err = req.GetConnection().SendMessage(400, []byte("ERR string exceeds maximum allowed size")); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	res, err := getString(s.db(req), c[0])
+	// an empty value leaves the key untouched
+	if err == nil && len(c[2]) > 0 {
+		if n := offset + len(c[2]); n > len(res) {
+			res = append(res, make([]byte, n-len(res))...)
+		}
+		copy(res[offset:], c[2])
+		err = s.db(req).Set(c[0], res)
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte(strconv.Itoa(len(res)))); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+type GetDelRouter struct {
+	knet.BaseRouter
+}
+
+func (gdr *GetDelRouter) Handle(req kiface.IRequest) {
+	log.Println("handle GetDel")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	res, err := getString(s.db(req), c[0])
+	if err == nil && len(res) > 0 {
+		if err = s.db(req).Remove(c[0]); err == nil {
+			err = persist(s.db(req), c[0])
+		}
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if len(res) == 0 {
+			if err = req.GetConnection().SendMessage(200, []byte("(nil)")); err != nil {
+				log.Println(err)
+			}
+		} else {
+			if err = req.GetConnection().SendMessage(200, res); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+type GetExRouter struct {
+	knet.BaseRouter
+}
+
+// parseGetExOption returns the deadline in unix milliseconds set by a
+// GETEX option, or 0 for PERSIST.
+func parseGetExOption(c [][]byte) (int64, error) {
+	opt := strings.ToLower(string(c[0]))
+	if opt == "persist" {
+		if len(c) != 1 {
+			return 0, errors.New("ERR syntax error")
+		}
+		return 0, nil
+	}
+	if len(c) != 2 {
+		return 0, errors.New("ERR syntax error")
+	}
+	n, err := parseInt(c[1])
+	if err != nil {
+		return 0, err
+	}
+	if n <= 0 {
+		return 0, errors.New("ERR invalid expire time in 'getex' command")
+	}
+	switch opt {
+	case "ex":
+		return nowMs() + n*1000, nil
+	case "px":
+		return nowMs() + n, nil
+	case "exat":
+		return n * 1000, nil
+	case "pxat":
+		return n, nil
+	}
+	return 0, errors.New("ERR syntax error")
+}
+
+func (ger *GetExRouter) Handle(req kiface.IRequest) {
+	log.Println("handle GetEx")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	var at int64
+	var err error
+	if len(c) > 1 {
+		at, err = parseGetExOption(c[1:])
+	}
+
+	var res []byte
+	if err == nil {
+		res, err = getString(s.db(req), c[0])
+	}
+	if err == nil && len(res) > 0 && len(c) > 1 {
+		if at == 0 {
+			err = persist(s.db(req), c[0])
+		} else {
+			err = setExpire(s.db(req), c[0], at)
+		}
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if len(res) == 0 {
+			if err = req.GetConnection().SendMessage(200, []byte("(nil)")); err != nil {
+				log.Println(err)
+			}
+		} else {
+			if err = req.GetConnection().SendMessage(200, res); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
 // hash
 type HSetRouter struct {
 	knet.BaseRouter
@@ -300,7 +624,7 @@ func (hsr *HSetRouter) Handle(req kiface.IRequest) {
 	log.Println("handle HSet")
 	c := parseCommand(string(req.GetMsg().GetMsgData()))
 
-	err := s.dbServer.HSet(c[0], c[1], c[2])
+	err := s.db(req).HSet(c[0], c[1], c[2])
 	if err != nil {
 		if err = req.GetConnection().SendMessage(200, []byte(err.Error())); err != nil {
 			log.Println(err)
@@ -320,7 +644,7 @@ func (hsnr *HSetNxRouter) Handle(req kiface.IRequest) {
 	log.Println("handle HSetNx")
 	c := parseCommand(string(req.GetMsg().GetMsgData()))
 
-	err := s.dbServer.HSetNx(c[0], c[1], c[2])
+	err := s.db(req).HSetNx(c[0], c[1], c[2])
 	if err != nil {
 		if err = req.GetConnection().SendMessage(200, []byte(err.Error())); err != nil {
 			log.Println(err)
@@ -340,7 +664,7 @@ func (hg *HGetRouter) Handle(req kiface.IRequest) {
 	log.Println("handle HGet")
 	c := parseCommand(string(req.GetMsg().GetMsgData()))
 
-	res, err := s.dbServer.HGet(c[0], c[1])
+	res, err := s.db(req).HGet(c[0], c[1])
 	if err != nil {
 		if err = req.GetConnection().SendMessage(200, []byte(err.Error())); err != nil {
 			log.Println(err)
@@ -357,6 +681,8 @@ func (hg *HGetRouter) Handle(req kiface.IRequest) {
 	}
 }
 
+// HGetAllRouter replies with the fields of a hash in order, one field and
+// its value per line, so that the clients can read them into a map.
 type HGetAllRouter struct {
 	knet.BaseRouter
 }
@@ -365,38 +691,18 @@ func (hgar *HGetAllRouter) Handle(req kiface.IRequest) {
 	log.Println("handle HGetAll")
 	c := parseCommand(string(req.GetMsg().GetMsgData()))
 
-	res, err := s.dbServer.HGetAll(c[0])
+	pairs, err := hashPairs(req, c[0])
 	if err != nil {
-		if err = req.GetConnection().SendMessage(200, []byte(err.Error())); err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
 			log.Println(err)
 		}
 	} else {
-		if len(res) == 0 {
-			if err = req.GetConnection().SendMessage(200, []byte("(empty list)")); err != nil {
-				log.Println(err)
-			}
-			return
-		}
-		b := strings.Builder{}
-		for i, r := range res {
-			if len(r) == 0 {
-				b.WriteString(strconv.Itoa(i))
-				b.WriteString(") (nil)")
-				if i < len(res)-1 {
-					b.WriteString("\n")
-				}
-			} else {
-				b.WriteString(strconv.Itoa(i))
-				b.WriteString(") ")
-				b.WriteString(string(r))
-				if i < len(res)-1 {
-					b.WriteString("\n")
-				}
-			}
-		}
-		if err = req.GetConnection().SendMessage(200, []byte(b.String())); err != nil {
-			log.Println(err)
+		// the arguments can not hold spaces, so the first one ends the field
+		var res [][]byte
+		for _, p := range pairs {
+			res = append(res, append(append(append([]byte{}, p[0]...), ' '), p[1]...))
 		}
+		sendList(req, res)
 	}
 }
 
@@ -408,7 +714,7 @@ func (hdr *HDelRouter) Handle(req kiface.IRequest) {
 	log.Println("handle HDel")
 	c := parseCommand(string(req.GetMsg().GetMsgData()))
 
-	err := s.dbServer.HDel(c[0], c[1])
+	err := s.db(req).HDel(c[0], c[1])
 	if err != nil {
 		if err = req.GetConnection().SendMessage(200, []byte(err.Error())); err != nil {
 			log.Println(err)
@@ -428,7 +734,7 @@ func (hlr *HLenRouter) Handle(req kiface.IRequest) {
 	log.Println("handle HLen")
 	c := parseCommand(string(req.GetMsg().GetMsgData()))
 
-	l := s.dbServer.HLen(c[0])
+	l := s.db(req).HLen(c[0])
 	if err := req.GetConnection().SendMessage(200, []byte(strconv.Itoa(l))); err != nil {
 		log.Println(err)
 	}
@@ -442,7 +748,7 @@ func (her *HExistRouter) Handle(req kiface.IRequest) {
 	log.Println("handle HExist")
 	c := parseCommand(string(req.GetMsg().GetMsgData()))
 
-	b := s.dbServer.HExist(c[0], c[1])
+	b := s.db(req).HExist(c[0], c[1])
 	if err := req.GetConnection().SendMessage(200, []byte(strconv.FormatBool(b))); err != nil {
 		log.Println(err)
 	}
@@ -457,7 +763,10 @@ func (lpr *LPushRouter) Handle(req kiface.IRequest) {
 	log.Println("handle LPush")
 	c := parseCommand(string(req.GetMsg().GetMsgData()))
 
-	err := s.dbServer.LPush(c[0], c[1:]...)
+	err := s.db(req).LPush(c[0], c[1:]...)
+	if err == nil {
+		s.wakeUp(s.session(req.GetConnection()).db, c[0])
+	}
 	if err != nil {
 		if err = req.GetConnection().SendMessage(200, []byte(err.Error())); err != nil {
 			log.Println(err)
@@ -477,7 +786,10 @@ func (lrpr *LRPushRouter) Handle(req kiface.IRequest) {
 	log.Println("handle LRPush")
 	c := parseCommand(string(req.GetMsg().GetMsgData()))
 
-	err := s.dbServer.RPush(c[0], c[1:]...)
+	err := s.db(req).RPush(c[0], c[1:]...)
+	if err == nil {
+		s.wakeUp(s.session(req.GetConnection()).db, c[0])
+	}
 	if err != nil {
 		if err = req.GetConnection().SendMessage(200, []byte(err.Error())); err != nil {
 			log.Println(err)
@@ -497,7 +809,7 @@ func (lpr *LPopRouter) Handle(req kiface.IRequest) {
 	log.Println("handle LPop")
 	c := parseCommand(string(req.GetMsg().GetMsgData()))
 
-	res, err := s.dbServer.LPop(c[0])
+	res, err := s.db(req).LPop(c[0])
 	if err != nil {
 		if err = req.GetConnection().SendMessage(200, []byte(err.Error())); err != nil {
 			log.Println(err)
@@ -523,7 +835,7 @@ func (lrpr *LRPopRouter) Handle(req kiface.IRequest) {
 	log.Println("handle RPop")
 	c := parseCommand(string(req.GetMsg().GetMsgData()))
 
-	res, err := s.dbServer.RPop(c[0])
+	res, err := s.db(req).RPop(c[0])
 	if err != nil {
 		if err = req.GetConnection().SendMessage(200, []byte(err.Error())); err != nil {
 			log.Println(err)
@@ -551,7 +863,10 @@ func (lir *LInsertRouter) Handle(req kiface.IRequest) {
 
 	n, _ := strconv.Atoi(string(c[2]))
 
-	err := s.dbServer.LInsert(c[0], c[1], n)
+	err := s.db(req).LInsert(c[0], c[1], n)
+	if err == nil {
+		s.wakeUp(s.session(req.GetConnection()).db, c[0])
+	}
 	if err != nil {
 		if err = req.GetConnection().SendMessage(200, []byte(err.Error())); err != nil {
 			log.Println(err)
@@ -573,7 +888,10 @@ func (lrir *LRInsertRouter) Handle(req kiface.IRequest) {
 
 	n, _ := strconv.Atoi(string(c[2]))
 
-	err := s.dbServer.RInsert(c[0], c[1], n)
+	err := s.db(req).RInsert(c[0], c[1], n)
+	if err == nil {
+		s.wakeUp(s.session(req.GetConnection()).db, c[0])
+	}
 	if err != nil {
 		if err = req.GetConnection().SendMessage(200, []byte(err.Error())); err != nil {
 			log.Println(err)
@@ -595,7 +913,7 @@ func (lsr *LSetRouter) Handle(req kiface.IRequest) {
 
 	n, _ := strconv.Atoi(string(c[2]))
 
-	err := s.dbServer.LSet(c[0], c[1], n)
+	err := s.db(req).LSet(c[0], c[1], n)
 	if err != nil {
 		if err = req.GetConnection().SendMessage(200, []byte(err.Error())); err != nil {
 			log.Println(err)
@@ -617,7 +935,7 @@ func (lrr *LRemRouter) Handle(req kiface.IRequest) {
 
 	n, _ := strconv.Atoi(string(c[2]))
 
-	err := s.dbServer.LRem(c[0], c[1], n)
+	err := s.db(req).LRem(c[0], c[1], n)
 	if err != nil {
 		if err = req.GetConnection().SendMessage(200, []byte(err.Error())); err != nil {
 			log.Println(err)
@@ -637,7 +955,7 @@ func (llr *LLenRouter) Handle(req kiface.IRequest) {
 	log.Println("handle LLen")
 	c := parseCommand(string(req.GetMsg().GetMsgData()))
 
-	l := s.dbServer.LLen(c[0])
+	l := s.db(req).LLen(c[0])
 	if err := req.GetConnection().SendMessage(200, []byte(strconv.Itoa(l))); err != nil {
 		log.Println(err)
 	}
@@ -653,7 +971,7 @@ func (lir *LIndexRouter) Handle(req kiface.IRequest) {
 
 	n, _ := strconv.Atoi(string(c[1]))
 
-	res, err := s.dbServer.LIndex(c[0], n)
+	res, err := s.db(req).LIndex(c[0], n)
 
 	if err != nil {
 		if err = req.GetConnection().SendMessage(200, []byte(err.Error())); err != nil {
@@ -683,7 +1001,7 @@ func (lrr *LRangeRouter) Handle(req kiface.IRequest) {
 	start, _ := strconv.Atoi(string(c[1]))
 	stop, _ := strconv.Atoi(string(c[2]))
 
-	res, err := s.dbServer.LRange(c[0], start, stop)
+	res, err := s.db(req).LRange(c[0], start, stop)
 
 	if err != nil {
 		if err = req.GetConnection().SendMessage(200, []byte(err.Error())); err != nil {
@@ -727,7 +1045,7 @@ func (ler *LExistRouter) Handle(req kiface.IRequest) {
 	log.Println("handle LExist")
 	c := parseCommand(string(req.GetMsg().GetMsgData()))
 
-	b := s.dbServer.LExist(c[0], c[1])
+	b := s.db(req).LExist(c[0], c[1])
 
 	if err := req.GetConnection().SendMessage(200, []byte(strconv.FormatBool(b))); err != nil {
 		log.Println(err)
@@ -743,7 +1061,7 @@ func (sar *SAddRouter) Handle(req kiface.IRequest) {
 	log.Println("handle SAdd")
 	c := parseCommand(string(req.GetMsg().GetMsgData()))
 
-	err := s.dbServer.SAdd(c[0], c[1:]...)
+	err := s.db(req).SAdd(c[0], c[1:]...)
 	if err != nil {
 		if err = req.GetConnection().SendMessage(200, []byte(err.Error())); err != nil {
 			log.Println(err)
@@ -763,7 +1081,7 @@ func (srr *SRemRouter) Handle(req kiface.IRequest) {
 	log.Println("handle SRem")
 	c := parseCommand(string(req.GetMsg().GetMsgData()))
 
-	err := s.dbServer.SRem(c[0], c[1])
+	err := s.db(req).SRem(c[0], c[1])
 	if err != nil {
 		if err = req.GetConnection().SendMessage(200, []byte(err.Error())); err != nil {
 			log.Println(err)
@@ -783,7 +1101,7 @@ func (smr *SMoveRouter) Handle(req kiface.IRequest) {
 	log.Println("handle SMove")
 	c := parseCommand(string(req.GetMsg().GetMsgData()))
 
-	err := s.dbServer.SMove(c[0], c[1], c[2])
+	err := s.db(req).SMove(c[0], c[1], c[2])
 	if err != nil {
 		if err = req.GetConnection().SendMessage(200, []byte(err.Error())); err != nil {
 			log.Println(err)
@@ -803,7 +1121,7 @@ func (sur *SUnionRouter) Handle(req kiface.IRequest) {
 	log.Println("handle SUnion")
 	c := parseCommand(string(req.GetMsg().GetMsgData()))
 
-	res, err := s.dbServer.SUnion(c...)
+	res, err := s.db(req).SUnion(c...)
 
 	if err != nil {
 		if err = req.GetConnection().SendMessage(200, []byte(err.Error())); err != nil {
@@ -847,7 +1165,7 @@ func (sdr *SDiffRouter) Handle(req kiface.IRequest) {
 	log.Println("handle SDiff")
 	c := parseCommand(string(req.GetMsg().GetMsgData()))
 
-	res, err := s.dbServer.SDiff(c...)
+	res, err := s.db(req).SDiff(c...)
 
 	if err != nil {
 		if err = req.GetConnection().SendMessage(200, []byte(err.Error())); err != nil {
@@ -891,7 +1209,7 @@ func (ssr *SScanRouter) Handle(req kiface.IRequest) {
 	log.Println("handle SScan")
 	c := parseCommand(string(req.GetMsg().GetMsgData()))
 
-	res, err := s.dbServer.SScan(c[0])
+	res, err := s.db(req).SScan(c[0])
 
 	if err != nil {
 		if err = req.GetConnection().SendMessage(200, []byte(err.Error())); err != nil {
@@ -935,7 +1253,7 @@ func (scr *SCardRouter) Handle(req kiface.IRequest) {
 	log.Println("handle SCard")
 	c := parseCommand(string(req.GetMsg().GetMsgData()))
 
-	l := s.dbServer.SCard(c[0])
+	l := s.db(req).SCard(c[0])
 	if err := req.GetConnection().SendMessage(200, []byte(strconv.Itoa(l))); err != nil {
 		log.Println(err)
 	}
@@ -949,7 +1267,7 @@ func (simr *SIsMemberRouter) Handle(req kiface.IRequest) {
 	log.Println("handle SIsMember")
 	c := parseCommand(string(req.GetMsg().GetMsgData()))
 
-	b := s.dbServer.SIsMember(c[0], c[1])
+	b := s.db(req).SIsMember(c[0], c[1])
 	if err := req.GetConnection().SendMessage(200, []byte(strconv.FormatBool(b))); err != nil {
 		log.Println(err)
 	}
@@ -964,17 +1282,52 @@ func (zar *ZAddRouter) Handle(req kiface.IRequest) {
 	log.Println("handle ZAdd")
 	c := parseCommand(string(req.GetMsg().GetMsgData()))
 
-	score, _ := strconv.ParseFloat(string(c[1]), 64)
-
-	err := s.dbServer.ZAdd(c[0], score, c[2])
+	flags, i, err := parseZAddFlags(c[1:])
+	pairs := c[1+i:]
+	if err == nil && (len(pairs) == 0 || len(pairs)%2 != 0) {
+		err = ErrSyntax
+	}
+	if err == nil && flags.incr && len(pairs) != 2 {
+		err = errors.New("ERR INCR option supports a single increment-element pair")
+	}
+	// parse all the scores before writing anything
+	scores := make([]float64, len(pairs)/2)
+	for j := 0; j < len(scores) && err == nil; j++ {
+		scores[j], err = parseScore(pairs[2*j])
+	}
 	if err != nil {
-		if err = req.GetConnection().SendMessage(200, []byte(err.Error())); err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
 			log.Println(err)
 		}
-	} else {
-		if err = req.GetConnection().SendMessage(200, []byte("\"OK\"")); err != nil {
+		return
+	}
+
+	n := 0
+	var score float64
+	var result int
+	for j := 0; j < len(scores) && err == nil; j++ {
+		score, result, err = zAdd(s.db(req), c[0], flags, scores[j], pairs[2*j+1])
+		if result == zAdded || flags.ch && result == zChanged {
+			n++
+		}
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
 			log.Println(err)
 		}
+		return
+	}
+
+	// with INCR the new score is returned, or nil when a flag aborted it
+	res := []byte(strconv.Itoa(n))
+	if flags.incr {
+		res = []byte("(nil)")
+		if result != zAborted {
+			res = formatScore(score)
+		}
+	}
+	if err = req.GetConnection().SendMessage(200, res); err != nil {
+		log.Println(err)
 	}
 }
 
@@ -986,7 +1339,7 @@ func (zrr *ZRemRouter) Handle(req kiface.IRequest) {
 	log.Println("handle ZRem")
 	c := parseCommand(string(req.GetMsg().GetMsgData()))
 
-	err := s.dbServer.ZRem(c[0], c[1])
+	err := s.db(req).ZRem(c[0], c[1])
 	if err != nil {
 		if err = req.GetConnection().SendMessage(200, []byte(err.Error())); err != nil {
 			log.Println(err)
@@ -1009,7 +1362,7 @@ func (zsrr *ZScoreRangeRouter) Handle(req kiface.IRequest) {
 	from, _ := strconv.ParseFloat(string(c[1]), 64)
 	to, _ := strconv.ParseFloat(string(c[2]), 64)
 
-	res, err := s.dbServer.ZScoreRange(c[0], from, to)
+	res, err := s.db(req).ZScoreRange(c[0], from, to)
 
 	if err != nil {
 		if err = req.GetConnection().SendMessage(200, []byte(err.Error())); err != nil {
@@ -1053,7 +1406,7 @@ func (zsr *ZScoreRouter) Handle(req kiface.IRequest) {
 	log.Println("handle ZScore")
 	c := parseCommand(string(req.GetMsg().GetMsgData()))
 
-	b, res := s.dbServer.ZScore(c[0], c[1])
+	b, res := s.db(req).ZScore(c[0], c[1])
 	score := fmt.Sprintf("%f", res)
 	if b {
 		if err := req.GetConnection().SendMessage(200, []byte(score)); err != nil {
@@ -1074,7 +1427,7 @@ func (zcr *ZCardRouter) Handle(req kiface.IRequest) {
 	log.Println("handle ZCard")
 	c := parseCommand(string(req.GetMsg().GetMsgData()))
 
-	n := s.dbServer.ZCard(c[0])
+	n := s.db(req).ZCard(c[0])
 	if err := req.GetConnection().SendMessage(200, []byte(strconv.Itoa(n))); err != nil {
 		log.Println(err)
 	}
@@ -1088,7 +1441,7 @@ func (zimr *ZIsMemberRouter) Handle(req kiface.IRequest) {
 	log.Println("handle ZIsMember")
 	c := parseCommand(string(req.GetMsg().GetMsgData()))
 
-	b := s.dbServer.ZIsMember(c[0], c[1])
+	b := s.db(req).ZIsMember(c[0], c[1])
 	if err := req.GetConnection().SendMessage(200, []byte(strconv.FormatBool(b))); err != nil {
 		log.Println(err)
 	}
@@ -1103,7 +1456,7 @@ func (ztr *ZTopRouter) Handle(req kiface.IRequest) {
 	c := parseCommand(string(req.GetMsg().GetMsgData()))
 
 	n, _ := strconv.Atoi(string(c[1]))
-	res, err := s.dbServer.ZTop(c[0], n)
+	res, err := s.db(req).ZTop(c[0], n)
 
 	if err != nil {
 		if err = req.GetConnection().SendMessage(200, []byte(err.Error())); err != nil {
@@ -1141,6 +1494,8 @@ func (ztr *ZTopRouter) Handle(req kiface.IRequest) {
 
 var s *Server
 
+var random = rand.New(rand.NewSource(time.Now().UnixNano()))
+
 func init() {
 	b, _ := ioutil.ReadFile("./banner.txt")
 	fmt.Println(string(b))
@@ -1148,11 +1503,6 @@ func init() {
 
 func main() {
 
-	// pprof
-	go func() {
-		log.Println(http.ListenAndServe("0.0.0.0:6060", nil))
-	}()
-
 	defer func() {
 		if r := recover(); r != nil {
 			log.Printf("server panic: %+v", r)
@@ -1181,55 +1531,32 @@ func main() {
 		log.Fatal(err)
 	}
 
+	// pprof, only reachable from the configured address
+	if cfg.PprofAddr != "" {
+		go func() {
+			log.Println(http.ListenAndServe(cfg.PprofAddr, nil))
+		}()
+	}
+
 	// registry router
 	ns := s.netServer
-	ns.AddRouter(0, &SetRouter{})
-	ns.AddRouter(1, &MSetRouter{})
-	ns.AddRouter(2, &SetNxRouter{})
-	ns.AddRouter(3, &MSetNxRouter{})
-	ns.AddRouter(4, &GetRouter{})
-	ns.AddRouter(5, &MGetRouter{})
-	ns.AddRouter(6, &GetSetRouter{})
-	ns.AddRouter(7, &RemoveRouter{})
-	ns.AddRouter(8, &SLenRouter{})
-	ns.AddRouter(9, &HSetRouter{})
-	ns.AddRouter(10, &HSetNxRouter{})
-	ns.AddRouter(11, &HGetRouter{})
-	ns.AddRouter(12, &HGetAllRouter{})
-	ns.AddRouter(13, &HDelRouter{})
-	ns.AddRouter(14, &HLenRouter{})
-	ns.AddRouter(15, &HExistRouter{})
-	ns.AddRouter(16, &LPushRouter{})
-	ns.AddRouter(17, &LRPushRouter{})
-	ns.AddRouter(18, &LPopRouter{})
-	ns.AddRouter(19, &LRPopRouter{})
-	ns.AddRouter(20, &LInsertRouter{})
-	ns.AddRouter(21, &LRInsertRouter{})
-	ns.AddRouter(22, &LSetRouter{})
-	ns.AddRouter(23, &LRemRouter{})
-	ns.AddRouter(24, &LLenRouter{})
-	ns.AddRouter(25, &LIndexRouter{})
-	ns.AddRouter(26, &LRangeRouter{})
-	ns.AddRouter(27, &LExistRouter{})
-	ns.AddRouter(28, &SAddRouter{})
-	ns.AddRouter(29, &SRemRouter{})
-	ns.AddRouter(30, &SMoveRouter{})
-	ns.AddRouter(31, &SUnionRouter{})
-	ns.AddRouter(32, &SDiffRouter{})
-	ns.AddRouter(33, &SScanRouter{})
-	ns.AddRouter(34, &SCardRouter{})
-	ns.AddRouter(35, &SIsMemberRouter{})
-	ns.AddRouter(36, &ZAddRouter{})
-	ns.AddRouter(37, &ZRemRouter{})
-	ns.AddRouter(38, &ZScoreRangeRouter{})
-	ns.AddRouter(39, &ZScoreRouter{})
-	ns.AddRouter(40, &ZCardRouter{})
-	ns.AddRouter(41, &ZIsMemberRouter{})
-	ns.AddRouter(42, &ZTopRouter{})
+	for _, cmd := range commandTable {
+		ns.AddRouter(cmd.Id, cmd)
+	}
+
+	// drop per-connection state when a client goes away
+	ns.SetOnConnStop(s.closeSession)
+
+	if s.tlsProxy != nil {
+		go s.tlsProxy.Serve()
+		defer s.tlsProxy.Close()
+	}
+
+	go s.expireCycle()
 
 	// tcp server blocking
 	ns.Serve()
-	defer s.dbServer.Close()
+	defer s.Close()
 }
 
 func NewServer(cfg ServerConfig) (*Server, error) {
@@ -1247,24 +1574,63 @@ func NewServer(cfg ServerConfig) (*Server, error) {
 	netCfg.HeartRateInSecond = defCfg.HeartRateInSecond
 	netCfg.HeartFreshLevel = cfg.HeartFreshLevel
 
+	// with tls the plaintext port is only reachable through the proxy
+	var tlsProxy *TLSProxy
+	if cfg.TLSPort != 0 {
+		netCfg.Host = LoopbackHost
+		p, err := NewTLSProxy(cfg, net.JoinHostPort(LoopbackHost, strconv.Itoa(cfg.Port)))
+		if err != nil {
+			return nil, err
+		}
+		tlsProxy = p
+	}
+
 	netServer := knet.NewServer(netCfg)
 
+	// load acl users
+	acl, err := NewACL(cfg.RequirePass, cfg.Users)
+	if err != nil {
+		return nil, err
+	}
+
 	// load db server config
 	dbCfg := CaskDB.DefaultConfig()
 	dbCfg.DBDir = cfg.DBDir
 	dbCfg.MaxKeySize = cfg.MaxKeySize
-	dbCfg.MaxValueSize = cfg.MaxKeySize
+	dbCfg.MaxValueSize = cfg.MaxValueSize
 	dbCfg.MaxFileSize = cfg.MaxFileSize
 	dbCfg.MergeInterval = defCfg.MergeInterval
 	dbCfg.WriteSync = cfg.WriteSync
-	dbServer, err := CaskDB.Open(dbCfg)
-	if err != nil {
-		return nil, err
-	}
 
 	s := &Server{
 		netServer: netServer,
-		dbServer:  dbServer,
+		dbCfg:     dbCfg,
+		acl:       acl,
+		tlsProxy:  tlsProxy,
+		sessions:  make(map[uint32]*Session),
+		blocked:   make(map[blockKey][]*waiter),
+		leases:    make(map[blockKey]*time.Timer),
+	}
+
+	// every logical database lives in db_dir/<index>
+	if err = s.migrateDB(); err != nil {
+		return nil, err
+	}
+	n := cfg.Databases
+	if n <= 0 {
+		n = defCfg.Databases
+	}
+	for i := 0; i < n; i++ {
+		db, err := s.openDB(i)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.dbs = append(s.dbs, db)
+	}
+	if s.sys, err = s.openSys(); err != nil {
+		s.Close()
+		return nil, err
 	}
 	return s, nil
 }
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"errors"
+	"github.com/k-si/CaskDB"
+	"github.com/k-si/Kinx/kiface"
+	"github.com/k-si/Kinx/knet"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// sInter intersects the sets of keys, keeping the order of the first one.
+func sInter(db *CaskDB.DB, keys ...[]byte) ([][]byte, error) {
+	res, err := db.SScan(keys[0])
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range keys[1:] {
+		if len(res) == 0 {
+			break
+		}
+		var kept [][]byte
+		for _, m := range res {
+			if db.SIsMember(key, m) {
+				kept = append(kept, m)
+			}
+		}
+		res = kept
+	}
+	return res, nil
+}
+
+// sStore replaces dst, whatever its type, by the set of members res.
+func sStore(db *CaskDB.DB, dst []byte, res [][]byte) error {
+	if _, err := delKey(db, dst); err != nil {
+		return err
+	}
+	if len(res) == 0 {
+		return nil
+	}
+	return db.SAdd(dst, res...)
+}
+
+// sRandom picks count distinct members of a set for a positive count, and
+// -count members possibly repeated for a negative one.
+func sRandom(members [][]byte, count int) [][]byte {
+	if count >= 0 {
+		random.Shuffle(len(members), func(i, j int) {
+			members[i], members[j] = members[j], members[i]
+		})
+		if count > len(members) {
+			count = len(members)
+		}
+		return members[:count]
+	}
+	var res [][]byte
+	if len(members) > 0 {
+		for i := 0; i < -count; i++ {
+			res = append(res, members[random.Intn(len(members))])
+		}
+	}
+	return res
+}
+
+type SInterRouter struct {
+	knet.BaseRouter
+}
+
+func (sir *SInterRouter) Handle(req kiface.IRequest) {
+	log.Println("handle SInter")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	res, err := sInter(s.db(req), c...)
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	sendList(req, res)
+}
+
+type SInterCardRouter struct {
+	knet.BaseRouter
+}
+
+func (sicr *SInterCardRouter) keys(args [][]byte) [][]byte {
+	return numKeys(args)
+}
+
+func (sicr *SInterCardRouter) Handle(req kiface.IRequest) {
+	log.Println("handle SInterCard")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	numKeys, err := strconv.Atoi(string(c[0]))
+	if err != nil || numKeys < 1 {
+		err = ErrNumKeys
+	} else if numKeys > len(c)-1 {
+		err = errors.New("ERR Number of keys can't be greater than number of args")
+	}
+	limit := 0
+	if err == nil && len(c) > numKeys+1 {
+		if len(c) != numKeys+3 || strings.ToLower(string(c[numKeys+1])) != "limit" {
+			err = ErrSyntax
+		} else if limit, err = strconv.Atoi(string(c[numKeys+2])); err != nil || limit < 0 {
+			err = errors.New("ERR LIMIT can't be negative")
+		}
+	}
+
+	var res [][]byte
+	if err == nil {
+		res, err = sInter(s.db(req), c[1:numKeys+1]...)
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	// a zero limit means no limit
+	n := len(res)
+	if limit > 0 && n > limit {
+		n = limit
+	}
+	if err = req.GetConnection().SendMessage(200, []byte(strconv.Itoa(n))); err != nil {
+		log.Println(err)
+	}
+}
+
+// setStore serves the *STORE commands, writing the result of op on the
+// source keys to the destination key and replying with its cardinality.
+func setStore(req kiface.IRequest, op func(db *CaskDB.DB, keys ...[]byte) ([][]byte, error)) {
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	db := s.db(req)
+	res, err := op(db, c[1:]...)
+	if err == nil {
+		err = sStore(db, c[0], res)
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte(strconv.Itoa(db.SCard(c[0])))); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+type SInterStoreRouter struct {
+	knet.BaseRouter
+}
+
+func (sisr *SInterStoreRouter) sources(args [][]byte) [][]byte {
+	return args[1:]
+}
+
+func (sisr *SInterStoreRouter) Handle(req kiface.IRequest) {
+	log.Println("handle SInterStore")
+	setStore(req, sInter)
+}
+
+type SUnionStoreRouter struct {
+	knet.BaseRouter
+}
+
+func (susr *SUnionStoreRouter) sources(args [][]byte) [][]byte {
+	return args[1:]
+}
+
+func (susr *SUnionStoreRouter) Handle(req kiface.IRequest) {
+	log.Println("handle SUnionStore")
+	setStore(req, func(db *CaskDB.DB, keys ...[]byte) ([][]byte, error) {
+		return db.SUnion(keys...)
+	})
+}
+
+type SDiffStoreRouter struct {
+	knet.BaseRouter
+}
+
+func (sdsr *SDiffStoreRouter) sources(args [][]byte) [][]byte {
+	return args[1:]
+}
+
+func (sdsr *SDiffStoreRouter) Handle(req kiface.IRequest) {
+	log.Println("handle SDiffStore")
+	setStore(req, func(db *CaskDB.DB, keys ...[]byte) ([][]byte, error) {
+		return db.SDiff(keys...)
+	})
+}
+
+type SPopRouter struct {
+	knet.BaseRouter
+}
+
+func (spr *SPopRouter) Handle(req kiface.IRequest) {
+	log.Println("handle SPop")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	count, err := parseCount(c)
+	if err == nil && count < 0 {
+		err = errors.New("ERR value is out of range, must be positive")
+	}
+	var members [][]byte
+	if err == nil {
+		members, err = s.db(req).SScan(c[0])
+	}
+	var res [][]byte
+	if err == nil {
+		res = sRandom(members, count)
+		for _, m := range res {
+			if err = s.db(req).SRem(c[0], m); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	// without count a single member is returned, or nil
+	if len(c) == 1 {
+		if len(res) == 0 {
+			if err = req.GetConnection().SendMessage(200, []byte("(nil)")); err != nil {
+				log.Println(err)
+			}
+			return
+		}
+		if err = req.GetConnection().SendMessage(200, res[0]); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	sendList(req, res)
+}
+
+type SRandMemberRouter struct {
+	knet.BaseRouter
+}
+
+func (srmr *SRandMemberRouter) Handle(req kiface.IRequest) {
+	log.Println("handle SRandMember")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	count, err := parseCount(c)
+	var members [][]byte
+	if err == nil {
+		members, err = s.db(req).SScan(c[0])
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	res := sRandom(members, count)
+	if len(c) == 1 {
+		if len(res) == 0 {
+			if err = req.GetConnection().SendMessage(200, []byte("(nil)")); err != nil {
+				log.Println(err)
+			}
+			return
+		}
+		if err = req.GetConnection().SendMessage(200, res[0]); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	sendList(req, res)
+}
+
+type SMIsMemberRouter struct {
+	knet.BaseRouter
+}
+
+func (smimr *SMIsMemberRouter) Handle(req kiface.IRequest) {
+	log.Println("handle SMIsMember")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	var res [][]byte
+	for _, m := range c[1:] {
+		res = append(res, []byte(strconv.FormatBool(s.db(req).SIsMember(c[0], m))))
+	}
+	sendList(req, res)
+}
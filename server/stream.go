@@ -0,0 +1,1235 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/k-si/CaskDB"
+	"github.com/k-si/Kinx/kiface"
+	"github.com/k-si/Kinx/knet"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidStreamID  = errors.New("ERR Invalid stream ID specified as stream command argument")
+	ErrStreamIDTooSmall = errors.New("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+	ErrStreamIDZero     = errors.New("ERR The ID specified in XADD must be greater than 0-0")
+	ErrNoStream         = errors.New("ERR The XGROUP subcommand requires the key to exist. Note that for CREATE you may want to use the MKSTREAM option to create an empty stream automatically.")
+	ErrBusyGroup        = errors.New("BUSYGROUP Consumer Group name already exists")
+)
+
+// A stream is kept in two internal keys: a list of json encoded entries in
+// id order, and a string holding the json encoded streamMeta. The meta key
+// exists for as long as the stream does, even when it has no entries. The
+// meta keeps the last id and the length, so that adding an entry reads no
+// entry and reading a range only decodes the entries probed by a binary
+// search besides the ones returned.
+const (
+	streamPrefix     = internalPrefix + "stream:"
+	streamMetaPrefix = internalPrefix + "stream-meta:"
+)
+
+func streamKey(key []byte) []byte {
+	return []byte(streamPrefix + string(key))
+}
+
+func streamMetaKey(key []byte) []byte {
+	return []byte(streamMetaPrefix + string(key))
+}
+
+// streamID identifies a stream entry, as milliseconds and a sequence number.
+type streamID struct {
+	ms, seq uint64
+}
+
+var maxStreamID = streamID{math.MaxUint64, math.MaxUint64}
+
+func (id streamID) String() string {
+	return strconv.FormatUint(id.ms, 10) + "-" + strconv.FormatUint(id.seq, 10)
+}
+
+func (id streamID) less(o streamID) bool {
+	return id.ms < o.ms || id.ms == o.ms && id.seq < o.seq
+}
+
+// next is the smallest id greater than id.
+func (id streamID) next() (streamID, bool) {
+	if id.seq < math.MaxUint64 {
+		return streamID{id.ms, id.seq + 1}, true
+	}
+	if id.ms < math.MaxUint64 {
+		return streamID{id.ms + 1, 0}, true
+	}
+	return id, false
+}
+
+// prev is the greatest id smaller than id.
+func (id streamID) prev() (streamID, bool) {
+	if id.seq > 0 {
+		return streamID{id.ms, id.seq - 1}, true
+	}
+	if id.ms > 0 {
+		return streamID{id.ms - 1, math.MaxUint64}, true
+	}
+	return id, false
+}
+
+// parseStreamID parses ms-seq, a missing sequence number is seq.
+func parseStreamID(b []byte, seq uint64) (streamID, error) {
+	parts := strings.SplitN(string(b), "-", 2)
+	ms, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return streamID{}, ErrInvalidStreamID
+	}
+	if len(parts) == 2 {
+		if seq, err = strconv.ParseUint(parts[1], 10, 64); err != nil {
+			return streamID{}, ErrInvalidStreamID
+		}
+	}
+	return streamID{ms, seq}, nil
+}
+
+// parseRangeID parses a range bound of XRANGE: - and + are the smallest and
+// the greatest ids, and ( makes the bound exclusive.
+func parseRangeID(b []byte, start bool) (streamID, bool, error) {
+	switch string(b) {
+	case "-":
+		return streamID{}, true, nil
+	case "+":
+		return maxStreamID, true, nil
+	}
+	exclusive := len(b) > 0 && b[0] == '('
+	if exclusive {
+		b = b[1:]
+	}
+	var seq uint64
+	if !start {
+		seq = math.MaxUint64
+	}
+	id, err := parseStreamID(b, seq)
+	if err != nil || !exclusive {
+		return id, true, err
+	}
+	if start {
+		id, ok := id.next()
+		return id, ok, nil
+	}
+	id, ok := id.prev()
+	return id, ok, nil
+}
+
+type streamEntry struct {
+	ID     string   `json:"id"`
+	Fields []string `json:"fields"` // alternating fields and values
+}
+
+func (e streamEntry) id() streamID {
+	id, _ := parseStreamID([]byte(e.ID), 0)
+	return id
+}
+
+// format renders an entry as its id followed by its fields and values as a
+// json array.
+func (e streamEntry) format() []byte {
+	b, _ := json.Marshal(e.Fields)
+	return []byte(e.ID + " " + string(b))
+}
+
+type pendingEntry struct {
+	Consumer  string `json:"consumer"`
+	Delivered int64  `json:"delivered"` // unix milliseconds of the last delivery
+	Count     int    `json:"count"`
+}
+
+type streamGroup struct {
+	LastID    string                   `json:"last_id"`
+	Pending   map[string]*pendingEntry `json:"pending"`
+	Consumers map[string]int64         `json:"consumers"` // unix milliseconds seen last
+}
+
+type streamMeta struct {
+	LastID string                  `json:"last_id"`
+	Length int                     `json:"length"`
+	Groups map[string]*streamGroup `json:"groups"`
+}
+
+func (m *streamMeta) lastID() streamID {
+	id, _ := parseStreamID([]byte(m.LastID), 0)
+	return id
+}
+
+// loadStream reads the meta of a stream, or nil if it does not exist.
+func loadStream(db *CaskDB.DB, key []byte) (*streamMeta, error) {
+	v, err := db.Get(streamMetaKey(key))
+	if err != nil || len(v) == 0 {
+		return nil, err
+	}
+	m := &streamMeta{}
+	if err = json.Unmarshal(v, m); err != nil {
+		return nil, err
+	}
+	if m.Groups == nil {
+		m.Groups = make(map[string]*streamGroup)
+	}
+	return m, nil
+}
+
+func saveStream(db *CaskDB.DB, key []byte, m *streamMeta) error {
+	v, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return db.Set(streamMetaKey(key), v)
+}
+
+// streamSearch finds the position of the first of the n entries of a
+// stream with an id not less than id.
+func streamSearch(db *CaskDB.DB, key []byte, n int, id streamID) (int, error) {
+	lo, hi := 0, n
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		v, err := db.LIndex(streamKey(key), mid)
+		if err != nil {
+			return 0, err
+		}
+		var e streamEntry
+		if err = json.Unmarshal(v, &e); err != nil {
+			return 0, err
+		}
+		if e.id().less(id) {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo, nil
+}
+
+// streamRange reads the entries with an id between start and end out of
+// the n entries of a stream, at most count of them unless count is
+// negative. With rev they are read from the end, in reverse order.
+func streamRange(db *CaskDB.DB, key []byte, n int, start, end streamID, count int, rev bool) ([]streamEntry, error) {
+	from, err := streamSearch(db, key, n, start)
+	if err != nil {
+		return nil, err
+	}
+	to := n
+	if next, ok := end.next(); ok {
+		if to, err = streamSearch(db, key, n, next); err != nil {
+			return nil, err
+		}
+	}
+	if count >= 0 && to-from > count {
+		if rev {
+			from = to - count
+		} else {
+			to = from + count
+		}
+	}
+	if from >= to {
+		return nil, nil
+	}
+	res, err := db.LRange(streamKey(key), from, to-1)
+	if err != nil {
+		return nil, err
+	}
+	es := make([]streamEntry, len(res))
+	for i, r := range res {
+		j := i
+		if rev {
+			j = len(res) - 1 - i
+		}
+		if err = json.Unmarshal(r, &es[j]); err != nil {
+			return nil, err
+		}
+	}
+	return es, nil
+}
+
+// delStream removes a stream and its groups.
+func delStream(db *CaskDB.DB, key []byte) (bool, error) {
+	m, err := loadStream(db, key)
+	if err != nil || m == nil {
+		return false, err
+	}
+	for i := 0; i < m.Length && err == nil; i++ {
+		_, err = db.LPop(streamKey(key))
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, db.Remove(streamMetaKey(key))
+}
+
+// copyStream copies the entries and the groups of a stream.
+func copyStream(srcDB *CaskDB.DB, src []byte, dstDB *CaskDB.DB, dst []byte) error {
+	m, err := loadStream(srcDB, src)
+	if err != nil || m == nil {
+		return err
+	}
+	res, err := listAll(srcDB, streamKey(src))
+	if err == nil && len(res) > 0 {
+		err = dstDB.RPush(streamKey(dst), res...)
+	}
+	if err != nil {
+		return err
+	}
+	return saveStream(dstDB, dst, m)
+}
+
+// sendEntries replies with entries, one per line.
+func sendEntries(req kiface.IRequest, es []streamEntry) {
+	var res [][]byte
+	for _, e := range es {
+		res = append(res, e.format())
+	}
+	sendList(req, res)
+}
+
+// xAddID computes the id of a new entry from the id argument of XADD: * is
+// generated from the clock, ms-* gets the next sequence number of ms.
+func xAddID(b []byte, last streamID) (streamID, error) {
+	if string(b) == "*" {
+		id := streamID{uint64(nowMs()), 0}
+		if !last.less(id) {
+			var ok bool
+			if id, ok = last.next(); !ok {
+				return id, ErrStreamIDTooSmall
+			}
+		}
+		return id, nil
+	}
+	if strings.HasSuffix(string(b), "-*") {
+		ms, err := strconv.ParseUint(strings.TrimSuffix(string(b), "-*"), 10, 64)
+		if err != nil {
+			return streamID{}, ErrInvalidStreamID
+		}
+		id := streamID{ms, 0}
+		if ms == last.ms {
+			if last.seq == math.MaxUint64 {
+				return id, ErrStreamIDTooSmall
+			}
+			id.seq = last.seq + 1
+		}
+		if ms == 0 && id.seq == 0 {
+			id.seq = 1
+		}
+		if !last.less(id) {
+			return id, ErrStreamIDTooSmall
+		}
+		return id, nil
+	}
+	id, err := parseStreamID(b, 0)
+	if err != nil {
+		return id, err
+	}
+	if id == (streamID{}) {
+		return id, ErrStreamIDZero
+	}
+	if !last.less(id) {
+		return id, ErrStreamIDTooSmall
+	}
+	return id, nil
+}
+
+// trimStream drops the oldest entries until at most maxLen are left.
+func trimStream(db *CaskDB.DB, key []byte, m *streamMeta, maxLen int) error {
+	for ; m.Length > maxLen; m.Length-- {
+		if _, err := db.LPop(streamKey(key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// XAddRouter appends an entry to a stream:
+// XADD key [NOMKSTREAM] [MAXLEN [=|~] n] <*|id> field value [field value ...]
+// the MAXLEN trimming is always exact.
+type XAddRouter struct {
+	knet.BaseRouter
+}
+
+func (xar *XAddRouter) Handle(req kiface.IRequest) {
+	log.Println("handle XAdd")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	noMkStream, maxLen := false, -1
+	i := 1
+	var err error
+loop:
+	for ; i < len(c) && err == nil; i++ {
+		switch strings.ToLower(string(c[i])) {
+		case "nomkstream":
+			noMkStream = true
+		case "maxlen":
+			if i+1 < len(c) && (string(c[i+1]) == "=" || string(c[i+1]) == "~") {
+				i++
+			}
+			if i+1 >= len(c) {
+				err = ErrSyntax
+			} else if maxLen, err = strconv.Atoi(string(c[i+1])); err != nil || maxLen < 0 {
+				err = errors.New("ERR The MAXLEN argument must be >= 0.")
+			}
+			i++
+		default:
+			break loop
+		}
+	}
+	if err == nil && (i >= len(c) || (len(c)-i-1)%2 != 0 || len(c)-i-1 == 0) {
+		err = errors.New("ERR wrong number of arguments for 'xadd' command")
+	}
+
+	db := s.db(req)
+	var m *streamMeta
+	if err == nil {
+		m, err = loadStream(db, c[0])
+	}
+	if err == nil && m == nil && noMkStream {
+		if err = req.GetConnection().SendMessage(200, []byte("(nil)")); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	if err == nil && m == nil {
+		m = &streamMeta{LastID: streamID{}.String(), Groups: make(map[string]*streamGroup)}
+	}
+
+	var id streamID
+	if err == nil {
+		id, err = xAddID(c[i], m.lastID())
+	}
+	if err == nil {
+		e := streamEntry{ID: id.String()}
+		for _, f := range c[i+1:] {
+			e.Fields = append(e.Fields, string(f))
+		}
+		var v []byte
+		if v, err = json.Marshal(e); err == nil {
+			err = db.RPush(streamKey(c[0]), v)
+		}
+	}
+	if err == nil {
+		m.LastID = id.String()
+		m.Length++
+		if maxLen >= 0 {
+			err = trimStream(db, c[0], m, maxLen)
+		}
+	}
+	if err == nil {
+		err = saveStream(db, c[0], m)
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	if err = req.GetConnection().SendMessage(200, []byte(id.String())); err != nil {
+		log.Println(err)
+	}
+	s.wakeStreams(s.session(req.GetConnection()).db, streamKey(c[0]))
+}
+
+type XLenRouter struct {
+	knet.BaseRouter
+}
+
+func (xlr *XLenRouter) Handle(req kiface.IRequest) {
+	log.Println("handle XLen")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	m, err := loadStream(s.db(req), c[0])
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	n := 0
+	if m != nil {
+		n = m.Length
+	}
+	if err = req.GetConnection().SendMessage(200, []byte(strconv.Itoa(n))); err != nil {
+		log.Println(err)
+	}
+}
+
+// xRange serves XRANGE and XREVRANGE, the latter takes the end first.
+func xRange(req kiface.IRequest, rev bool) {
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	startArg, endArg := c[1], c[2]
+	if rev {
+		startArg, endArg = endArg, startArg
+	}
+	start, okStart, err := parseRangeID(startArg, true)
+	var end streamID
+	okEnd := true
+	if err == nil {
+		end, okEnd, err = parseRangeID(endArg, false)
+	}
+	count := -1
+	if err == nil && len(c) > 3 {
+		if len(c) != 5 || strings.ToLower(string(c[3])) != "count" {
+			err = ErrSyntax
+		} else if count, err = strconv.Atoi(string(c[4])); err != nil {
+			err = ErrNotInteger
+		}
+	}
+	var m *streamMeta
+	if err == nil {
+		m, err = loadStream(s.db(req), c[0])
+	}
+	var es []streamEntry
+	if err == nil && m != nil && okStart && okEnd {
+		es, err = streamRange(s.db(req), c[0], m.Length, start, end, count, rev)
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	sendEntries(req, es)
+}
+
+type XRangeRouter struct {
+	knet.BaseRouter
+}
+
+func (xrr *XRangeRouter) Handle(req kiface.IRequest) {
+	log.Println("handle XRange")
+	xRange(req, false)
+}
+
+type XRevRangeRouter struct {
+	knet.BaseRouter
+}
+
+func (xrrr *XRevRangeRouter) Handle(req kiface.IRequest) {
+	log.Println("handle XRevRange")
+	xRange(req, true)
+}
+
+// xReadArgs are the arguments of XREAD and XREADGROUP.
+type xReadArgs struct {
+	group, consumer string
+	count           int
+	block           time.Duration
+	blocking        bool
+	noAck           bool
+	keys, ids       [][]byte
+}
+
+// parseXRead parses [GROUP group consumer] [COUNT n] [BLOCK ms] [NOACK]
+// STREAMS key [key ...] id [id ...], group tells whether it is XREADGROUP.
+func parseXRead(c [][]byte, group bool) (xReadArgs, error) {
+	args := xReadArgs{count: -1}
+	name := "xread"
+	if group {
+		name = "xreadgroup"
+	}
+	for i := 0; i < len(c); i++ {
+		switch strings.ToLower(string(c[i])) {
+		case "group":
+			if !group || i+2 >= len(c) {
+				return args, ErrSyntax
+			}
+			args.group, args.consumer = string(c[i+1]), string(c[i+2])
+			i += 2
+		case "count":
+			if i+1 >= len(c) {
+				return args, ErrSyntax
+			}
+			n, err := strconv.Atoi(string(c[i+1]))
+			if err != nil {
+				return args, ErrNotInteger
+			}
+			if n > 0 {
+				args.count = n
+			}
+			i++
+		case "block":
+			if i+1 >= len(c) {
+				return args, ErrSyntax
+			}
+			ms, err := strconv.ParseInt(string(c[i+1]), 10, 64)
+			if err != nil {
+				return args, errors.New("ERR timeout is not an integer or out of range")
+			}
+			if ms < 0 {
+				return args, ErrNegativeTimeout
+			}
+			var ok bool
+			if args.block, ok = msDuration(ms); !ok {
+				return args, ErrTimeoutRange
+			}
+			args.blocking = true
+			i++
+		case "noack":
+			if !group {
+				return args, ErrSyntax
+			}
+			args.noAck = true
+		case "streams":
+			rest := c[i+1:]
+			if len(rest) == 0 || len(rest)%2 != 0 {
+				return args, fmt.Errorf("ERR Unbalanced '%s' list of streams: for each stream key an ID or '$' must be specified.", name)
+			}
+			args.keys, args.ids = rest[:len(rest)/2], rest[len(rest)/2:]
+			if group && args.group == "" {
+				return args, errors.New("ERR Missing GROUP option for XREADGROUP")
+			}
+			return args, nil
+		default:
+			return args, ErrSyntax
+		}
+	}
+	return args, ErrSyntax
+}
+
+// xReadKeys picks the stream keys following STREAMS.
+func xReadKeys(args [][]byte) [][]byte {
+	for i, a := range args {
+		if strings.ToLower(string(a)) == "streams" {
+			rest := args[i+1:]
+			return rest[:len(rest)/2]
+		}
+	}
+	return nil
+}
+
+// formatRead renders the entries read from each stream, one entry per line
+// prefixed with its stream key. It returns nil when nothing was read.
+func formatRead(keys [][]byte, read [][]streamEntry) []byte {
+	var res [][]byte
+	for i, es := range read {
+		for _, e := range es {
+			res = append(res, append(append(append([]byte{}, keys[i]...), ' '), e.format()...))
+		}
+	}
+	if len(res) == 0 {
+		return nil
+	}
+	b := strings.Builder{}
+	writeList(&b, res)
+	return []byte(b.String())
+}
+
+// blockStreams parks the connection until one of the streams of args gets
+// new entries, read then serves them. A read returning nothing leaves the
+// connection parked.
+func blockStreams(req kiface.IRequest, args xReadArgs, read func(db *CaskDB.DB) ([]byte, error)) {
+	var keys [][]byte
+	for _, key := range args.keys {
+		keys = append(keys, streamKey(key))
+	}
+	s.block(&waiter{
+		conn: req.GetConnection(),
+		db:   s.session(req.GetConnection()).db,
+		keys: keys,
+		serve: func(db *CaskDB.DB, key []byte) ([]byte, error) {
+			return read(db)
+		},
+	}, args.block)
+}
+
+// wakeStreams offers the entries added to a stream to the connections
+// blocked on it, in arrival order. Unlike popping a list, reading a stream
+// takes nothing away, so each waiter is served once per call. The ones
+// getting nothing, like the consumers of a group another consumer was just
+// served, stay parked. s.mu is held throughout so that no timeout fires
+// while a waiter is being served.
+func (s *Server) wakeStreams(dbIndex int, key []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	db := s.dbs[dbIndex]
+	ws := append([]*waiter{}, s.blocked[blockKey{db: dbIndex, key: string(key)}]...)
+	for _, w := range ws {
+		res, err := w.serve(db, key)
+		if err == nil && res == nil {
+			continue
+		}
+		s.unblockLocked(w)
+		if err != nil {
+			if err = w.conn.SendMessage(400, []byte(err.Error())); err != nil {
+				log.Println(err)
+			}
+		} else {
+			if err = w.conn.SendMessage(200, res); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// sendRead replies with what read returned, or nil.
+func sendRead(req kiface.IRequest, res []byte) {
+	if res == nil {
+		res = []byte("(nil)")
+	}
+	if err := req.GetConnection().SendMessage(200, res); err != nil {
+		log.Println(err)
+	}
+}
+
+// XReadRouter reads the entries following the given ids of one or more
+// streams, $ stands for the last id of a stream. With BLOCK it waits for new
+// entries when there are none, forever for BLOCK 0.
+type XReadRouter struct {
+	knet.BaseRouter
+}
+
+func (xrr *XReadRouter) keys(args [][]byte) [][]byte {
+	return xReadKeys(args)
+}
+
+func (xrr *XReadRouter) Handle(req kiface.IRequest) {
+	log.Println("handle XRead")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	args, err := parseXRead(c, false)
+	// the ids are resolved once so that blocking reads only see new entries
+	var after []streamID
+	for i := 0; i < len(args.ids) && err == nil; i++ {
+		var id streamID
+		if string(args.ids[i]) == "$" {
+			var m *streamMeta
+			if m, err = loadStream(s.db(req), args.keys[i]); err == nil && m != nil {
+				id = m.lastID()
+			}
+		} else {
+			id, err = parseStreamID(args.ids[i], 0)
+		}
+		after = append(after, id)
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	read := func(db *CaskDB.DB) ([]byte, error) {
+		var read [][]streamEntry
+		for i, key := range args.keys {
+			m, err := loadStream(db, key)
+			if err != nil {
+				return nil, err
+			}
+			var es []streamEntry
+			if start, ok := after[i].next(); ok && m != nil && !m.lastID().less(start) {
+				if es, err = streamRange(db, key, m.Length, start, maxStreamID, args.count, false); err != nil {
+					return nil, err
+				}
+			}
+			read = append(read, es)
+		}
+		return formatRead(args.keys, read), nil
+	}
+
+	res, err := read(s.db(req))
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	if res == nil && args.blocking {
+		blockStreams(req, args, read)
+		return
+	}
+	sendRead(req, res)
+}
+
+// groupOf loads the meta of a stream and one of its groups.
+func groupOf(db *CaskDB.DB, key []byte, group, cmd string) (*streamMeta, *streamGroup, error) {
+	m, err := loadStream(db, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if m == nil || m.Groups[group] == nil {
+		return nil, nil, fmt.Errorf("NOGROUP No such key '%s' or consumer group '%s' in %s", key, group, cmd)
+	}
+	return m, m.Groups[group], nil
+}
+
+// readGroup reads the entries of a stream for a consumer of a group: the
+// entries never delivered to the group for the id >, otherwise the entries
+// of the consumer pending after id.
+func readGroup(db *CaskDB.DB, key []byte, id []byte, args xReadArgs) ([]streamEntry, error) {
+	m, g, err := groupOf(db, key, args.group, "XREADGROUP with GROUP option")
+	if err != nil {
+		return nil, err
+	}
+	now := nowMs()
+	g.Consumers[args.consumer] = now
+
+	var res []streamEntry
+	if string(id) == ">" {
+		last, _ := parseStreamID([]byte(g.LastID), 0)
+		if start, ok := last.next(); ok && !m.lastID().less(start) {
+			if res, err = streamRange(db, key, m.Length, start, maxStreamID, args.count, false); err != nil {
+				return nil, err
+			}
+		}
+		for _, e := range res {
+			g.LastID = e.ID
+			if !args.noAck {
+				g.Pending[e.ID] = &pendingEntry{Consumer: args.consumer, Delivered: now, Count: 1}
+			}
+		}
+	} else {
+		after, err := parseStreamID(id, 0)
+		if err != nil {
+			return nil, err
+		}
+		// entries trimmed away are still listed as pending
+		var ids []streamID
+		for pid, p := range g.Pending {
+			if p.Consumer != args.consumer {
+				continue
+			}
+			if i, _ := parseStreamID([]byte(pid), 0); after.less(i) {
+				ids = append(ids, i)
+			}
+		}
+		sort.Slice(ids, func(i, j int) bool {
+			return ids[i].less(ids[j])
+		})
+		for _, i := range ids {
+			if args.count >= 0 && len(res) == args.count {
+				break
+			}
+			e := streamEntry{ID: i.String()}
+			found, err := streamRange(db, key, m.Length, i, i, 1, false)
+			if err != nil {
+				return nil, err
+			}
+			if len(found) == 1 {
+				e = found[0]
+			}
+			res = append(res, e)
+		}
+	}
+	return res, saveStream(db, key, m)
+}
+
+// XReadGroupRouter reads streams on behalf of a consumer of a group, the
+// entries delivered are pending until acknowledged by XACK unless NOACK.
+type XReadGroupRouter struct {
+	knet.BaseRouter
+}
+
+func (xrgr *XReadGroupRouter) keys(args [][]byte) [][]byte {
+	return xReadKeys(args)
+}
+
+func (xrgr *XReadGroupRouter) Handle(req kiface.IRequest) {
+	log.Println("handle XReadGroup")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	args, err := parseXRead(c, true)
+	// check the groups up front, they may not vanish while blocked
+	for i := 0; i < len(args.keys) && err == nil; i++ {
+		_, _, err = groupOf(s.db(req), args.keys[i], args.group, "XREADGROUP with GROUP option")
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	history := false
+	read := func(db *CaskDB.DB) ([]byte, error) {
+		var read [][]streamEntry
+		for i, key := range args.keys {
+			es, err := readGroup(db, key, args.ids[i], args)
+			if err != nil {
+				return nil, err
+			}
+			if string(args.ids[i]) != ">" {
+				history = true
+			}
+			read = append(read, es)
+		}
+		return formatRead(args.keys, read), nil
+	}
+
+	res, err := read(s.db(req))
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	// only reads of new entries block
+	if res == nil && args.blocking && !history {
+		blockStreams(req, args, read)
+		return
+	}
+	sendRead(req, res)
+}
+
+// XGroupRouter manages the consumer groups of a stream:
+// XGROUP CREATE key group <id|$> [MKSTREAM]
+// XGROUP SETID key group <id|$>
+// XGROUP DESTROY key group
+// XGROUP CREATECONSUMER key group consumer
+// XGROUP DELCONSUMER key group consumer
+type XGroupRouter struct {
+	knet.BaseRouter
+}
+
+func (xgr *XGroupRouter) Handle(req kiface.IRequest) {
+	log.Println("handle XGroup")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	res, err := xGroup(s.db(req), strings.ToLower(string(c[0])), c[1], string(c[2]), c[3:])
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, res); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func xGroup(db *CaskDB.DB, sub string, key []byte, group string, args [][]byte) ([]byte, error) {
+	m, err := loadStream(db, key)
+	if err != nil {
+		return nil, err
+	}
+
+	// resolves the id argument of CREATE and SETID
+	groupID := func() (string, error) {
+		if len(args) == 0 {
+			return "", ErrSyntax
+		}
+		if string(args[0]) == "$" {
+			return m.LastID, nil
+		}
+		id, err := parseStreamID(args[0], 0)
+		return id.String(), err
+	}
+
+	if sub == "create" {
+		mkStream := len(args) == 2 && strings.ToLower(string(args[1])) == "mkstream"
+		if len(args) != 1 && !mkStream {
+			return nil, ErrSyntax
+		}
+		if m == nil && !mkStream {
+			return nil, ErrNoStream
+		}
+		if m == nil {
+			m = &streamMeta{LastID: streamID{}.String(), Groups: make(map[string]*streamGroup)}
+		}
+		if m.Groups[group] != nil {
+			return nil, ErrBusyGroup
+		}
+		id, err := groupID()
+		if err != nil {
+			return nil, err
+		}
+		m.Groups[group] = &streamGroup{LastID: id, Pending: make(map[string]*pendingEntry), Consumers: make(map[string]int64)}
+		return []byte("\"OK\""), saveStream(db, key, m)
+	}
+
+	if m == nil {
+		return nil, ErrNoStream
+	}
+	g := m.Groups[group]
+	if g == nil && sub != "destroy" {
+		return nil, fmt.Errorf("NOGROUP No such consumer group '%s' for key name '%s'", group, key)
+	}
+	var res []byte
+	switch sub {
+	case "setid":
+		if len(args) != 1 {
+			return nil, ErrSyntax
+		}
+		id, err := groupID()
+		if err != nil {
+			return nil, err
+		}
+		g.LastID = id
+		res = []byte("\"OK\"")
+	case "destroy":
+		if len(args) != 0 {
+			return nil, ErrSyntax
+		}
+		if g == nil {
+			return []byte("false"), nil
+		}
+		delete(m.Groups, group)
+		res = []byte("true")
+	case "createconsumer":
+		if len(args) != 1 {
+			return nil, ErrSyntax
+		}
+		_, ok := g.Consumers[string(args[0])]
+		if !ok {
+			g.Consumers[string(args[0])] = nowMs()
+		}
+		res = []byte(strconv.FormatBool(!ok))
+	case "delconsumer":
+		// the entries pending for the consumer are dropped with it
+		if len(args) != 1 {
+			return nil, ErrSyntax
+		}
+		n := 0
+		for id, p := range g.Pending {
+			if p.Consumer == string(args[0]) {
+				delete(g.Pending, id)
+				n++
+			}
+		}
+		delete(g.Consumers, string(args[0]))
+		res = []byte(strconv.Itoa(n))
+	default:
+		return nil, fmt.Errorf("ERR unknown subcommand '%s'", sub)
+	}
+	return res, saveStream(db, key, m)
+}
+
+// XAckRouter acknowledges entries delivered to a group, removing them from
+// its pending entries.
+type XAckRouter struct {
+	knet.BaseRouter
+}
+
+func (xar *XAckRouter) Handle(req kiface.IRequest) {
+	log.Println("handle XAck")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	db := s.db(req)
+	n := 0
+	m, err := loadStream(db, c[0])
+	if err == nil && m != nil && m.Groups[string(c[1])] != nil {
+		g := m.Groups[string(c[1])]
+		for i := 2; i < len(c) && err == nil; i++ {
+			var id streamID
+			if id, err = parseStreamID(c[i], 0); err == nil && g.Pending[id.String()] != nil {
+				delete(g.Pending, id.String())
+				n++
+			}
+		}
+		if err == nil {
+			err = saveStream(db, c[0], m)
+		}
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte(strconv.Itoa(n))); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// pendingIDs lists the pending entries of a group in id order.
+func pendingIDs(g *streamGroup) []streamID {
+	var ids []streamID
+	for pid := range g.Pending {
+		id, _ := parseStreamID([]byte(pid), 0)
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i].less(ids[j])
+	})
+	return ids
+}
+
+// XPendingRouter inspects the pending entries of a group. The summary form
+// replies with their count, smallest and greatest ids followed by the count
+// of each consumer, the extended form
+// XPENDING key group [IDLE min-idle] start end count [consumer]
+// replies with the id, consumer, idle milliseconds and deliveries of each.
+type XPendingRouter struct {
+	knet.BaseRouter
+}
+
+func (xpr *XPendingRouter) Handle(req kiface.IRequest) {
+	log.Println("handle XPending")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	_, g, err := groupOf(s.db(req), c[0], string(c[1]), "XPENDING")
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	ids := pendingIDs(g)
+
+	if len(c) == 2 {
+		if len(ids) == 0 {
+			sendList(req, [][]byte{[]byte("0"), nil, nil})
+			return
+		}
+		counts := make(map[string]int)
+		for _, p := range g.Pending {
+			counts[p.Consumer]++
+		}
+		var consumers []string
+		for name := range counts {
+			consumers = append(consumers, name)
+		}
+		sort.Strings(consumers)
+		res := [][]byte{[]byte(strconv.Itoa(len(ids))), []byte(ids[0].String()), []byte(ids[len(ids)-1].String())}
+		for _, name := range consumers {
+			res = append(res, []byte(name+" "+strconv.Itoa(counts[name])))
+		}
+		sendList(req, res)
+		return
+	}
+
+	args := c[2:]
+	var minIdle int64
+	if len(args) > 0 && strings.ToLower(string(args[0])) == "idle" {
+		if len(args) < 2 {
+			err = ErrSyntax
+		} else if minIdle, err = strconv.ParseInt(string(args[1]), 10, 64); err != nil {
+			err = ErrNotInteger
+		}
+		args = args[2:]
+	}
+	if err == nil && len(args) != 3 && len(args) != 4 {
+		err = ErrSyntax
+	}
+	var start, end streamID
+	okStart, okEnd := true, true
+	count := 0
+	if err == nil {
+		start, okStart, err = parseRangeID(args[0], true)
+	}
+	if err == nil {
+		end, okEnd, err = parseRangeID(args[1], false)
+	}
+	if err == nil {
+		if count, err = strconv.Atoi(string(args[2])); err != nil {
+			err = ErrNotInteger
+		}
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	now := nowMs()
+	var res [][]byte
+	for _, id := range ids {
+		if !okStart || !okEnd || len(res) >= count {
+			break
+		}
+		if id.less(start) || end.less(id) {
+			continue
+		}
+		p := g.Pending[id.String()]
+		if len(args) == 4 && p.Consumer != string(args[3]) || now-p.Delivered < minIdle {
+			continue
+		}
+		res = append(res, []byte(fmt.Sprintf("%s %s %d %d", id, p.Consumer, now-p.Delivered, p.Count)))
+	}
+	sendList(req, res)
+}
+
+// XClaimRouter hands pending entries idle for at least min-idle
+// milliseconds over to another consumer of the group:
+// XCLAIM key group consumer min-idle id [id ...] [JUSTID]
+// JUSTID replies with the ids only and does not count a delivery.
+type XClaimRouter struct {
+	knet.BaseRouter
+}
+
+func (xcr *XClaimRouter) Handle(req kiface.IRequest) {
+	log.Println("handle XClaim")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	db := s.db(req)
+	m, g, err := groupOf(db, c[0], string(c[1]), "XCLAIM")
+	var minIdle int64
+	if err == nil {
+		if minIdle, err = strconv.ParseInt(string(c[3]), 10, 64); err != nil {
+			err = errors.New("ERR Invalid min-idle-time argument for XCLAIM")
+		}
+	}
+	idArgs := c[4:]
+	justID := false
+	if err == nil && strings.ToLower(string(idArgs[len(idArgs)-1])) == "justid" {
+		justID = true
+		idArgs = idArgs[:len(idArgs)-1]
+	}
+	var ids []streamID
+	for i := 0; i < len(idArgs) && err == nil; i++ {
+		var id streamID
+		if id, err = parseStreamID(idArgs[i], 0); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	now := nowMs()
+	consumer := string(c[2])
+	g.Consumers[consumer] = now
+	var claimed []streamEntry
+	for _, id := range ids {
+		p := g.Pending[id.String()]
+		if p == nil || now-p.Delivered < minIdle {
+			continue
+		}
+		// entries trimmed away are not pending anymore
+		var found []streamEntry
+		if found, err = streamRange(db, c[0], m.Length, id, id, 1, false); err != nil {
+			break
+		}
+		if len(found) == 0 {
+			delete(g.Pending, id.String())
+			continue
+		}
+		p.Consumer, p.Delivered = consumer, now
+		if !justID {
+			p.Count++
+		}
+		claimed = append(claimed, found[0])
+	}
+	if err == nil {
+		err = saveStream(db, c[0], m)
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	if justID {
+		var res [][]byte
+		for _, e := range claimed {
+			res = append(res, []byte(e.ID))
+		}
+		sendList(req, res)
+		return
+	}
+	sendEntries(req, claimed)
+}
@@ -0,0 +1,632 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/k-si/CaskDB"
+	"github.com/k-si/Kinx/kiface"
+	"github.com/k-si/Kinx/knet"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrTSExists      = errors.New("ERR TSDB: key already exists")
+	ErrTSNoKey       = errors.New("ERR TSDB: the key does not exist")
+	ErrTSTimestamp   = errors.New("ERR TSDB: invalid timestamp")
+	ErrTSValue       = errors.New("ERR TSDB: invalid value")
+	ErrTSRetention   = errors.New("ERR TSDB: invalid retention time")
+	ErrTSOld         = errors.New("ERR TSDB: Timestamp is older than retention")
+	ErrTSAggregation = errors.New("ERR TSDB: unknown aggregation type")
+	ErrTSBucket      = errors.New("ERR TSDB: invalid bucket duration")
+	ErrTSRule        = errors.New("ERR TSDB: the destination key already has a rule")
+	ErrTSNoRule      = errors.New("ERR TSDB: compaction rule does not exist")
+	ErrTSSameKey     = errors.New("ERR TSDB: the source key and destination key should be different")
+)
+
+// A time series is kept in two internal keys: a sorted set of samples
+// scored with their timestamp in milliseconds, whose members are
+// "timestamp:value" so that a timestamp holds a single sample, and a string
+// holding the json encoded tsMeta. The meta key exists for as long as the
+// series does, even when it has no samples.
+const (
+	tsPrefix     = internalPrefix + "ts:"
+	tsMetaPrefix = internalPrefix + "ts-meta:"
+)
+
+func tsKey(key []byte) []byte {
+	return []byte(tsPrefix + string(key))
+}
+
+func tsMetaKey(key []byte) []byte {
+	return []byte(tsMetaPrefix + string(key))
+}
+
+// tsRule downsamples a series into Dest, aggregating the samples of each
+// bucket of Bucket milliseconds.
+type tsRule struct {
+	Dest        string `json:"dest"`
+	Aggregation string `json:"aggregation"`
+	Bucket      int64  `json:"bucket"`
+}
+
+// tsMeta is the configuration of a series, a zero Retention keeps the
+// samples forever. Source is the series compacting into this one, if any.
+// Last is the timestamp of the newest sample, or -1, kept here so that
+// adding a sample reads none.
+type tsMeta struct {
+	Retention int64    `json:"retention"`
+	Rules     []tsRule `json:"rules"`
+	Source    string   `json:"source,omitempty"`
+	Last      int64    `json:"last"`
+}
+
+func newTSMeta(retention int64) *tsMeta {
+	return &tsMeta{Retention: retention, Last: -1}
+}
+
+type tsSample struct {
+	ts    int64
+	value float64
+}
+
+func (sample tsSample) member() []byte {
+	return []byte(strconv.FormatInt(sample.ts, 10) + ":" + formatValue(sample.value))
+}
+
+func (sample tsSample) format() []byte {
+	return []byte(strconv.FormatInt(sample.ts, 10) + " " + formatValue(sample.value))
+}
+
+func formatValue(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// loadTS reads the meta of a series, or nil if it does not exist.
+func loadTS(db *CaskDB.DB, key []byte) (*tsMeta, error) {
+	v, err := db.Get(tsMetaKey(key))
+	if err != nil || len(v) == 0 {
+		return nil, err
+	}
+	m := &tsMeta{}
+	if err = json.Unmarshal(v, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func saveTS(db *CaskDB.DB, key []byte, m *tsMeta) error {
+	v, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return db.Set(tsMetaKey(key), v)
+}
+
+// tsSamples reads the samples of a series between from and to, in
+// timestamp order.
+func tsSamples(db *CaskDB.DB, key []byte, from, to int64) ([]tsSample, error) {
+	res, err := db.ZScoreRange(tsKey(key), float64(from), float64(to))
+	if err != nil {
+		return nil, err
+	}
+	// the reply alternates members and scores
+	var samples []tsSample
+	for i := 0; i+1 < len(res); i += 2 {
+		member := res[i].(string)
+		v, err := strconv.ParseFloat(member[strings.IndexByte(member, ':')+1:], 64)
+		if err != nil {
+			return nil, err
+		}
+		samples = append(samples, tsSample{int64(res[i+1].(float64)), v})
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i].ts < samples[j].ts
+	})
+	return samples, nil
+}
+
+// removeSamples removes the samples of a series between from and to.
+func removeSamples(db *CaskDB.DB, key []byte, from, to int64) error {
+	samples, err := tsSamples(db, key, from, to)
+	for i := 0; i < len(samples) && err == nil; i++ {
+		err = db.ZRem(tsKey(key), samples[i].member())
+	}
+	return err
+}
+
+// putSample stores a sample, replacing the one at the same timestamp, then
+// drops the samples the retention of the series no longer keeps. The meta is
+// saved when the sample is the newest.
+func putSample(db *CaskDB.DB, key []byte, m *tsMeta, sample tsSample) error {
+	if m.Retention > 0 && m.Last >= 0 && sample.ts < m.Last-m.Retention {
+		return ErrTSOld
+	}
+	if err := removeSamples(db, key, sample.ts, sample.ts); err != nil {
+		return err
+	}
+	if err := db.ZAdd(tsKey(key), float64(sample.ts), sample.member()); err != nil {
+		return err
+	}
+	if sample.ts <= m.Last {
+		return nil
+	}
+	m.Last = sample.ts
+	if m.Retention > 0 {
+		if err := removeSamples(db, key, 0, sample.ts-m.Retention-1); err != nil {
+			return err
+		}
+	}
+	return saveTS(db, key, m)
+}
+
+// delTS removes a series, reporting whether it existed.
+func delTS(db *CaskDB.DB, key []byte) (bool, error) {
+	m, err := loadTS(db, key)
+	if err != nil || m == nil {
+		return false, err
+	}
+	if err = removeSamples(db, key, 0, math.MaxInt64); err != nil {
+		return false, err
+	}
+	// the rules from and to the series go with it
+	for _, rule := range m.Rules {
+		if err = unlinkRule(db, []byte(rule.Dest), key); err != nil {
+			return false, err
+		}
+	}
+	if m.Source != "" {
+		var sm *tsMeta
+		if sm, err = loadTS(db, []byte(m.Source)); err == nil && sm != nil {
+			sm.Rules = removeRule(sm.Rules, string(key))
+			err = saveTS(db, []byte(m.Source), sm)
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, db.Remove(tsMetaKey(key))
+}
+
+// copyTS copies the samples and the retention of a series, the compaction
+// rules stay with the source.
+func copyTS(srcDB *CaskDB.DB, src []byte, dstDB *CaskDB.DB, dst []byte) error {
+	m, err := loadTS(srcDB, src)
+	if err != nil || m == nil {
+		return err
+	}
+	samples, err := tsSamples(srcDB, src, 0, math.MaxInt64)
+	for i := 0; i < len(samples) && err == nil; i++ {
+		err = dstDB.ZAdd(tsKey(dst), float64(samples[i].ts), samples[i].member())
+	}
+	if err != nil {
+		return err
+	}
+	dm := newTSMeta(m.Retention)
+	dm.Last = m.Last
+	return saveTS(dstDB, dst, dm)
+}
+
+// aggregate reduces the values of a bucket.
+func aggregate(agg string, samples []tsSample) float64 {
+	res := samples[0].value
+	for _, sample := range samples[1:] {
+		switch agg {
+		case "min":
+			res = math.Min(res, sample.value)
+		case "max":
+			res = math.Max(res, sample.value)
+		case "sum", "avg":
+			res += sample.value
+		}
+	}
+	switch agg {
+	case "avg":
+		res /= float64(len(samples))
+	case "count":
+		res = float64(len(samples))
+	}
+	return res
+}
+
+func parseAggregation(aggArg, bucketArg []byte) (string, int64, error) {
+	agg := strings.ToLower(string(aggArg))
+	switch agg {
+	case "avg", "min", "max", "sum", "count":
+	default:
+		return "", 0, ErrTSAggregation
+	}
+	bucket, err := strconv.ParseInt(string(bucketArg), 10, 64)
+	if err != nil || bucket <= 0 {
+		return "", 0, ErrTSBucket
+	}
+	return agg, bucket, nil
+}
+
+// downsample aggregates samples in timestamp order by buckets aligned on
+// the epoch, each bucket is timestamped with its start.
+func downsample(samples []tsSample, agg string, bucket int64) []tsSample {
+	var res []tsSample
+	for i := 0; i < len(samples); {
+		start := samples[i].ts - samples[i].ts%bucket
+		j := i
+		for j < len(samples) && samples[j].ts < start+bucket {
+			j++
+		}
+		res = append(res, tsSample{start, aggregate(agg, samples[i:j])})
+		i = j
+	}
+	return res
+}
+
+// compact applies the rules of a series for a new sample at ts: the bucket
+// holding it is aggregated again into each destination. Destinations do not
+// apply their own rules.
+func compact(db *CaskDB.DB, m *tsMeta, key []byte, ts int64) error {
+	for _, rule := range m.Rules {
+		dm, err := loadTS(db, []byte(rule.Dest))
+		if err != nil {
+			return err
+		}
+		if dm == nil {
+			continue
+		}
+		start := ts - ts%rule.Bucket
+		samples, err := tsSamples(db, key, start, start+rule.Bucket-1)
+		if err != nil {
+			return err
+		}
+		if len(samples) == 0 {
+			continue
+		}
+		err = putSample(db, []byte(rule.Dest), dm, tsSample{start, aggregate(rule.Aggregation, samples)})
+		if err != nil && err != ErrTSOld {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseRetention(b []byte) (int64, error) {
+	retention, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil || retention < 0 {
+		return 0, ErrTSRetention
+	}
+	return retention, nil
+}
+
+// TSCreateRouter creates an empty series: TS.CREATE key [RETENTION ms]
+type TSCreateRouter struct {
+	knet.BaseRouter
+}
+
+func (tscr *TSCreateRouter) Handle(req kiface.IRequest) {
+	log.Println("handle TSCreate")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	db := s.db(req)
+	m := newTSMeta(0)
+	var err error
+	for i := 1; i < len(c) && err == nil; i += 2 {
+		if strings.ToLower(string(c[i])) != "retention" || i+1 >= len(c) {
+			err = ErrSyntax
+		} else {
+			m.Retention, err = parseRetention(c[i+1])
+		}
+	}
+	var old *tsMeta
+	if err == nil {
+		old, err = loadTS(db, c[0])
+	}
+	if err == nil && old != nil {
+		err = ErrTSExists
+	}
+	if err == nil {
+		err = saveTS(db, c[0], m)
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte("\"OK\"")); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// TSAddRouter adds a sample: TS.ADD key timestamp|* value [RETENTION ms]
+// the series is created when it does not exist, with the retention given.
+// A sample replaces the one at the same timestamp.
+type TSAddRouter struct {
+	knet.BaseRouter
+}
+
+func (tsar *TSAddRouter) Handle(req kiface.IRequest) {
+	log.Println("handle TSAdd")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	db := s.db(req)
+	var sample tsSample
+	var err error
+	if string(c[1]) == "*" {
+		sample.ts = nowMs()
+	} else if sample.ts, err = strconv.ParseInt(string(c[1]), 10, 64); err != nil || sample.ts < 0 {
+		err = ErrTSTimestamp
+	}
+	if err == nil {
+		sample.value, err = strconv.ParseFloat(string(c[2]), 64)
+		if err != nil || math.IsNaN(sample.value) || math.IsInf(sample.value, 0) {
+			err = ErrTSValue
+		}
+	}
+	retention, hasRetention := int64(0), false
+	for i := 3; i < len(c) && err == nil; i += 2 {
+		if strings.ToLower(string(c[i])) != "retention" || i+1 >= len(c) {
+			err = ErrSyntax
+		} else {
+			retention, err = parseRetention(c[i+1])
+			hasRetention = true
+		}
+	}
+
+	var m *tsMeta
+	if err == nil {
+		m, err = loadTS(db, c[0])
+	}
+	if err == nil && m == nil {
+		m = newTSMeta(retention)
+		err = saveTS(db, c[0], m)
+	} else if err == nil && hasRetention && m.Retention != retention {
+		m.Retention = retention
+		err = saveTS(db, c[0], m)
+	}
+	if err == nil {
+		err = putSample(db, c[0], m, sample)
+	}
+	if err == nil {
+		err = compact(db, m, c[0], sample.ts)
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte(strconv.FormatInt(sample.ts, 10))); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// TSRangeRouter replies with the samples between two timestamps:
+// TS.RANGE key from|- to|+ [AGGREGATION avg|min|max|sum|count bucket] [COUNT n]
+// one "timestamp value" per line, aggregated by buckets when asked.
+type TSRangeRouter struct {
+	knet.BaseRouter
+}
+
+func (tsrr *TSRangeRouter) Handle(req kiface.IRequest) {
+	log.Println("handle TSRange")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	db := s.db(req)
+	from, to := int64(0), int64(math.MaxInt64)
+	var err error
+	if string(c[1]) != "-" {
+		if from, err = strconv.ParseInt(string(c[1]), 10, 64); err != nil {
+			err = ErrTSTimestamp
+		}
+	}
+	if err == nil && string(c[2]) != "+" {
+		if to, err = strconv.ParseInt(string(c[2]), 10, 64); err != nil {
+			err = ErrTSTimestamp
+		}
+	}
+	agg, bucket, count := "", int64(0), -1
+	for i := 3; i < len(c) && err == nil; i++ {
+		switch strings.ToLower(string(c[i])) {
+		case "aggregation":
+			if i+2 >= len(c) {
+				err = ErrSyntax
+			} else {
+				agg, bucket, err = parseAggregation(c[i+1], c[i+2])
+			}
+			i += 2
+		case "count":
+			if i+1 >= len(c) {
+				err = ErrSyntax
+			} else if count, err = strconv.Atoi(string(c[i+1])); err != nil || count < 0 {
+				err = ErrNotInteger
+			}
+			i++
+		default:
+			err = ErrSyntax
+		}
+	}
+
+	var m *tsMeta
+	if err == nil {
+		m, err = loadTS(db, c[0])
+	}
+	if err == nil && m == nil {
+		err = ErrTSNoKey
+	}
+	var samples []tsSample
+	if err == nil {
+		samples, err = tsSamples(db, c[0], from, to)
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	if agg != "" {
+		samples = downsample(samples, agg, bucket)
+	}
+	if count >= 0 && count < len(samples) {
+		samples = samples[:count]
+	}
+	var res [][]byte
+	for _, sample := range samples {
+		res = append(res, sample.format())
+	}
+	sendList(req, res)
+}
+
+// TSCreateRuleRouter adds a compaction rule from a series to another:
+// TS.CREATERULE source dest AGGREGATION avg|min|max|sum|count bucket
+// a series is the destination of a single rule.
+type TSCreateRuleRouter struct {
+	knet.BaseRouter
+}
+
+func (tscrr *TSCreateRuleRouter) Handle(req kiface.IRequest) {
+	log.Println("handle TSCreateRule")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	db := s.db(req)
+	var rule tsRule
+	var err error
+	if len(c) != 5 || strings.ToLower(string(c[2])) != "aggregation" {
+		err = ErrSyntax
+	} else if string(c[0]) == string(c[1]) {
+		err = ErrTSSameKey
+	} else {
+		rule.Dest = string(c[1])
+		rule.Aggregation, rule.Bucket, err = parseAggregation(c[3], c[4])
+	}
+	var m, dm *tsMeta
+	if err == nil {
+		m, err = loadTS(db, c[0])
+	}
+	if err == nil {
+		dm, err = loadTS(db, c[1])
+	}
+	if err == nil && (m == nil || dm == nil) {
+		err = ErrTSNoKey
+	}
+	if err == nil && dm.Source != "" {
+		err = ErrTSRule
+	}
+	if err == nil {
+		m.Rules = append(m.Rules, rule)
+		dm.Source = string(c[0])
+		if err = saveTS(db, c[0], m); err == nil {
+			err = saveTS(db, c[1], dm)
+		}
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte("\"OK\"")); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// removeRule removes the rule compacting into dest from rules.
+func removeRule(rules []tsRule, dest string) []tsRule {
+	var res []tsRule
+	for _, rule := range rules {
+		if rule.Dest != dest {
+			res = append(res, rule)
+		}
+	}
+	return res
+}
+
+// unlinkRule forgets the source of dest, if it is still source.
+func unlinkRule(db *CaskDB.DB, dest, source []byte) error {
+	dm, err := loadTS(db, dest)
+	if err != nil || dm == nil || dm.Source != string(source) {
+		return err
+	}
+	dm.Source = ""
+	return saveTS(db, dest, dm)
+}
+
+// TSDeleteRuleRouter removes a compaction rule: TS.DELETERULE source dest
+type TSDeleteRuleRouter struct {
+	knet.BaseRouter
+}
+
+func (tsdrr *TSDeleteRuleRouter) Handle(req kiface.IRequest) {
+	log.Println("handle TSDeleteRule")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	db := s.db(req)
+	m, err := loadTS(db, c[0])
+	if err == nil && m == nil {
+		err = ErrTSNoKey
+	}
+	if err == nil {
+		rules := removeRule(m.Rules, string(c[1]))
+		if len(rules) == len(m.Rules) {
+			err = ErrTSNoRule
+		} else {
+			m.Rules = rules
+			err = saveTS(db, c[0], m)
+		}
+	}
+	if err == nil {
+		err = unlinkRule(db, c[1], c[0])
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte("\"OK\"")); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// TSInfoRouter replies with the samples count, the first and last
+// timestamps, the retention and the compaction rules of a series.
+type TSInfoRouter struct {
+	knet.BaseRouter
+}
+
+func (tsir *TSInfoRouter) Handle(req kiface.IRequest) {
+	log.Println("handle TSInfo")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	db := s.db(req)
+	m, err := loadTS(db, c[0])
+	if err == nil && m == nil {
+		err = ErrTSNoKey
+	}
+	var samples []tsSample
+	if err == nil {
+		samples, err = tsSamples(db, c[0], 0, math.MaxInt64)
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	first, last := int64(0), int64(0)
+	if len(samples) > 0 {
+		first, last = samples[0].ts, samples[len(samples)-1].ts
+	}
+	res := [][]byte{
+		[]byte("totalSamples " + strconv.Itoa(len(samples))),
+		[]byte("firstTimestamp " + strconv.FormatInt(first, 10)),
+		[]byte("lastTimestamp " + strconv.FormatInt(last, 10)),
+		[]byte("retentionTime " + strconv.FormatInt(m.Retention, 10)),
+	}
+	for _, rule := range m.Rules {
+		res = append(res, []byte("rule "+rule.Dest+" "+rule.Aggregation+" "+strconv.FormatInt(rule.Bucket, 10)))
+	}
+	sendList(req, res)
+}
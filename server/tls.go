@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+const tlsHandshakeTimeout = 10 * time.Second
+
+// loadTLSConfig builds the server tls config, client certificates are
+// required and verified when a client CA is configured.
+func loadTLSConfig(cfg ServerConfig) (*tls.Config, error) {
+	if cfg.TLSCertFile == "" || cfg.TLSKeyFile == "" {
+		return nil, errors.New("tls_cert_file and tls_key_file are required by tls_port")
+	}
+	cert, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsCfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if cfg.TLSCACertFile != "" {
+		pem, err := ioutil.ReadFile(cfg.TLSCACertFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", cfg.TLSCACertFile)
+		}
+		tlsCfg.ClientCAs = pool
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsCfg, nil
+}
+
+// TLSProxy terminates tls connections and forwards the plaintext stream to
+// the tcp server, which only listens on the loopback address then.
+type TLSProxy struct {
+	listener net.Listener
+	backend  string
+}
+
+func NewTLSProxy(cfg ServerConfig, backend string) (*TLSProxy, error) {
+	tlsCfg, err := loadTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	addr := net.JoinHostPort(cfg.Host, strconv.Itoa(cfg.TLSPort))
+	l, err := tls.Listen(cfg.IPVersion, addr, tlsCfg)
+	if err != nil {
+		return nil, err
+	}
+	return &TLSProxy{listener: l, backend: backend}, nil
+}
+
+func (p *TLSProxy) Serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			log.Println("tls accept err:", err)
+			return
+		}
+		go p.forward(conn.(*tls.Conn))
+	}
+}
+
+func (p *TLSProxy) Close() error {
+	return p.listener.Close()
+}
+
+func (p *TLSProxy) forward(conn *tls.Conn) {
+	defer conn.Close()
+
+	// reject clients failing the handshake before dialing the backend
+	conn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := conn.Handshake(); err != nil {
+		log.Println("tls handshake err:", err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	backend, err := net.Dial("tcp", p.backend)
+	if err != nil {
+		log.Println("tls backend err:", err)
+		return
+	}
+	defer backend.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(backend, conn)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, backend)
+		done <- struct{}{}
+	}()
+	// either side closing ends the forwarding
+	<-done
+}
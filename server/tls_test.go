@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate generated for the test, signed by parent or
+// self signed when parent is nil.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, name string, parent *testCert, isCA bool, usage x509.ExtKeyUsage) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+		tmpl.DNSNames = []string{"localhost"}
+		tmpl.IPAddresses = []net.IP{net.ParseIP("127.0.0.1")}
+	}
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write saves the certificate and its key as pem files in dir.
+func (c *testCert) write(t *testing.T, dir, name string) (string, string) {
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func (c *testCert) pair() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key, Leaf: c.cert}
+}
+
+// echoServer stands for the tcp server behind the proxy.
+func echoServer(t *testing.T) string {
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// startProxy runs a tls proxy on a random loopback port in front of an
+// echo server.
+func startProxy(t *testing.T, cfg ServerConfig) string {
+	cfg.Host, cfg.TLSPort, cfg.IPVersion = "127.0.0.1", 0, "tcp4"
+	p, err := NewTLSProxy(cfg, echoServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	go p.Serve()
+	return p.listener.Addr().String()
+}
+
+// echo sends a message through the proxy and reads it back.
+func echo(addr string, cfg *tls.Config) error {
+	conn, err := tls.Dial("tcp4", addr, cfg)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	msg := []byte("ping")
+	if _, err = conn.Write(msg); err != nil {
+		return err
+	}
+	buf := make([]byte, len(msg))
+	if _, err = io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if string(buf) != string(msg) {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
+func TestTLSProxy(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil, true, 0)
+	srvFile, srvKeyFile := newTestCert(t, "server", ca, false, x509.ExtKeyUsageServerAuth).write(t, dir, "server")
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	addr := startProxy(t, ServerConfig{TLSCertFile: srvFile, TLSKeyFile: srvKeyFile})
+	if err := echo(addr, &tls.Config{RootCAs: roots, ServerName: "localhost"}); err != nil {
+		t.Errorf("tls: %v", err)
+	}
+	if err := echo(addr, &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"}); err != nil {
+		t.Errorf("tls by ip: %v", err)
+	}
+	// the client does not trust a server it has no CA for
+	if err := echo(addr, &tls.Config{ServerName: "localhost"}); err == nil {
+		t.Error("tls without the server CA: connected")
+	}
+	// nor a server name the certificate is not for
+	if err := echo(addr, &tls.Config{RootCAs: roots, ServerName: "caskdb.example"}); err == nil {
+		t.Error("tls with a wrong server name: connected")
+	}
+}
+
+func TestMutualTLSProxy(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil, true, 0)
+	caFile, _ := ca.write(t, dir, "ca")
+	srvFile, srvKeyFile := newTestCert(t, "server", ca, false, x509.ExtKeyUsageServerAuth).write(t, dir, "server")
+	client := newTestCert(t, "client", ca, false, x509.ExtKeyUsageClientAuth)
+	other := newTestCert(t, "other", nil, true, 0)
+	stranger := newTestCert(t, "stranger", other, false, x509.ExtKeyUsageClientAuth)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	addr := startProxy(t, ServerConfig{TLSCertFile: srvFile, TLSKeyFile: srvKeyFile, TLSCACertFile: caFile})
+	tests := []struct {
+		name  string
+		certs []tls.Certificate
+		ok    bool
+	}{
+		{"client certificate", []tls.Certificate{client.pair()}, true},
+		{"no client certificate", nil, false},
+		{"certificate of another CA", []tls.Certificate{stranger.pair()}, false},
+	}
+	for _, tt := range tests {
+		err := echo(addr, &tls.Config{RootCAs: roots, ServerName: "localhost", Certificates: tt.certs})
+		if tt.ok && err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%s: connected", tt.name)
+		}
+	}
+}
+
+func TestLoadTLSConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil, true, 0)
+	_, caKeyFile := ca.write(t, dir, "ca")
+	srvFile, srvKeyFile := newTestCert(t, "server", ca, false, x509.ExtKeyUsageServerAuth).write(t, dir, "server")
+
+	tests := []struct {
+		name string
+		cfg  ServerConfig
+	}{
+		{"no key", ServerConfig{TLSCertFile: srvFile}},
+		{"no certificate", ServerConfig{TLSKeyFile: srvKeyFile}},
+		{"missing file", ServerConfig{TLSCertFile: filepath.Join(dir, "none.crt"), TLSKeyFile: srvKeyFile}},
+		{"missing CA", ServerConfig{TLSCertFile: srvFile, TLSKeyFile: srvKeyFile, TLSCACertFile: filepath.Join(dir, "none.crt")}},
+		{"CA without certificate", ServerConfig{TLSCertFile: srvFile, TLSKeyFile: srvKeyFile, TLSCACertFile: caKeyFile}},
+	}
+	for _, tt := range tests {
+		if _, err := loadTLSConfig(tt.cfg); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+
+	cfg, err := loadTLSConfig(ServerConfig{TLSCertFile: srvFile, TLSKeyFile: srvKeyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ClientAuth != tls.NoClientCert || cfg.MinVersion != tls.VersionTLS12 {
+		t.Errorf("got client auth %v and min version %x", cfg.ClientAuth, cfg.MinVersion)
+	}
+}
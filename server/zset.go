@@ -0,0 +1,1112 @@
+package main
+
+import (
+	"errors"
+	"github.com/k-si/CaskDB"
+	"github.com/k-si/Kinx/kiface"
+	"github.com/k-si/Kinx/knet"
+	"log"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var ErrScoreBound = errors.New("ERR min or max is not a float")
+
+// zMember is a member of a sorted set with its score.
+type zMember struct {
+	member []byte
+	score  float64
+}
+
+// zMembers reads all the members of a sorted set, ordered by score and then
+// by member like the ranks are.
+func zMembers(db *CaskDB.DB, key []byte) ([]zMember, error) {
+	res, err := db.ZScoreRange(key, math.Inf(-1), math.Inf(1))
+	if err != nil {
+		return nil, err
+	}
+	// the reply alternates members and scores
+	var ms []zMember
+	for i := 0; i+1 < len(res); i += 2 {
+		ms = append(ms, zMember{member: []byte(res[i].(string)), score: res[i+1].(float64)})
+	}
+	zSortMembers(ms)
+	return ms, nil
+}
+
+// reverse reverses the order of ms in place.
+func reverse(ms []zMember) {
+	for i, j := 0, len(ms)-1; i < j; i, j = i+1, j-1 {
+		ms[i], ms[j] = ms[j], ms[i]
+	}
+}
+
+func formatScore(f float64) []byte {
+	switch {
+	case math.IsInf(f, 1):
+		return []byte("inf")
+	case math.IsInf(f, -1):
+		return []byte("-inf")
+	}
+	return []byte(strconv.FormatFloat(f, 'f', -1, 64))
+}
+
+// sendMembers replies with the members, each one followed by its score
+// when withScores is set.
+func sendMembers(req kiface.IRequest, ms []zMember, withScores bool) {
+	var res [][]byte
+	for _, m := range ms {
+		res = append(res, m.member)
+		if withScores {
+			res = append(res, formatScore(m.score))
+		}
+	}
+	sendList(req, res)
+}
+
+// rankRange normalizes the ranks start and stop of a sorted set of n
+// members, negative ranks count from the end.
+func rankRange(start, stop, n int) (int, int, bool) {
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if start > stop || start >= n {
+		return 0, 0, false
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	return start, stop, true
+}
+
+// scoreBound is a score range bound, exclusive bounds are prefixed with (.
+type scoreBound struct {
+	value     float64
+	exclusive bool
+}
+
+func parseScoreBound(b []byte) (scoreBound, error) {
+	var sb scoreBound
+	if len(b) > 0 && b[0] == '(' {
+		sb.exclusive = true
+		b = b[1:]
+	}
+	switch strings.ToLower(string(b)) {
+	case "-inf":
+		sb.value = math.Inf(-1)
+	case "+inf", "inf":
+		sb.value = math.Inf(1)
+	default:
+		f, err := strconv.ParseFloat(string(b), 64)
+		if err != nil || math.IsNaN(f) {
+			return sb, ErrScoreBound
+		}
+		sb.value = f
+	}
+	return sb, nil
+}
+
+// scoreRange is the range of scores between min and max.
+type scoreRange struct {
+	min, max scoreBound
+}
+
+func parseScoreRange(min, max []byte) (scoreRange, error) {
+	var sr scoreRange
+	var err error
+	if sr.min, err = parseScoreBound(min); err != nil {
+		return sr, err
+	}
+	sr.max, err = parseScoreBound(max)
+	return sr, err
+}
+
+func (sr scoreRange) contains(f float64) bool {
+	if f < sr.min.value || sr.min.exclusive && f == sr.min.value {
+		return false
+	}
+	if f > sr.max.value || sr.max.exclusive && f == sr.max.value {
+		return false
+	}
+	return true
+}
+
+// byScore keeps the members of ms with a score in sr.
+func byScore(ms []zMember, sr scoreRange) []zMember {
+	var res []zMember
+	for _, m := range ms {
+		if sr.contains(m.score) {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+// rangeOptions are the WITHSCORES and LIMIT options of the range commands.
+type rangeOptions struct {
+	withScores    bool
+	offset, count int
+}
+
+func parseRangeOptions(c [][]byte, withScores bool) (rangeOptions, error) {
+	opts := rangeOptions{count: -1}
+	for i := 0; i < len(c); i++ {
+		switch strings.ToLower(string(c[i])) {
+		case "withscores":
+			if !withScores {
+				return opts, ErrSyntax
+			}
+			opts.withScores = true
+		case "limit":
+			if i+2 >= len(c) {
+				return opts, ErrSyntax
+			}
+			var err error
+			if opts.offset, err = strconv.Atoi(string(c[i+1])); err != nil {
+				return opts, ErrNotInteger
+			}
+			if opts.count, err = strconv.Atoi(string(c[i+2])); err != nil {
+				return opts, ErrNotInteger
+			}
+			i += 2
+		default:
+			return opts, ErrSyntax
+		}
+	}
+	return opts, nil
+}
+
+// limit applies LIMIT to ms, a negative count returns all the members after
+// offset and a negative offset returns none.
+func (opts rangeOptions) limit(ms []zMember) []zMember {
+	if opts.offset < 0 || opts.offset >= len(ms) {
+		return nil
+	}
+	ms = ms[opts.offset:]
+	if opts.count >= 0 && opts.count < len(ms) {
+		ms = ms[:opts.count]
+	}
+	return ms
+}
+
+// zRange serves ZRANGE and ZREVRANGE.
+func zRange(req kiface.IRequest, rev bool) {
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	start, err := strconv.Atoi(string(c[1]))
+	var stop int
+	if err == nil {
+		stop, err = strconv.Atoi(string(c[2]))
+	}
+	if err != nil {
+		err = ErrNotInteger
+	}
+	withScores := false
+	if err == nil && len(c) > 3 {
+		if len(c) != 4 || strings.ToLower(string(c[3])) != "withscores" {
+			err = ErrSyntax
+		}
+		withScores = true
+	}
+	var ms []zMember
+	if err == nil {
+		ms, err = zMembers(s.db(req), c[0])
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	if rev {
+		reverse(ms)
+	}
+	start, stop, ok := rankRange(start, stop, len(ms))
+	if !ok {
+		ms = nil
+	} else {
+		ms = ms[start : stop+1]
+	}
+	sendMembers(req, ms, withScores)
+}
+
+type ZRangeRouter struct {
+	knet.BaseRouter
+}
+
+func (zrr *ZRangeRouter) Handle(req kiface.IRequest) {
+	log.Println("handle ZRange")
+	zRange(req, false)
+}
+
+type ZRevRangeRouter struct {
+	knet.BaseRouter
+}
+
+func (zrrr *ZRevRangeRouter) Handle(req kiface.IRequest) {
+	log.Println("handle ZRevRange")
+	zRange(req, true)
+}
+
+// zRangeByScore serves ZRANGEBYSCORE and ZREVRANGEBYSCORE, the latter takes
+// the max bound first.
+func zRangeByScore(req kiface.IRequest, rev bool) {
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	min, max := c[1], c[2]
+	if rev {
+		min, max = max, min
+	}
+	sr, err := parseScoreRange(min, max)
+	var opts rangeOptions
+	if err == nil {
+		opts, err = parseRangeOptions(c[3:], true)
+	}
+	var ms []zMember
+	if err == nil {
+		ms, err = zMembers(s.db(req), c[0])
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	ms = byScore(ms, sr)
+	if rev {
+		reverse(ms)
+	}
+	sendMembers(req, opts.limit(ms), opts.withScores)
+}
+
+type ZRangeByScoreRouter struct {
+	knet.BaseRouter
+}
+
+func (zrbsr *ZRangeByScoreRouter) Handle(req kiface.IRequest) {
+	log.Println("handle ZRangeByScore")
+	zRangeByScore(req, false)
+}
+
+type ZRevRangeByScoreRouter struct {
+	knet.BaseRouter
+}
+
+func (zrrbsr *ZRevRangeByScoreRouter) Handle(req kiface.IRequest) {
+	log.Println("handle ZRevRangeByScore")
+	zRangeByScore(req, true)
+}
+
+// zRank serves ZRANK and ZREVRANK, replying with the rank of a member and
+// optionally its score, or nil.
+func zRank(req kiface.IRequest, rev bool) {
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	withScore := false
+	var err error
+	if len(c) > 2 {
+		if len(c) != 3 || strings.ToLower(string(c[2])) != "withscore" {
+			err = ErrSyntax
+		}
+		withScore = true
+	}
+	var ms []zMember
+	if err == nil {
+		ms, err = zMembers(s.db(req), c[0])
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	if rev {
+		reverse(ms)
+	}
+	for i, m := range ms {
+		if string(m.member) != string(c[1]) {
+			continue
+		}
+		if withScore {
+			sendList(req, [][]byte{[]byte(strconv.Itoa(i)), formatScore(m.score)})
+			return
+		}
+		if err = req.GetConnection().SendMessage(200, []byte(strconv.Itoa(i))); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	if err = req.GetConnection().SendMessage(200, []byte("(nil)")); err != nil {
+		log.Println(err)
+	}
+}
+
+type ZRankRouter struct {
+	knet.BaseRouter
+}
+
+func (zrr *ZRankRouter) Handle(req kiface.IRequest) {
+	log.Println("handle ZRank")
+	zRank(req, false)
+}
+
+type ZRevRankRouter struct {
+	knet.BaseRouter
+}
+
+func (zrrr *ZRevRankRouter) Handle(req kiface.IRequest) {
+	log.Println("handle ZRevRank")
+	zRank(req, true)
+}
+
+type ZCountRouter struct {
+	knet.BaseRouter
+}
+
+func (zcr *ZCountRouter) Handle(req kiface.IRequest) {
+	log.Println("handle ZCount")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	sr, err := parseScoreRange(c[1], c[2])
+	var ms []zMember
+	if err == nil {
+		ms, err = zMembers(s.db(req), c[0])
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte(strconv.Itoa(len(byScore(ms, sr))))); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// parseScore parses a score, infinite scores are allowed.
+func parseScore(b []byte) (float64, error) {
+	f, err := strconv.ParseFloat(string(b), 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, ErrNotFloat
+	}
+	return f, nil
+}
+
+// zAddFlags are the options of ZADD.
+type zAddFlags struct {
+	nx, xx, gt, lt, ch, incr bool
+}
+
+// parseZAddFlags parses the flags leading the arguments of ZADD, it returns
+// the index of the first score.
+func parseZAddFlags(c [][]byte) (zAddFlags, int, error) {
+	var flags zAddFlags
+	i := 0
+loop:
+	for ; i < len(c); i++ {
+		switch strings.ToLower(string(c[i])) {
+		case "nx":
+			flags.nx = true
+		case "xx":
+			flags.xx = true
+		case "gt":
+			flags.gt = true
+		case "lt":
+			flags.lt = true
+		case "ch":
+			flags.ch = true
+		case "incr":
+			flags.incr = true
+		default:
+			break loop
+		}
+	}
+	if flags.nx && flags.xx {
+		return flags, i, errors.New("ERR XX and NX options at the same time are not compatible")
+	}
+	if flags.gt && flags.lt || flags.nx && (flags.gt || flags.lt) {
+		return flags, i, errors.New("ERR GT, LT, and/or NX options at the same time are not compatible")
+	}
+	return flags, i, nil
+}
+
+// results of zAdd
+const (
+	zAborted   = iota // a flag prevented the update
+	zAdded            // the member was added
+	zChanged          // the score of the member was updated
+	zUnchanged        // the member already had the score
+)
+
+// zAdd adds member to a sorted set or updates its score according to flags,
+// it returns the score of the member afterwards.
+func zAdd(db *CaskDB.DB, key []byte, flags zAddFlags, score float64, member []byte) (float64, int, error) {
+	exists, old := db.ZScore(key, member)
+	if flags.incr && exists {
+		score += old
+		if math.IsNaN(score) {
+			return 0, zAborted, errors.New("ERR resulting score is not a number (NaN)")
+		}
+	}
+
+	if !exists {
+		if flags.xx {
+			return 0, zAborted, nil
+		}
+		return score, zAdded, db.ZAdd(key, score, member)
+	}
+	if flags.nx || flags.gt && score <= old || flags.lt && score >= old {
+		return old, zAborted, nil
+	}
+	if score == old {
+		return score, zUnchanged, nil
+	}
+	return score, zChanged, db.ZAdd(key, score, member)
+}
+
+type ZIncrByRouter struct {
+	knet.BaseRouter
+}
+
+func (zibr *ZIncrByRouter) Handle(req kiface.IRequest) {
+	log.Println("handle ZIncrBy")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	incr, err := parseScore(c[1])
+	var score float64
+	if err == nil {
+		score, _, err = zAdd(s.db(req), c[0], zAddFlags{incr: true}, incr, c[2])
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, formatScore(score)); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// zRem removes the members ms from a sorted set.
+func zRem(db *CaskDB.DB, key []byte, ms []zMember) error {
+	for _, m := range ms {
+		if err := db.ZRem(key, m.member); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// zPop serves ZPOPMIN and ZPOPMAX, replying with the popped members and
+// their scores.
+func zPop(req kiface.IRequest, max bool) {
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	count, err := parseCount(c)
+	if err == nil && count < 0 {
+		err = errors.New("ERR value is out of range, must be positive")
+	}
+	var ms []zMember
+	if err == nil {
+		ms, err = zMembers(s.db(req), c[0])
+	}
+	if err == nil {
+		if max {
+			reverse(ms)
+		}
+		if count < len(ms) {
+			ms = ms[:count]
+		}
+		err = zRem(s.db(req), c[0], ms)
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	sendMembers(req, ms, true)
+}
+
+type ZPopMinRouter struct {
+	knet.BaseRouter
+}
+
+func (zpmr *ZPopMinRouter) Handle(req kiface.IRequest) {
+	log.Println("handle ZPopMin")
+	zPop(req, false)
+}
+
+type ZPopMaxRouter struct {
+	knet.BaseRouter
+}
+
+func (zpmr *ZPopMaxRouter) Handle(req kiface.IRequest) {
+	log.Println("handle ZPopMax")
+	zPop(req, true)
+}
+
+type ZRemRangeByScoreRouter struct {
+	knet.BaseRouter
+}
+
+func (zrrbsr *ZRemRangeByScoreRouter) Handle(req kiface.IRequest) {
+	log.Println("handle ZRemRangeByScore")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	sr, err := parseScoreRange(c[1], c[2])
+	var ms []zMember
+	if err == nil {
+		ms, err = zMembers(s.db(req), c[0])
+	}
+	if err == nil {
+		ms = byScore(ms, sr)
+		err = zRem(s.db(req), c[0], ms)
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte(strconv.Itoa(len(ms)))); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+type ZRemRangeByRankRouter struct {
+	knet.BaseRouter
+}
+
+func (zrrbrr *ZRemRangeByRankRouter) Handle(req kiface.IRequest) {
+	log.Println("handle ZRemRangeByRank")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	start, err := strconv.Atoi(string(c[1]))
+	var stop int
+	if err == nil {
+		stop, err = strconv.Atoi(string(c[2]))
+	}
+	if err != nil {
+		err = ErrNotInteger
+	}
+	var ms []zMember
+	if err == nil {
+		ms, err = zMembers(s.db(req), c[0])
+	}
+	if err == nil {
+		if start, stop, ok := rankRange(start, stop, len(ms)); ok {
+			ms = ms[start : stop+1]
+		} else {
+			ms = nil
+		}
+		err = zRem(s.db(req), c[0], ms)
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte(strconv.Itoa(len(ms)))); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// zSetOp are the arguments of the sorted set union, intersection and
+// difference commands.
+type zSetOp struct {
+	keys       [][]byte
+	weights    []float64
+	aggregate  string
+	withScores bool
+}
+
+// parseZSetOp parses numkeys, the keys and the options, the difference has
+// no WEIGHTS nor AGGREGATE and only the non store commands take WITHSCORES.
+func parseZSetOp(c [][]byte, diff, withScores bool) (zSetOp, error) {
+	op := zSetOp{aggregate: "sum"}
+	n, err := strconv.Atoi(string(c[0]))
+	if err != nil || n < 1 {
+		return op, ErrNumKeys
+	}
+	if n > len(c)-1 {
+		return op, ErrSyntax
+	}
+	op.keys = c[1 : n+1]
+	for i := 0; i < n; i++ {
+		op.weights = append(op.weights, 1)
+	}
+
+	for i := n + 1; i < len(c); i++ {
+		switch strings.ToLower(string(c[i])) {
+		case "weights":
+			if diff || i+n >= len(c) {
+				return op, ErrSyntax
+			}
+			for j := 0; j < n; j++ {
+				w, err := strconv.ParseFloat(string(c[i+1+j]), 64)
+				if err != nil || math.IsNaN(w) {
+					return op, errors.New("ERR weight value is not a float")
+				}
+				op.weights[j] = w
+			}
+			i += n
+		case "aggregate":
+			if diff || i+1 >= len(c) {
+				return op, ErrSyntax
+			}
+			op.aggregate = strings.ToLower(string(c[i+1]))
+			if op.aggregate != "sum" && op.aggregate != "min" && op.aggregate != "max" {
+				return op, ErrSyntax
+			}
+			i++
+		case "withscores":
+			if !withScores {
+				return op, ErrSyntax
+			}
+			op.withScores = true
+		default:
+			return op, ErrSyntax
+		}
+	}
+	return op, nil
+}
+
+// aggregateScores combines two scores of a member.
+func (op zSetOp) aggregateScores(a, b float64) float64 {
+	switch op.aggregate {
+	case "min":
+		return math.Min(a, b)
+	case "max":
+		return math.Max(a, b)
+	}
+	// inf + -inf counts as 0
+	if f := a + b; !math.IsNaN(f) {
+		return f
+	}
+	return 0
+}
+
+// weighted multiplies a score by a weight, 0 * inf counts as 0.
+func weighted(score, weight float64) float64 {
+	if f := score * weight; !math.IsNaN(f) {
+		return f
+	}
+	return 0
+}
+
+// zSortMembers orders ms like the ranks are.
+func zSortMembers(ms []zMember) {
+	sort.SliceStable(ms, func(i, j int) bool {
+		if ms[i].score != ms[j].score {
+			return ms[i].score < ms[j].score
+		}
+		return string(ms[i].member) < string(ms[j].member)
+	})
+}
+
+// zUnion computes the weighted union of the sorted sets of op.
+func zUnion(db *CaskDB.DB, op zSetOp) ([]zMember, error) {
+	scores := make(map[string]float64)
+	var order []string
+	for i, key := range op.keys {
+		ms, err := zMembers(db, key)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range ms {
+			score := weighted(m.score, op.weights[i])
+			old, ok := scores[string(m.member)]
+			if !ok {
+				order = append(order, string(m.member))
+				scores[string(m.member)] = score
+			} else {
+				scores[string(m.member)] = op.aggregateScores(old, score)
+			}
+		}
+	}
+	res := make([]zMember, 0, len(order))
+	for _, m := range order {
+		res = append(res, zMember{member: []byte(m), score: scores[m]})
+	}
+	zSortMembers(res)
+	return res, nil
+}
+
+// zInter computes the weighted intersection of the sorted sets of op.
+func zInter(db *CaskDB.DB, op zSetOp) ([]zMember, error) {
+	res, err := zMembers(db, op.keys[0])
+	if err != nil {
+		return nil, err
+	}
+	for i := range res {
+		res[i].score = weighted(res[i].score, op.weights[0])
+	}
+	for i, key := range op.keys[1:] {
+		var kept []zMember
+		for _, m := range res {
+			if ok, score := db.ZScore(key, m.member); ok {
+				m.score = op.aggregateScores(m.score, weighted(score, op.weights[i+1]))
+				kept = append(kept, m)
+			}
+		}
+		res = kept
+	}
+	zSortMembers(res)
+	return res, nil
+}
+
+// zDiff computes the members of the first sorted set of op missing from
+// the others.
+func zDiff(db *CaskDB.DB, op zSetOp) ([]zMember, error) {
+	ms, err := zMembers(db, op.keys[0])
+	if err != nil {
+		return nil, err
+	}
+	var res []zMember
+	for _, m := range ms {
+		found := false
+		for _, key := range op.keys[1:] {
+			if db.ZIsMember(key, m.member) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			res = append(res, m)
+		}
+	}
+	return res, nil
+}
+
+// zSetCompute serves ZUNION, ZINTER and ZDIFF.
+func zSetCompute(req kiface.IRequest, diff bool, compute func(db *CaskDB.DB, op zSetOp) ([]zMember, error)) {
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	op, err := parseZSetOp(c, diff, true)
+	var res []zMember
+	if err == nil {
+		res, err = compute(s.db(req), op)
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	sendMembers(req, res, op.withScores)
+}
+
+// zSetStore serves the *STORE commands, replacing the destination key by
+// the result and replying with its cardinality.
+func zSetStore(req kiface.IRequest, diff bool, compute func(db *CaskDB.DB, op zSetOp) ([]zMember, error)) {
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	db := s.db(req)
+	op, err := parseZSetOp(c[1:], diff, false)
+	var res []zMember
+	if err == nil {
+		res, err = compute(db, op)
+	}
+	// the destination is overwritten whatever its type
+	if err == nil {
+		_, err = delKey(db, c[0])
+	}
+	for i := 0; i < len(res) && err == nil; i++ {
+		err = db.ZAdd(c[0], res[i].score, res[i].member)
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte(strconv.Itoa(len(res)))); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+// zSetStoreKeys picks the destination and the numkeys keys of the *STORE
+// commands.
+func zSetStoreKeys(args [][]byte) [][]byte {
+	return append([][]byte{args[0]}, numKeys(args[1:])...)
+}
+
+type ZUnionRouter struct {
+	knet.BaseRouter
+}
+
+func (zur *ZUnionRouter) keys(args [][]byte) [][]byte {
+	return numKeys(args)
+}
+
+func (zur *ZUnionRouter) Handle(req kiface.IRequest) {
+	log.Println("handle ZUnion")
+	zSetCompute(req, false, zUnion)
+}
+
+type ZInterRouter struct {
+	knet.BaseRouter
+}
+
+func (zir *ZInterRouter) keys(args [][]byte) [][]byte {
+	return numKeys(args)
+}
+
+func (zir *ZInterRouter) Handle(req kiface.IRequest) {
+	log.Println("handle ZInter")
+	zSetCompute(req, false, zInter)
+}
+
+type ZDiffRouter struct {
+	knet.BaseRouter
+}
+
+func (zdr *ZDiffRouter) keys(args [][]byte) [][]byte {
+	return numKeys(args)
+}
+
+func (zdr *ZDiffRouter) Handle(req kiface.IRequest) {
+	log.Println("handle ZDiff")
+	zSetCompute(req, true, zDiff)
+}
+
+type ZUnionStoreRouter struct {
+	knet.BaseRouter
+}
+
+func (zusr *ZUnionStoreRouter) keys(args [][]byte) [][]byte {
+	return zSetStoreKeys(args)
+}
+
+func (zusr *ZUnionStoreRouter) sources(args [][]byte) [][]byte {
+	return numKeys(args[1:])
+}
+
+func (zusr *ZUnionStoreRouter) Handle(req kiface.IRequest) {
+	log.Println("handle ZUnionStore")
+	zSetStore(req, false, zUnion)
+}
+
+type ZInterStoreRouter struct {
+	knet.BaseRouter
+}
+
+func (zisr *ZInterStoreRouter) keys(args [][]byte) [][]byte {
+	return zSetStoreKeys(args)
+}
+
+func (zisr *ZInterStoreRouter) sources(args [][]byte) [][]byte {
+	return numKeys(args[1:])
+}
+
+func (zisr *ZInterStoreRouter) Handle(req kiface.IRequest) {
+	log.Println("handle ZInterStore")
+	zSetStore(req, false, zInter)
+}
+
+type ZDiffStoreRouter struct {
+	knet.BaseRouter
+}
+
+func (zdsr *ZDiffStoreRouter) keys(args [][]byte) [][]byte {
+	return zSetStoreKeys(args)
+}
+
+func (zdsr *ZDiffStoreRouter) sources(args [][]byte) [][]byte {
+	return numKeys(args[1:])
+}
+
+func (zdsr *ZDiffStoreRouter) Handle(req kiface.IRequest) {
+	log.Println("handle ZDiffStore")
+	zSetStore(req, true, zDiff)
+}
+
+var ErrLexBound = errors.New("ERR min or max not valid string range item")
+
+// lexBound is a member range bound: - and + are the infinite bounds, [ and (
+// prefix the inclusive and exclusive ones.
+type lexBound struct {
+	value     string
+	exclusive bool
+	inf       int // -1 for -, 1 for +
+}
+
+func parseLexBound(b []byte) (lexBound, error) {
+	var lb lexBound
+	switch {
+	case string(b) == "-":
+		lb.inf = -1
+	case string(b) == "+":
+		lb.inf = 1
+	case len(b) > 0 && b[0] == '[':
+		lb.value = string(b[1:])
+	case len(b) > 0 && b[0] == '(':
+		lb.value, lb.exclusive = string(b[1:]), true
+	default:
+		return lb, ErrLexBound
+	}
+	return lb, nil
+}
+
+// lexRange is the range of members between min and max, it is meaningful
+// when all the members have the same score.
+type lexRange struct {
+	min, max lexBound
+}
+
+func parseLexRange(min, max []byte) (lexRange, error) {
+	var lr lexRange
+	var err error
+	if lr.min, err = parseLexBound(min); err != nil {
+		return lr, err
+	}
+	lr.max, err = parseLexBound(max)
+	return lr, err
+}
+
+func (lr lexRange) contains(m string) bool {
+	switch lr.min.inf {
+	case 1:
+		return false
+	case 0:
+		if m < lr.min.value || lr.min.exclusive && m == lr.min.value {
+			return false
+		}
+	}
+	switch lr.max.inf {
+	case -1:
+		return false
+	case 0:
+		if m > lr.max.value || lr.max.exclusive && m == lr.max.value {
+			return false
+		}
+	}
+	return true
+}
+
+// byLex keeps the members of ms in lr.
+func byLex(ms []zMember, lr lexRange) []zMember {
+	var res []zMember
+	for _, m := range ms {
+		if lr.contains(string(m.member)) {
+			res = append(res, m)
+		}
+	}
+	return res
+}
+
+// zRangeByLex serves ZRANGEBYLEX and ZREVRANGEBYLEX, the latter takes the
+// max bound first.
+func zRangeByLex(req kiface.IRequest, rev bool) {
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	min, max := c[1], c[2]
+	if rev {
+		min, max = max, min
+	}
+	lr, err := parseLexRange(min, max)
+	var opts rangeOptions
+	if err == nil {
+		opts, err = parseRangeOptions(c[3:], false)
+	}
+	var ms []zMember
+	if err == nil {
+		ms, err = zMembers(s.db(req), c[0])
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	ms = byLex(ms, lr)
+	if rev {
+		reverse(ms)
+	}
+	sendMembers(req, opts.limit(ms), false)
+}
+
+type ZRangeByLexRouter struct {
+	knet.BaseRouter
+}
+
+func (zrblr *ZRangeByLexRouter) Handle(req kiface.IRequest) {
+	log.Println("handle ZRangeByLex")
+	zRangeByLex(req, false)
+}
+
+type ZRevRangeByLexRouter struct {
+	knet.BaseRouter
+}
+
+func (zrrblr *ZRevRangeByLexRouter) Handle(req kiface.IRequest) {
+	log.Println("handle ZRevRangeByLex")
+	zRangeByLex(req, true)
+}
+
+type ZLexCountRouter struct {
+	knet.BaseRouter
+}
+
+func (zlcr *ZLexCountRouter) Handle(req kiface.IRequest) {
+	log.Println("handle ZLexCount")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	lr, err := parseLexRange(c[1], c[2])
+	var ms []zMember
+	if err == nil {
+		ms, err = zMembers(s.db(req), c[0])
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte(strconv.Itoa(len(byLex(ms, lr))))); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+type ZRemRangeByLexRouter struct {
+	knet.BaseRouter
+}
+
+func (zrrblr *ZRemRangeByLexRouter) Handle(req kiface.IRequest) {
+	log.Println("handle ZRemRangeByLex")
+	c := parseCommand(string(req.GetMsg().GetMsgData()))
+
+	lr, err := parseLexRange(c[1], c[2])
+	var ms []zMember
+	if err == nil {
+		ms, err = zMembers(s.db(req), c[0])
+	}
+	if err == nil {
+		ms = byLex(ms, lr)
+		err = zRem(s.db(req), c[0], ms)
+	}
+	if err != nil {
+		if err = req.GetConnection().SendMessage(400, []byte(err.Error())); err != nil {
+			log.Println(err)
+		}
+	} else {
+		if err = req.GetConnection().SendMessage(200, []byte(strconv.Itoa(len(ms)))); err != nil {
+			log.Println(err)
+		}
+	}
+}